@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"net/http"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 	"th_payment_processor/internal/config"
 	"th_payment_processor/internal/handlers"
+	"th_payment_processor/internal/middleware"
 	"th_payment_processor/internal/services"
 	"th_payment_processor/internal/storage"
 	"th_payment_processor/internal/tracing"
+	"time"
 )
 
 func main() {
@@ -26,19 +33,87 @@ func main() {
 
 	// configs
 	cfg := config.Load()
+	if _, err := services.NewProcessorRegistry(cfg); err != nil {
+		logrus.Fatalf("Invalid processor configuration: %v", err)
+	}
 
 	//  storage
-	storage := storage.NewInMemoryStorage()
+	storage, err := storage.Open(cfg)
+	if err != nil {
+		logrus.Fatalf("Failed to open storage: %v", err)
+	}
+	defer func() {
+		if err := storage.Close(); err != nil {
+			logrus.Errorf("Failed to close storage: %v", err)
+		}
+	}()
+
+	// SIGTERM/SIGINT start a graceful shutdown
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stopSignals()
 
 	// init services
 	paymentService := services.NewPaymentService(cfg, storage)
 
+	// background work runs until the HTTP server has stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	//  health monitoring in background
-	ctx := context.Background()
 	go paymentService.StartHealthMonitoring(ctx)
 
+	// payment workers draining the intake queue
+	workersDone := make(chan struct{})
+	go func() {
+		paymentService.StartWorkers(ctx)
+		close(workersDone)
+	}()
+
+	// second lookups of losing hedged requests; they outlive the workers,
+	// whose last payments may still queue some
+	rechecksCtx, stopRechecks := context.WithCancel(context.Background())
+	defer stopRechecks()
+	rechecksDone := make(chan struct{})
+	go func() {
+		paymentService.StartHedgeRechecks(rechecksCtx)
+		close(rechecksDone)
+	}()
+
+	// retries for payments both processors rejected, including those a
+	// previous run left unfinished
+	paymentService.RecoverRetries()
+	go paymentService.StartRetryScheduler(ctx)
+
+	// release authorizations nobody captured
+	go paymentService.StartAuthorizationExpiry(ctx)
+
+	// cross-check our totals with the processors' own summaries
+	go paymentService.StartReconciliation(ctx)
+
+	// resend refunds whose outcome is not known
+	go paymentService.StartRefundRetries(ctx)
+
+	// learn what each processor charges per payment
+	go paymentService.StartFeeDiscovery(ctx)
+
+	// deliver payment events to registered webhooks
+	go paymentService.Webhooks().Start(ctx)
+
+	// stored responses for Idempotency-Key replays
+	idempotencyStore := middleware.NewIdempotencyStore(cfg.IdempotencyTTL)
+	if cfg.StorageBackend == "file" {
+		idempotencyStore, err = middleware.OpenIdempotencyStore(cfg.IdempotencyTTL, filepath.Join(cfg.StorageDir, "idempotency.log"))
+		if err != nil {
+			logrus.Fatalf("Failed to open idempotency store: %v", err)
+		}
+	}
+	defer idempotencyStore.Close()
+	go idempotencyStore.StartExpiry(ctx, cfg.IdempotencyExpiryInterval)
+
 	// init handlers
 	handler := handlers.NewPaymentHandler(paymentService)
+	webhookHandler := handlers.NewWebhookHandler(paymentService.Webhooks())
+	eventHandler := handlers.NewEventHandler(paymentService.Events(), cfg.EventsHeartbeatInterval)
 
 	//  Gin router
 	gin.SetMode(gin.ReleaseMode)
@@ -49,12 +124,68 @@ func main() {
 	router.Use(gin.Logger())
 	router.Use(otelgin.Middleware("rinha-backend"))
 
+	// webhook and admin routes require ADMIN_TOKEN in X-Rinha-Token
+	if cfg.AdminToken == "" {
+		logrus.Warn("ADMIN_TOKEN is not set; webhook and admin routes will reject every request")
+	}
+	adminAuth := middleware.AdminAuth(cfg.AdminToken)
+
 	//  routes
-	router.POST("/payments", handler.ProcessPayment)
+	router.POST("/payments", middleware.Idempotency(idempotencyStore), handler.ProcessPayment)
+	router.GET("/payments", handler.ListPayments)
+	router.GET("/payments/:correlationId", handler.GetPayment)
+	router.POST("/payments/:correlationId/refunds", middleware.Idempotency(idempotencyStore), handler.RefundPayment)
+	router.POST("/payments/batch", middleware.Idempotency(idempotencyStore), handler.ProcessBatch)
+	router.POST("/payments/authorize", middleware.Idempotency(idempotencyStore), handler.AuthorizePayment)
+	router.POST("/payments/:correlationId/capture", middleware.Idempotency(idempotencyStore), handler.CapturePayment)
+	router.POST("/payments/:correlationId/void", middleware.Idempotency(idempotencyStore), handler.VoidPayment)
 	router.GET("/payments-summary", handler.GetPaymentsSummary)
+	router.GET("/queue-stats", handler.GetQueueStats)
+	router.GET("/events", eventHandler.StreamEvents)
+	router.POST("/webhooks", adminAuth, webhookHandler.RegisterWebhook)
+	router.GET("/webhooks", adminAuth, webhookHandler.ListWebhooks)
+	router.DELETE("/webhooks/:id", adminAuth, webhookHandler.DeleteWebhook)
+	router.GET("/webhooks/dead-letters", adminAuth, webhookHandler.ListDeadLetters)
+	router.POST("/webhooks/dead-letters/:id/replay", adminAuth, webhookHandler.ReplayDeadLetter)
+	router.POST("/admin/reconciliations", adminAuth, handler.RunReconciliation)
+	router.GET("/admin/reconciliations", adminAuth, handler.ListReconciliations)
+	router.GET("/admin/reconciliations/:id", adminAuth, handler.GetReconciliation)
 
-	logrus.Infof("Starting rinha-backend on port %s", cfg.ServerPort)
-	if err := router.Run(":" + cfg.ServerPort); err != nil {
-		logrus.Fatalf("Failed to start server: %v", err)
+	server := &http.Server{Addr: ":" + cfg.ServerPort, Handler: router}
+	serverErr := make(chan error, 1)
+	go func() {
+		logrus.Infof("Starting rinha-backend on port %s", cfg.ServerPort)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("Failed to start server: %v", err)
+		}
+	case <-signals.Done():
+		logrus.Info("Shutting down")
+	}
+
+	// Finish in-flight requests; event streams and other stragglers are cut
+	// off after the timeout
+	shutdownTimeout := cfg.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = 10 * time.Second
 	}
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logrus.Warnf("HTTP shutdown did not finish cleanly: %v", err)
+		server.Close()
+	}
+
+	// Stop the background loops and let the workers drain the queue, then
+	// run the hedge rechecks still waiting, before storage is closed by the
+	// deferred Close
+	cancel()
+	<-workersDone
+	stopRechecks()
+	<-rechecksDone
+	logrus.Info("Shutdown complete")
 }
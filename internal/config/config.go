@@ -1,32 +1,245 @@
 package config
 
 import (
+	"encoding/json"
 	"os"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
+// ProcessorConfig describes one payment processor in the PROCESSORS list.
+type ProcessorConfig struct {
+	Name          string
+	URL           string
+	Priority      int
+	FeePercentage float64
+	Timeout       time.Duration
+	// AdminToken authenticates reconciliation against the processor's
+	// admin summary; empty uses ProcessorAdminToken
+	AdminToken string
+}
+
 type Config struct {
 	ServerPort string
+	ShutdownTimeout time.Duration
+	// X-Rinha-Token required on the webhook and admin routes; empty
+	// locks them
+	AdminToken string
 	DefaultProcessorURL string
 	FallbackProcessorURL string
 	HealthCheckInterval time.Duration
 	RequestTimeout time.Duration
+	WorkerCount int
+	QueueSize int
+	RetryMaxAttempts int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay time.Duration
+	RetryDeadline time.Duration
+	StorageBackend string
+	StorageDir string
+	StorageFsync string
+	StorageFsyncInterval time.Duration
+	StorageSnapshotInterval time.Duration
+	PeerURLs []string
+	PeerTimeout time.Duration
+	DefaultProcessorFee float64
+	FallbackProcessorFee float64
+	RoutingPolicy string
+	RoutingLatencyBudget time.Duration
+	RoutingWeights string
+	Processors []ProcessorConfig
+	CircuitFailureThreshold int
+	CircuitTimeoutThreshold int
+	CircuitErrorRate float64
+	CircuitMinRequests int
+	CircuitWindow time.Duration
+	CircuitOpenTimeout time.Duration
+	CircuitHalfOpenRequests int
+	HedgingEnabled bool
+	HedgeDelayMultiplier float64
+	HedgeMinDelay time.Duration
+	HedgeMaxDelay time.Duration
+	IdempotencyTTL time.Duration
+	IdempotencyExpiryInterval time.Duration
+	AuthorizationTTL time.Duration
+	AuthorizationExpiryInterval time.Duration
+	RefundRetryInterval time.Duration
+	BatchMaxSize int
+	BatchConcurrency int
+	WebhookTimeout time.Duration
+	WebhookMaxAttempts int
+	WebhookBaseDelay time.Duration
+	WebhookMaxDelay time.Duration
+	WebhookConcurrency int
+	WebhookQueueSize int
+	// Webhook hosts exempt from the public-address check
+	WebhookAllowedHosts []string
+	EventsBufferSize int
+	EventsHeartbeatInterval time.Duration
+	ProcessorAdminToken string
+	ReconciliationEnabled bool
+	ReconciliationInterval time.Duration
+	ReconciliationDelay time.Duration
+	ReconciliationHistory int
+	// How far the processors' clocks may be off ours at the window's edges
+	ReconciliationClockSkew time.Duration
+	FeeDiscoveryEnabled bool
+	FeeRefreshInterval time.Duration
 }
 
 func Load() *Config {
 	serverPort := getEnv("SERVER_PORT", "8080")
+	shutdownTimeout := getEnvAsDuration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	adminToken := getEnv("ADMIN_TOKEN", "")
 	defaultProcessorURL := getEnv("DEFAULT_PROCESSOR_URL", "http://payment-processor-default:8080")
 	fallbackProcessorURL := getEnv("FALLBACK_PROCESSOR_URL", "http://payment-processor-fallback:8080")
 	
 	healthCheckInterval := getEnvAsDuration("HEALTH_CHECK_INTERVAL", 5*time.Second)
 	requestTimeout := getEnvAsDuration("REQUEST_TIMEOUT", 10*time.Second)
 
+	workerCount := getEnvAsInt("WORKER_COUNT", 16)
+	queueSize := getEnvAsInt("QUEUE_SIZE", 10000)
+
+	retryMaxAttempts := getEnvAsInt("RETRY_MAX_ATTEMPTS", 5)
+	retryBaseDelay := getEnvAsDuration("RETRY_BASE_DELAY", 1*time.Second)
+	retryMaxDelay := getEnvAsDuration("RETRY_MAX_DELAY", 30*time.Second)
+	retryDeadline := getEnvAsDuration("RETRY_DEADLINE", 5*time.Minute)
+
+	storageBackend := getEnv("STORAGE_BACKEND", "memory")
+	storageDir := getEnv("STORAGE_DIR", "./data")
+	storageFsync := getEnv("STORAGE_FSYNC", "interval")
+	storageFsyncInterval := getEnvAsDuration("STORAGE_FSYNC_INTERVAL", 1*time.Second)
+	storageSnapshotInterval := getEnvAsDuration("STORAGE_SNAPSHOT_INTERVAL", 1*time.Minute)
+
+	peerURLs := getEnvAsList("PEER_URLS")
+	peerTimeout := getEnvAsDuration("PEER_TIMEOUT", 2*time.Second)
+
+	defaultProcessorFee := getEnvAsFloat("DEFAULT_PROCESSOR_FEE", 1.0)
+	fallbackProcessorFee := getEnvAsFloat("FALLBACK_PROCESSOR_FEE", 5.0)
+	routingPolicy := getEnv("ROUTING_POLICY", "priority")
+	routingLatencyBudget := getEnvAsDuration("ROUTING_LATENCY_BUDGET", 200*time.Millisecond)
+	routingWeights := getEnv("ROUTING_WEIGHTS", "default=90,fallback=10")
+
+	processors := getEnvAsProcessors("PROCESSORS")
+
+	circuitFailureThreshold := getEnvAsInt("CIRCUIT_FAILURE_THRESHOLD", 5)
+	circuitTimeoutThreshold := getEnvAsInt("CIRCUIT_TIMEOUT_THRESHOLD", 3)
+	circuitErrorRate := getEnvAsFloat("CIRCUIT_ERROR_RATE", 0.5)
+	circuitMinRequests := getEnvAsInt("CIRCUIT_MIN_REQUESTS", 20)
+	circuitWindow := getEnvAsDuration("CIRCUIT_WINDOW", 10*time.Second)
+	circuitOpenTimeout := getEnvAsDuration("CIRCUIT_OPEN_TIMEOUT", 5*time.Second)
+	circuitHalfOpenRequests := getEnvAsInt("CIRCUIT_HALF_OPEN_REQUESTS", 1)
+
+	hedgingEnabled := getEnvAsBool("HEDGING_ENABLED", false)
+	hedgeDelayMultiplier := getEnvAsFloat("HEDGE_DELAY_MULTIPLIER", 2.0)
+	hedgeMinDelay := getEnvAsDuration("HEDGE_MIN_DELAY", 50*time.Millisecond)
+	hedgeMaxDelay := getEnvAsDuration("HEDGE_MAX_DELAY", 1*time.Second)
+
+	idempotencyTTL := getEnvAsDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+	idempotencyExpiryInterval := getEnvAsDuration("IDEMPOTENCY_EXPIRY_INTERVAL", 1*time.Minute)
+
+	authorizationTTL := getEnvAsDuration("AUTHORIZATION_TTL", 7*24*time.Hour)
+	authorizationExpiryInterval := getEnvAsDuration("AUTHORIZATION_EXPIRY_INTERVAL", 1*time.Minute)
+	refundRetryInterval := getEnvAsDuration("REFUND_RETRY_INTERVAL", 30*time.Second)
+
+	batchMaxSize := getEnvAsInt("BATCH_MAX_SIZE", 10000)
+	batchConcurrency := getEnvAsInt("BATCH_CONCURRENCY", 16)
+
+	webhookTimeout := getEnvAsDuration("WEBHOOK_TIMEOUT", 5*time.Second)
+	webhookMaxAttempts := getEnvAsInt("WEBHOOK_MAX_ATTEMPTS", 8)
+	webhookBaseDelay := getEnvAsDuration("WEBHOOK_BASE_DELAY", 1*time.Second)
+	webhookMaxDelay := getEnvAsDuration("WEBHOOK_MAX_DELAY", 5*time.Minute)
+	webhookConcurrency := getEnvAsInt("WEBHOOK_CONCURRENCY", 4)
+	webhookQueueSize := getEnvAsInt("WEBHOOK_QUEUE_SIZE", 10000)
+	webhookAllowedHosts := getEnvAsList("WEBHOOK_ALLOWED_HOSTS")
+
+	eventsBufferSize := getEnvAsInt("EVENTS_BUFFER_SIZE", 256)
+	eventsHeartbeatInterval := getEnvAsDuration("EVENTS_HEARTBEAT_INTERVAL", 15*time.Second)
+
+	processorAdminToken := getEnv("PROCESSOR_ADMIN_TOKEN", "")
+	// Every instance would run the same scheduled check, so with peers only
+	// the one it is enabled on does
+	reconciliationEnabled := getEnvAsBool("RECONCILIATION_ENABLED", len(peerURLs) == 0)
+	reconciliationInterval := getEnvAsDuration("RECONCILIATION_INTERVAL", 5*time.Minute)
+	reconciliationDelay := getEnvAsDuration("RECONCILIATION_DELAY", 1*time.Minute)
+	reconciliationHistory := getEnvAsInt("RECONCILIATION_HISTORY", 100)
+	reconciliationClockSkew := getEnvAsDuration("RECONCILIATION_CLOCK_SKEW", 2*time.Second)
+
+	feeDiscoveryEnabled := getEnvAsBool("FEE_DISCOVERY_ENABLED", true)
+	feeRefreshInterval := getEnvAsDuration("FEE_REFRESH_INTERVAL", 5*time.Minute)
+
+	// Both ask the processors' admin endpoints, which refuse a missing token
+	if !processorTokensSet(processorAdminToken, processors) && (reconciliationEnabled || feeDiscoveryEnabled) {
+		logrus.Warn("PROCESSOR_ADMIN_TOKEN is not set; reconciliation and fee discovery are disabled")
+		reconciliationEnabled = false
+		feeDiscoveryEnabled = false
+	}
+
 	return &Config{
 		ServerPort: serverPort,
+		ShutdownTimeout: shutdownTimeout,
+		AdminToken: adminToken,
 		DefaultProcessorURL: defaultProcessorURL,
 		FallbackProcessorURL: fallbackProcessorURL,
 		HealthCheckInterval: healthCheckInterval,
 		RequestTimeout: requestTimeout,
+		WorkerCount: workerCount,
+		QueueSize: queueSize,
+		RetryMaxAttempts: retryMaxAttempts,
+		RetryBaseDelay: retryBaseDelay,
+		RetryMaxDelay: retryMaxDelay,
+		RetryDeadline: retryDeadline,
+		StorageBackend: storageBackend,
+		StorageDir: storageDir,
+		StorageFsync: storageFsync,
+		StorageFsyncInterval: storageFsyncInterval,
+		StorageSnapshotInterval: storageSnapshotInterval,
+		PeerURLs: peerURLs,
+		PeerTimeout: peerTimeout,
+		DefaultProcessorFee: defaultProcessorFee,
+		FallbackProcessorFee: fallbackProcessorFee,
+		RoutingPolicy: routingPolicy,
+		RoutingLatencyBudget: routingLatencyBudget,
+		RoutingWeights: routingWeights,
+		Processors: processors,
+		CircuitFailureThreshold: circuitFailureThreshold,
+		CircuitTimeoutThreshold: circuitTimeoutThreshold,
+		CircuitErrorRate: circuitErrorRate,
+		CircuitMinRequests: circuitMinRequests,
+		CircuitWindow: circuitWindow,
+		CircuitOpenTimeout: circuitOpenTimeout,
+		CircuitHalfOpenRequests: circuitHalfOpenRequests,
+		HedgingEnabled: hedgingEnabled,
+		HedgeDelayMultiplier: hedgeDelayMultiplier,
+		HedgeMinDelay: hedgeMinDelay,
+		HedgeMaxDelay: hedgeMaxDelay,
+		IdempotencyTTL: idempotencyTTL,
+		IdempotencyExpiryInterval: idempotencyExpiryInterval,
+		AuthorizationTTL: authorizationTTL,
+		AuthorizationExpiryInterval: authorizationExpiryInterval,
+		RefundRetryInterval: refundRetryInterval,
+		BatchMaxSize: batchMaxSize,
+		BatchConcurrency: batchConcurrency,
+		WebhookTimeout: webhookTimeout,
+		WebhookMaxAttempts: webhookMaxAttempts,
+		WebhookBaseDelay: webhookBaseDelay,
+		WebhookMaxDelay: webhookMaxDelay,
+		WebhookConcurrency: webhookConcurrency,
+		WebhookQueueSize: webhookQueueSize,
+		WebhookAllowedHosts: webhookAllowedHosts,
+		EventsBufferSize: eventsBufferSize,
+		EventsHeartbeatInterval: eventsHeartbeatInterval,
+		ProcessorAdminToken: processorAdminToken,
+		ReconciliationEnabled: reconciliationEnabled,
+		ReconciliationInterval: reconciliationInterval,
+		ReconciliationDelay: reconciliationDelay,
+		ReconciliationHistory: reconciliationHistory,
+		ReconciliationClockSkew: reconciliationClockSkew,
+		FeeDiscoveryEnabled: feeDiscoveryEnabled,
+		FeeRefreshInterval: feeRefreshInterval,
 	}
 }
 
@@ -44,4 +257,107 @@ func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
 		}
 	}
 	return defaultValue
-} 
\ No newline at end of file
+}
+
+func getEnvAsInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// processorTokensSet reports whether every processor has an admin token,
+// its own or token.
+func processorTokensSet(token string, processors []ProcessorConfig) bool {
+	if token != "" {
+		return true
+	}
+	if len(processors) == 0 {
+		return false
+	}
+	for _, p := range processors {
+		if p.AdminToken == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// getEnvAsProcessors parses a JSON processor list such as
+// [{"name":"default","url":"http://pp-default:8080","priority":1,"fee":1.0,"timeout":"5s","adminToken":"123"}].
+// Invalid entries are logged and skipped.
+func getEnvAsProcessors(key string) []ProcessorConfig {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+
+	var raw []struct {
+		Name     string  `json:"name"`
+		URL      string  `json:"url"`
+		Priority int     `json:"priority"`
+		Fee      float64 `json:"fee"`
+		Timeout    string  `json:"timeout"`
+		AdminToken string  `json:"adminToken"`
+	}
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		logrus.Errorf("Invalid %s, falling back to default/fallback processors: %v", key, err)
+		return nil
+	}
+
+	processors := make([]ProcessorConfig, 0, len(raw))
+	for i, entry := range raw {
+		if entry.Name == "" || entry.URL == "" {
+			logrus.Errorf("Skipping %s entry %d: name and url are required", key, i)
+			continue
+		}
+		var timeout time.Duration
+		if entry.Timeout != "" {
+			parsed, err := time.ParseDuration(entry.Timeout)
+			if err != nil {
+				logrus.Errorf("Skipping %s entry %q: invalid timeout: %v", key, entry.Name, err)
+				continue
+			}
+			timeout = parsed
+		}
+		processors = append(processors, ProcessorConfig{
+			Name:          entry.Name,
+			URL:           entry.URL,
+			Priority:      entry.Priority,
+			FeePercentage: entry.Fee,
+			Timeout:       timeout,
+			AdminToken:    entry.AdminToken,
+		})
+	}
+	return processors
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/sirupsen/logrus"
+	"th_payment_processor/internal/models"
+	"th_payment_processor/internal/services"
+)
+
+// maxBatchLineSize bounds a single NDJSON line.
+const maxBatchLineSize = 64 * 1024
+
+// ProcessBatch handles POST /payments/batch
+func (h *PaymentHandler) ProcessBatch(c *gin.Context) {
+	var items []json.RawMessage
+	var err error
+	switch c.ContentType() {
+	case "application/x-ndjson", "application/ndjson":
+		items, err = readNDJSONBatch(c.Request.Body, h.paymentService.MaxBatchSize())
+	default:
+		items, err = readJSONBatch(c.Request.Body, h.paymentService.MaxBatchSize())
+	}
+	switch {
+	case errors.Is(err, services.ErrBatchTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Batch exceeds %d payments", h.paymentService.MaxBatchSize())})
+		return
+	case err != nil:
+		logrus.Errorf("Invalid batch request: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	case len(items) == 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Batch is empty"})
+		return
+	}
+
+	// Invalid items are rejected on their own; the rest of the batch still runs
+	results := make([]models.BatchItemResult, len(items))
+	var reqs []*models.PaymentRequest
+	var positions []int
+	for i, item := range items {
+		var req models.PaymentRequest
+		err := json.Unmarshal(item, &req)
+		if err == nil {
+			err = binding.Validator.ValidateStruct(&req)
+		}
+		if err != nil {
+			results[i] = models.BatchItemResult{Index: i, CorrelationID: req.CorrelationID, Status: models.BatchItemRejected, Error: "Invalid request format"}
+			continue
+		}
+		reqs = append(reqs, &req)
+		positions = append(positions, i)
+	}
+
+	processed, err := h.paymentService.ProcessBatch(c.Request.Context(), reqs)
+	if err != nil {
+		logrus.Errorf("Batch of %d payments failed: %v", len(reqs), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process batch"})
+		return
+	}
+	for j, result := range processed {
+		result.Index = positions[j]
+		results[positions[j]] = result
+	}
+
+	c.JSON(http.StatusOK, models.NewBatchResponse(results))
+}
+
+// readJSONBatch reads a JSON array of items, stopping as soon as it holds
+// more than limit of them.
+func readJSONBatch(r io.Reader, limit int) ([]json.RawMessage, error) {
+	decoder := json.NewDecoder(r)
+	if token, err := decoder.Token(); err != nil {
+		return nil, err
+	} else if token != json.Delim('[') {
+		return nil, errors.New("expected a JSON array")
+	}
+
+	var items []json.RawMessage
+	for decoder.More() {
+		if len(items) == limit {
+			return nil, services.ErrBatchTooLarge
+		}
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// readNDJSONBatch reads one item per line, skipping blank lines. Lines that
+// are not valid JSON are kept and rejected as items of their own.
+func readNDJSONBatch(r io.Reader, limit int) ([]json.RawMessage, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxBatchLineSize)
+
+	var items []json.RawMessage
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(items) == limit {
+			return nil, services.ErrBatchTooLarge
+		}
+		items = append(items, json.RawMessage(bytes.Clone(line)))
+	}
+	return items, scanner.Err()
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"th_payment_processor/internal/models"
+	"th_payment_processor/internal/services"
+)
+
+type EventHandler struct {
+	broker    *services.EventBroker
+	heartbeat time.Duration
+}
+
+func NewEventHandler(broker *services.EventBroker, heartbeat time.Duration) *EventHandler {
+	if heartbeat <= 0 {
+		heartbeat = 15 * time.Second
+	}
+	return &EventHandler{
+		broker:    broker,
+		heartbeat: heartbeat,
+	}
+}
+
+// StreamEvents handles GET /events
+func (h *EventHandler) StreamEvents(c *gin.Context) {
+	sub := h.broker.Subscribe(models.EventFilter{
+		Processors: queryList(c, "processor"),
+		Types:      queryList(c, "type"),
+	})
+	defer h.broker.Unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Keep proxies from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	heartbeat := time.NewTicker(h.heartbeat)
+	defer heartbeat.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				if sub.Dropped() {
+					c.Render(-1, sse.Event{Event: "dropped", Data: gin.H{"error": "Subscriber fell behind and was dropped"}})
+				}
+				return false
+			}
+			c.Render(-1, sse.Event{Id: strconv.FormatUint(event.ID, 10), Event: event.Type, Data: event})
+		case <-heartbeat.C:
+			io.WriteString(w, ": heartbeat\n\n")
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
+
+// queryList collects a query parameter given repeatedly or comma-separated.
+func queryList(c *gin.Context, key string) []string {
+	var values []string
+	for _, value := range c.QueryArray(key) {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+	return values
+}
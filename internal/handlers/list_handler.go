@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"th_payment_processor/internal/models"
+)
+
+// ListPayments handles GET /payments
+func (h *PaymentHandler) ListPayments(c *gin.Context) {
+	query, err := parsePaymentQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := h.paymentService.ListPayments(query)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'cursor' parameter"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list payments"})
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+func parsePaymentQuery(c *gin.Context) (models.PaymentQuery, error) {
+	query := models.PaymentQuery{
+		Processors:          queryList(c, "processor"),
+		CorrelationIDPrefix: c.Query("correlationIdPrefix"),
+		Cursor:              c.Query("cursor"),
+	}
+	for _, status := range queryList(c, "status") {
+		query.Statuses = append(query.Statuses, models.PaymentStatus(status))
+	}
+
+	var err error
+	if query.MinAmount, err = queryMoney(c, "minAmount"); err != nil {
+		return query, err
+	}
+	if query.MaxAmount, err = queryMoney(c, "maxAmount"); err != nil {
+		return query, err
+	}
+	if query.ProcessedFrom, err = queryTime(c, "from"); err != nil {
+		return query, err
+	}
+	if query.ProcessedTo, err = queryTime(c, "to"); err != nil {
+		return query, err
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit <= 0 {
+			return query, errors.New("Invalid 'limit' parameter")
+		}
+	}
+	return query, nil
+}
+
+func queryMoney(c *gin.Context, key string) (*models.Money, error) {
+	value := c.Query(key)
+	if value == "" {
+		return nil, nil
+	}
+	amount, err := models.ParseMoney(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid '%s' parameter: %v", key, err)
+	}
+	return &amount, nil
+}
+
+func queryTime(c *gin.Context, key string) (*time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid '%s' parameter format", key)
+	}
+	return &parsed, nil
+}
@@ -1,9 +1,12 @@
 package handlers
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"io"
 	"net/http"
+	"strings"
 	"th_payment_processor/internal/models"
 	"th_payment_processor/internal/services"
 	"time"
@@ -27,16 +30,142 @@ func (h *PaymentHandler) ProcessPayment(c *gin.Context) {
 		return
 	}
 
-	// Process payment
-	_, err := h.paymentService.ProcessPayment(&req)
-	if err != nil {
-		logrus.Errorf("Payment processing failed: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment processing failed"})
+	// Hand off to the worker pool; processing happens asynchronously
+	if err := h.paymentService.EnqueuePayment(&req); err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCurrency):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrQueueFull):
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Payment queue is full"})
+		case errors.Is(err, services.ErrPaymentConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": "Payment with this correlationId already exists with a different amount or currency"})
+		case errors.Is(err, services.ErrQueueClosed):
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Payment service is not accepting payments"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept payment"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Payment accepted for processing"})
+}
+
+// GetPayment handles GET /payments/:correlationId
+func (h *PaymentHandler) GetPayment(c *gin.Context) {
+	record, ok := h.paymentService.GetPayment(c.Param("correlationId"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, record)
+}
+
+// RefundPayment handles POST /payments/:correlationId/refunds
+func (h *PaymentHandler) RefundPayment(c *gin.Context) {
+	var req models.RefundRequest
+	// An empty body asks for a full refund
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		logrus.Errorf("Invalid refund request: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	refund, err := h.paymentService.RefundPayment(c.Request.Context(), c.Param("correlationId"), req.Amount)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusCreated, refund)
+	case errors.Is(err, services.ErrPaymentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+	case errors.Is(err, models.ErrInvalidCurrency):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrPaymentNotRefundable):
+		c.JSON(http.StatusConflict, gin.H{"error": "Payment cannot be refunded in its current status"})
+	case errors.Is(err, services.ErrRefundExceedsPayment):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrRefundFailed):
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Payment processor did not refund the payment", "refund": refund})
+	case errors.Is(err, services.ErrRefundPending):
+		c.JSON(http.StatusAccepted, refund)
+	default:
+		logrus.Errorf("Refund of payment %s failed: %v", c.Param("correlationId"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refund payment"})
+	}
+}
+
+// AuthorizePayment handles POST /payments/authorize
+func (h *PaymentHandler) AuthorizePayment(c *gin.Context) {
+	var req models.PaymentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		logrus.Errorf("Invalid authorization request: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
 		return
 	}
 
-	// Return success response (any 2XX status is valid)
-	c.JSON(http.StatusOK, gin.H{"message": "Payment processed successfully"})
+	record, err := h.paymentService.AuthorizePayment(c.Request.Context(), &req)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusCreated, record)
+	case errors.Is(err, models.ErrInvalidCurrency):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrPaymentConflict):
+		c.JSON(http.StatusConflict, gin.H{"error": "Payment with this correlationId already exists with a different amount or currency"})
+	case errors.Is(err, services.ErrAuthorizationFailed):
+		c.JSON(http.StatusBadGateway, gin.H{"error": "No payment processor authorized the payment"})
+	case errors.Is(err, services.ErrAuthorizationPending):
+		c.JSON(http.StatusAccepted, record)
+	default:
+		logrus.Errorf("Authorization of payment %s failed: %v", req.CorrelationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authorize payment"})
+	}
+}
+
+// CapturePayment handles POST /payments/:correlationId/capture
+func (h *PaymentHandler) CapturePayment(c *gin.Context) {
+	var req models.CaptureRequest
+	// An empty body captures the whole authorization
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		logrus.Errorf("Invalid capture request: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	record, err := h.paymentService.CapturePayment(c.Request.Context(), c.Param("correlationId"), req.Amount)
+	h.respondAuthorizationAction(c, record, err)
+}
+
+// VoidPayment handles POST /payments/:correlationId/void
+func (h *PaymentHandler) VoidPayment(c *gin.Context) {
+	record, err := h.paymentService.VoidPayment(c.Request.Context(), c.Param("correlationId"))
+	h.respondAuthorizationAction(c, record, err)
+}
+
+func (h *PaymentHandler) respondAuthorizationAction(c *gin.Context, record *models.PaymentRecord, err error) {
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, record)
+	case errors.Is(err, services.ErrPaymentNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+	case errors.Is(err, models.ErrInvalidCurrency):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrNotAuthorized), errors.Is(err, services.ErrAuthorizationExpired), errors.Is(err, services.ErrAuthorizationBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrCaptureExceedsAuthorization):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrProcessorRejected):
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Payment processor rejected the request"})
+	case errors.Is(err, services.ErrAuthorizationPending):
+		c.JSON(http.StatusAccepted, record)
+	default:
+		logrus.Errorf("Authorization action on payment %s failed: %v", c.Param("correlationId"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update authorization"})
+	}
+}
+
+// GetQueueStats handles GET /queue-stats
+func (h *PaymentHandler) GetQueueStats(c *gin.Context) {
+	c.JSON(http.StatusOK, h.paymentService.QueueStats())
 }
 
 func (h *PaymentHandler) GetPaymentsSummary(c *gin.Context) {
@@ -66,8 +195,64 @@ func (h *PaymentHandler) GetPaymentsSummary(c *gin.Context) {
 		}
 	}
 
-	// Get summary from storage
-	summary := h.paymentService.GetPaymentsSummary(from, to)
+	if c.Query("interval") != "" {
+		h.getPaymentsSeries(c, from, to)
+		return
+	}
+
+	// Peers ask each other with local=true so the fan-out never recurses
+	if c.Query("local") == "true" {
+		c.JSON(http.StatusOK, h.paymentService.GetPaymentsSummary(from, to))
+		return
+	}
+
+	summary, err := h.paymentService.GetClusterPaymentsSummary(c.Request.Context(), from, to)
+	h.respondSummary(c, summary, err)
+}
+
+// getPaymentsSeries serves GET /payments-summary?interval=...
+func (h *PaymentHandler) getPaymentsSeries(c *gin.Context, from, to *time.Time) {
+	interval, err := models.ParseSummaryInterval(c.Query("interval"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'interval' parameter: " + err.Error()})
+		return
+	}
+
+	var points []models.SummaryPoint
+	if c.Query("local") == "true" {
+		points, err = h.paymentService.GetPaymentsSeries(from, to, interval)
+	} else {
+		points, err = h.paymentService.GetClusterPaymentsSeries(c.Request.Context(), from, to, interval)
+	}
+	if errors.Is(err, models.ErrSeriesTooLong) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.respondSummary(c, models.SummarySeries{Interval: c.Query("interval"), Points: points}, err)
+}
+
+// respondSummary writes a cluster-wide summary or series, or the reason it
+// is incomplete.
+func (h *PaymentHandler) respondSummary(c *gin.Context, summary any, err error) {
+	if err != nil {
+		var peerErr *services.PeerUnavailableError
+		if !errors.As(err, &peerErr) {
+			logrus.Errorf("Failed to build payments summary: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build payments summary"})
+			return
+		}
+
+		// A partial total would silently undercount, so only serve it on request
+		if c.Query("allowPartial") != "true" {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error":            "Payments summary incomplete: peers unavailable",
+				"unavailablePeers": peerErr.Peers,
+			})
+			return
+		}
+		c.Header("X-Summary-Partial", "true")
+		c.Header("X-Summary-Unavailable-Peers", strings.Join(peerErr.Peers, ","))
+	}
 
 	c.JSON(http.StatusOK, summary)
 }
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"th_payment_processor/internal/models"
+	"th_payment_processor/internal/services"
+)
+
+// RunReconciliation handles POST /admin/reconciliations
+func (h *PaymentHandler) RunReconciliation(c *gin.Context) {
+	var req models.ReconciliationRequest
+	// An empty body checks the window a scheduled run would check now
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		logrus.Errorf("Invalid reconciliation request: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	report, err := h.paymentService.ReconcilePayments(c.Request.Context(), req)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidReconciliationWindow) || errors.Is(err, services.ErrInvalidReconciliationMode) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reconcile payments"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, report)
+}
+
+// ListReconciliations handles GET /admin/reconciliations
+func (h *PaymentHandler) ListReconciliations(c *gin.Context) {
+	c.JSON(http.StatusOK, h.paymentService.Reconciliations())
+}
+
+// GetReconciliation handles GET /admin/reconciliations/:id
+func (h *PaymentHandler) GetReconciliation(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid reconciliation ID"})
+		return
+	}
+
+	report, err := h.paymentService.GetReconciliation(id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reconciliation report not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"th_payment_processor/internal/models"
+	"th_payment_processor/internal/services"
+)
+
+type WebhookHandler struct {
+	dispatcher *services.WebhookDispatcher
+}
+
+func NewWebhookHandler(dispatcher *services.WebhookDispatcher) *WebhookHandler {
+	return &WebhookHandler{
+		dispatcher: dispatcher,
+	}
+}
+
+// RegisterWebhook handles POST /webhooks
+func (h *WebhookHandler) RegisterWebhook(c *gin.Context) {
+	var req models.WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		logrus.Errorf("Invalid webhook request: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	webhook, err := h.dispatcher.Register(&req)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusCreated, webhook)
+	case errors.Is(err, services.ErrInvalidWebhookEvent), errors.Is(err, services.ErrInvalidWebhookURL):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		logrus.Errorf("Failed to register webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register webhook"})
+	}
+}
+
+// ListWebhooks handles GET /webhooks
+func (h *WebhookHandler) ListWebhooks(c *gin.Context) {
+	c.JSON(http.StatusOK, h.dispatcher.List())
+}
+
+// DeleteWebhook handles DELETE /webhooks/:id
+func (h *WebhookHandler) DeleteWebhook(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err == nil {
+		err = h.dispatcher.Delete(id)
+	}
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ListDeadLetters handles GET /webhooks/dead-letters
+func (h *WebhookHandler) ListDeadLetters(c *gin.Context) {
+	c.JSON(http.StatusOK, h.dispatcher.DeadLetters())
+}
+
+// ReplayDeadLetter handles POST /webhooks/dead-letters/:id/replay
+func (h *WebhookHandler) ReplayDeadLetter(c *gin.Context) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	}
+
+	delivery, err := h.dispatcher.Replay(id)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusAccepted, delivery)
+	case errors.Is(err, services.ErrWebhookNotFound):
+		c.JSON(http.StatusConflict, gin.H{"error": "The delivery's webhook has been deleted"})
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+	}
+}
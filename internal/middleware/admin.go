@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminTokenHeader carries the admin token, named like the processors'
+// own admin header.
+const AdminTokenHeader = "X-Rinha-Token"
+
+// AdminAuth rejects requests whose X-Rinha-Token is not token with 401.
+// An empty token rejects every request, so admin routes stay closed until
+// ADMIN_TOKEN is set.
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		given := c.GetHeader(AdminTokenHeader)
+		if token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or missing " + AdminTokenHeader})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newRouter := func(token string) *gin.Engine {
+		router := gin.New()
+		router.GET("/webhooks", AdminAuth(token), func(c *gin.Context) { c.Status(http.StatusOK) })
+		return router
+	}
+	get := func(router http.Handler, token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/webhooks", nil)
+		if token != "" {
+			req.Header.Set(AdminTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	router := newRouter("s3cret")
+	if code := get(router, "s3cret"); code != http.StatusOK {
+		t.Errorf("Expected the right token to pass, got %d", code)
+	}
+	if code := get(router, "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong token to be rejected, got %d", code)
+	}
+	if code := get(router, ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected a missing token to be rejected, got %d", code)
+	}
+	if code := get(newRouter(""), ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected routes to stay closed without a configured token, got %d", code)
+	}
+}
@@ -0,0 +1,251 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// IdempotencyKeyHeader carries the client-chosen key for a request.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader marks responses replayed from the store.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+
+	defaultIdempotencyExpiryInterval = time.Minute
+)
+
+// storedResponse is the first response sent for an idempotency key. Until
+// the handler finishes, done is false and repeats are turned away.
+type storedResponse struct {
+	fingerprint [sha256.Size]byte
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	expiresAt   time.Time
+}
+
+// IdempotencyStore keeps the first response for each Idempotency-Key for
+// ttl. A store from NewIdempotencyStore lives in memory only; one from
+// OpenIdempotencyStore also logs every stored response to a file, so keys
+// survive a restart.
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*storedResponse
+	ttl     time.Duration
+	now     func() time.Time
+
+	// path and log are set for a file-backed store. logMu guards log and
+	// orders appends with compactions; it is never taken while holding mu,
+	// so disk I/O does not hold up other keys.
+	path      string
+	logMu     sync.Mutex
+	log       *os.File
+	logClosed bool
+}
+
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		entries: make(map[string]*storedResponse),
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+// StartExpiry drops expired keys every interval until ctx is cancelled.
+func (s *IdempotencyStore) StartExpiry(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultIdempotencyExpiryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if expired := s.expire(); expired > 0 {
+				logrus.Debugf("Expired %d idempotency keys", expired)
+			}
+		}
+	}
+}
+
+// Len returns the number of keys currently held.
+func (s *IdempotencyStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+func (s *IdempotencyStore) expire() int {
+	expired := s.expireEntries()
+	if expired > 0 && s.path != "" {
+		if err := s.compact(); err != nil {
+			logrus.Errorf("Failed to compact idempotency log: %v", err)
+		}
+	}
+	return expired
+}
+
+func (s *IdempotencyStore) expireEntries() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	expired := 0
+	for key, entry := range s.entries {
+		// In-flight requests are never expired from under their handler
+		if entry.done && !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+			expired++
+		}
+	}
+	return expired
+}
+
+// begin claims key for a new request, or returns the entry already holding
+// it. An expired entry is replaced as if it had never existed.
+func (s *IdempotencyStore) begin(key string, fingerprint [sha256.Size]byte) (storedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.entries[key]; ok && (!entry.done || s.now().Before(entry.expiresAt)) {
+		return *entry, false
+	}
+	s.entries[key] = &storedResponse{fingerprint: fingerprint}
+	return storedResponse{}, true
+}
+
+// complete stores the response for key and starts its TTL.
+func (s *IdempotencyStore) complete(key string, status int, contentType string, body []byte) {
+	s.mu.Lock()
+	entry, ok := s.entries[key]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	entry.done = true
+	entry.status = status
+	entry.contentType = contentType
+	entry.body = body
+	entry.expiresAt = s.now().Add(s.ttl)
+	logged := entry.logged(key)
+	s.mu.Unlock()
+
+	if s.path != "" {
+		if err := s.append(logged); err != nil {
+			logrus.Errorf("Failed to log idempotency key %s: %v", key, err)
+		}
+	}
+}
+
+// release forgets key so the request can be retried under it.
+func (s *IdempotencyStore) release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+// captureWriter copies everything the handler writes.
+type captureWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency replays the first response sent for a request's
+// Idempotency-Key header. Reusing a key with a different request body is
+// rejected with 422, and a repeat arriving while the first is still being
+// handled gets 409. Transient failures (429 and 5xx) are not stored, so the
+// client can retry them under the same key. Requests without the header
+// pass through untouched.
+func Idempotency(store *IdempotencyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := requestFingerprint(c.Request, body)
+		existing, claimed := store.begin(key, fingerprint)
+		switch {
+		case claimed:
+		case existing.fingerprint != fingerprint:
+			c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different request"})
+			return
+		case !existing.done:
+			c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still being processed"})
+			return
+		default:
+			c.Header(IdempotentReplayedHeader, "true")
+			c.Data(existing.status, existing.contentType, existing.body)
+			c.Abort()
+			return
+		}
+
+		writer := &captureWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				store.release(key)
+				panic(recovered)
+			}
+			if status := writer.Status(); status == http.StatusTooManyRequests || status >= http.StatusInternalServerError {
+				store.release(key)
+				return
+			}
+			store.complete(key, writer.Status(), writer.Header().Get("Content-Type"), writer.body.Bytes())
+		}()
+
+		c.Next()
+	}
+}
+
+// requestFingerprint identifies what was asked for under a key, so the key
+// cannot be reused for a different payment.
+func requestFingerprint(r *http.Request, body []byte) [sha256.Size]byte {
+	h := sha256.New()
+	io.WriteString(h, r.Method)
+	h.Write([]byte{0})
+	io.WriteString(h, r.URL.Path)
+	h.Write([]byte{0})
+	h.Write(body)
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
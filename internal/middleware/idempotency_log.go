@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// loggedResponse is one line of the idempotency log. A key logged twice,
+// because it expired and was reused, keeps its last response.
+type loggedResponse struct {
+	Key         string            `json:"key"`
+	Fingerprint [sha256.Size]byte `json:"fingerprint"`
+	Status      int               `json:"status"`
+	ContentType string            `json:"contentType"`
+	Body        []byte            `json:"body"`
+	ExpiresAt   time.Time         `json:"expiresAt"`
+}
+
+func (e *storedResponse) logged(key string) loggedResponse {
+	return loggedResponse{
+		Key:         key,
+		Fingerprint: e.fingerprint,
+		Status:      e.status,
+		ContentType: e.contentType,
+		Body:        e.body,
+		ExpiresAt:   e.expiresAt,
+	}
+}
+
+// OpenIdempotencyStore returns a store that logs every stored response to
+// path and starts out with the unexpired responses already there. Only
+// finished responses are logged: a request interrupted by a restart was
+// never answered, so its key is free to be retried.
+func OpenIdempotencyStore(ttl time.Duration, path string) (*IdempotencyStore, error) {
+	s := NewIdempotencyStore(ttl)
+	s.path = path
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	// Start from a log holding only what was loaded, which also drops a
+	// torn last line
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the log of a file-backed store.
+func (s *IdempotencyStore) Close() error {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.logClosed = true
+	if s.log == nil {
+		return nil
+	}
+	err := s.log.Close()
+	s.log = nil
+	return err
+}
+
+func (s *IdempotencyStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open idempotency log: %w", err)
+	}
+	defer f.Close()
+
+	now := s.now()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var logged loggedResponse
+		if err := json.Unmarshal(scanner.Bytes(), &logged); err != nil {
+			// Only the last line can be torn by a crash mid-append
+			logrus.Warnf("Skipping unreadable idempotency log entry: %v", err)
+			continue
+		}
+		if !now.Before(logged.ExpiresAt) {
+			delete(s.entries, logged.Key)
+			continue
+		}
+		s.entries[logged.Key] = &storedResponse{
+			fingerprint: logged.Fingerprint,
+			done:        true,
+			status:      logged.Status,
+			contentType: logged.ContentType,
+			body:        logged.Body,
+			expiresAt:   logged.ExpiresAt,
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read idempotency log: %w", err)
+	}
+	return nil
+}
+
+// append logs a finished response. Callers must not hold mu.
+func (s *IdempotencyStore) append(logged loggedResponse) error {
+	line, err := json.Marshal(logged)
+	if err != nil {
+		return err
+	}
+
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	if s.log == nil {
+		return fmt.Errorf("idempotency log is closed")
+	}
+	if _, err := s.log.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	// The response is replayed as the answer to every retry, so it must
+	// survive a crash once the client may have seen it
+	return s.log.Sync()
+}
+
+// compact rewrites the log with the finished responses still held and
+// reopens it for appending. The responses are copied under mu and written
+// without it; holding logMu throughout keeps a response finished meanwhile
+// from being appended to the log about to be replaced. Callers must not
+// hold mu.
+func (s *IdempotencyStore) compact() error {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	if s.logClosed {
+		return fmt.Errorf("idempotency log is closed")
+	}
+
+	s.mu.Lock()
+	snapshot := make([]loggedResponse, 0, len(s.entries))
+	for key, entry := range s.entries {
+		if entry.done {
+			snapshot = append(snapshot, entry.logged(key))
+		}
+	}
+	s.mu.Unlock()
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create idempotency log: %w", err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, logged := range snapshot {
+		if err := enc.Encode(logged); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write idempotency log: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write idempotency log: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync idempotency log: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close idempotency log: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to install idempotency log: %w", err)
+	}
+
+	log, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open idempotency log: %w", err)
+	}
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log = log
+	return nil
+}
@@ -0,0 +1,174 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newIdempotentRouter(store *IdempotencyStore, status *atomic.Int32, calls *atomic.Int32) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/payments", Idempotency(store), func(c *gin.Context) {
+		n := calls.Add(1)
+		c.JSON(int(status.Load()), gin.H{"call": n})
+	})
+	return router
+}
+
+func send(router http.Handler, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotency_ReplaysFirstResponse(t *testing.T) {
+	var status, calls atomic.Int32
+	status.Store(http.StatusAccepted)
+	router := newIdempotentRouter(NewIdempotencyStore(time.Hour), &status, &calls)
+
+	first := send(router, "key-1", `{"amount":10}`)
+	second := send(router, "key-1", `{"amount":10}`)
+
+	if calls.Load() != 1 {
+		t.Fatalf("Expected the handler to run once, ran %d times", calls.Load())
+	}
+	if second.Code != first.Code || second.Body.String() != first.Body.String() {
+		t.Errorf("Replay differs: got %d %q, want %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get(IdempotentReplayedHeader) != "true" || first.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Error("Expected only the replay to be flagged")
+	}
+
+	if w := send(router, "key-1", `{"amount":20}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a reused key, got %d", w.Code)
+	}
+	if send(router, "", `{"amount":10}`); calls.Load() != 2 {
+		t.Error("Expected requests without a key to reach the handler")
+	}
+}
+
+func TestIdempotency_TransientFailuresNotStored(t *testing.T) {
+	var status, calls atomic.Int32
+	status.Store(http.StatusTooManyRequests)
+	store := NewIdempotencyStore(time.Hour)
+	router := newIdempotentRouter(store, &status, &calls)
+
+	send(router, "key-1", `{}`)
+	status.Store(http.StatusAccepted)
+	if w := send(router, "key-1", `{}`); w.Code != http.StatusAccepted || calls.Load() != 2 {
+		t.Errorf("Expected the retry to reach the handler, got %d after %d calls", w.Code, calls.Load())
+	}
+	if store.Len() != 1 {
+		t.Errorf("Expected one stored key, got %d", store.Len())
+	}
+}
+
+func TestIdempotency_KeysExpire(t *testing.T) {
+	var status, calls atomic.Int32
+	status.Store(http.StatusAccepted)
+	store := NewIdempotencyStore(time.Minute)
+	clock := time.Now()
+	store.now = func() time.Time { return clock }
+	router := newIdempotentRouter(store, &status, &calls)
+
+	send(router, "key-1", `{}`)
+	clock = clock.Add(2 * time.Minute)
+
+	if expired := store.expire(); expired != 1 || store.Len() != 0 {
+		t.Errorf("Expected the key to expire, expired=%d len=%d", expired, store.Len())
+	}
+	if send(router, "key-1", `{}`); calls.Load() != 2 {
+		t.Error("Expected an expired key to be handled again")
+	}
+}
+
+func TestIdempotency_FileStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.log")
+	var status, calls atomic.Int32
+	status.Store(http.StatusAccepted)
+
+	store, err := OpenIdempotencyStore(time.Hour, path)
+	if err != nil {
+		t.Fatalf("OpenIdempotencyStore failed: %v", err)
+	}
+	first := send(newIdempotentRouter(store, &status, &calls), "key-1", `{"amount":10}`)
+	store.Close()
+
+	reopened, err := OpenIdempotencyStore(time.Hour, path)
+	if err != nil {
+		t.Fatalf("OpenIdempotencyStore failed: %v", err)
+	}
+	defer reopened.Close()
+	router := newIdempotentRouter(reopened, &status, &calls)
+
+	replay := send(router, "key-1", `{"amount":10}`)
+	if calls.Load() != 1 || replay.Body.String() != first.Body.String() || replay.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Errorf("Expected the response to be replayed after a restart, got %d %q after %d calls", replay.Code, replay.Body, calls.Load())
+	}
+	if w := send(router, "key-1", `{"amount":20}`); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected 422 for a key reused after a restart, got %d", w.Code)
+	}
+}
+
+func TestIdempotency_FileStoreCompactsWhileLogging(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.log")
+	store, err := OpenIdempotencyStore(time.Hour, path)
+	if err != nil {
+		t.Fatalf("OpenIdempotencyStore failed: %v", err)
+	}
+
+	// Responses finished while the log is rewritten must land in the new one
+	const keys = 50
+	var wg sync.WaitGroup
+	for i := 0; i < keys; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i)
+			store.begin(key, [sha256.Size]byte{})
+			store.complete(key, http.StatusOK, "application/json", []byte(`{}`))
+		}(i)
+		if i%10 == 0 {
+			if err := store.compact(); err != nil {
+				t.Fatalf("compact failed: %v", err)
+			}
+		}
+	}
+	wg.Wait()
+	store.Close()
+
+	reopened, err := OpenIdempotencyStore(time.Hour, path)
+	if err != nil {
+		t.Fatalf("OpenIdempotencyStore failed: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.Len() != keys {
+		t.Errorf("Expected %d keys after a restart, got %d", keys, reopened.Len())
+	}
+}
+
+func TestIdempotency_StartExpiryDefaultsInterval(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewIdempotencyStore(time.Hour).StartExpiry(ctx, 0)
+		close(done)
+	}()
+	cancel()
+	<-done
+}
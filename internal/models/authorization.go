@@ -0,0 +1,64 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Authorization is the hold placed on a processor by a two-phase payment.
+// Amount is what was held; the payment's Amount becomes what was captured.
+type Authorization struct {
+	// ID is the processor's identifier for the hold
+	ID             uuid.UUID `json:"id"`
+	Amount         Money     `json:"amount"`
+	CapturedAmount Money     `json:"capturedAmount"`
+	AuthorizedAt   time.Time `json:"authorizedAt"`
+	ExpiresAt      time.Time `json:"expiresAt"`
+	// Set while the hold itself, a capture or a void is waiting on the
+	// processor, with the amount of a pending capture
+	PendingAction string `json:"pendingAction,omitempty"`
+	PendingAmount Money  `json:"pendingAmount,omitempty"`
+}
+
+// UpdateAuthorization applies update to a copy of the authorization, so
+// records sharing it never see each other's changes.
+func (r *PaymentRecord) UpdateAuthorization(update func(*Authorization)) {
+	var auth Authorization
+	if r.Authorization != nil {
+		auth = *r.Authorization
+	}
+	update(&auth)
+	r.Authorization = &auth
+}
+
+// ClearPending forgets the action that was waiting on the processor.
+func (a *Authorization) ClearPending() {
+	a.PendingAction = ""
+	a.PendingAmount = 0
+}
+
+// CaptureRequest is the body of POST /payments/:correlationId/capture. A
+// missing amount captures the whole hold.
+type CaptureRequest struct {
+	Amount Money `json:"amount" binding:"omitempty,gt=0"`
+}
+
+// ProcessorAuthorizationRequest asks a processor to hold an amount until
+// ExpiresAt.
+type ProcessorAuthorizationRequest struct {
+	CorrelationID string    `json:"correlationId"`
+	Amount        Money     `json:"amount"`
+	Currency      Currency  `json:"currency"`
+	RequestedAt   time.Time `json:"requestedAt"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
+
+type ProcessorAuthorizationResponse struct {
+	ID uuid.UUID `json:"id"`
+}
+
+// ProcessorCaptureRequest captures Amount of an existing hold.
+type ProcessorCaptureRequest struct {
+	Amount Money `json:"amount"`
+}
@@ -0,0 +1,31 @@
+package models
+
+// BatchItemRejected is the status of a batch item that was never accepted as
+// a payment, because it was invalid or conflicted with an existing one.
+const BatchItemRejected = "rejected"
+
+// BatchItemResult is the outcome of one payment of a POST /payments/batch.
+// Status is the payment's PaymentStatus, or BatchItemRejected.
+type BatchItemResult struct {
+	Index         int    `json:"index"`
+	CorrelationID string `json:"correlationId,omitempty"`
+	Status        string `json:"status"`
+	Processor     string `json:"processor,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// BatchResponse lists the result of every item in submission order, with the
+// number of items that ended in each status.
+type BatchResponse struct {
+	Total   int               `json:"total"`
+	Counts  map[string]int    `json:"counts"`
+	Results []BatchItemResult `json:"results"`
+}
+
+func NewBatchResponse(results []BatchItemResult) BatchResponse {
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	return BatchResponse{Total: len(results), Counts: counts, Results: results}
+}
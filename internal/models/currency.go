@@ -0,0 +1,86 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Currency is an ISO 4217 alphabetic currency code such as "BRL".
+type Currency string
+
+// DefaultCurrency applies to payments that do not name a currency.
+const DefaultCurrency Currency = "BRL"
+
+// ErrInvalidCurrency is returned for unknown currency codes and for amounts
+// finer than the currency's minor unit.
+var ErrInvalidCurrency = errors.New("invalid currency")
+
+// currencyExponents holds the number of minor-unit digits of each supported
+// currency. Money keeps MoneyScale decimals, so currencies with finer minor
+// units (BHD, KWD, ...) cannot be represented and are not listed.
+var currencyExponents = map[Currency]int{
+	"ARS": 2, "AUD": 2, "BOB": 2, "BRL": 2, "CAD": 2, "CHF": 2, "CLP": 0,
+	"CNY": 2, "COP": 2, "CZK": 2, "DKK": 2, "EUR": 2, "GBP": 2, "HKD": 2,
+	"HUF": 2, "IDR": 2, "ILS": 2, "INR": 2, "ISK": 0, "JPY": 0, "KRW": 0,
+	"MXN": 2, "NOK": 2, "NZD": 2, "PEN": 2, "PHP": 2, "PLN": 2, "PYG": 0,
+	"SEK": 2, "SGD": 2, "THB": 2, "TRY": 2, "TWD": 2, "UGX": 0, "USD": 2,
+	"UYU": 2, "VND": 0, "ZAR": 2,
+}
+
+// Exponent returns the number of minor-unit digits of c and whether c is a
+// supported currency.
+func (c Currency) Exponent() (int, bool) {
+	exponent, ok := currencyExponents[c]
+	return exponent, ok
+}
+
+// ValidateAmount checks that c is supported and that amount has no more
+// decimal places than c's minor unit, e.g. whole yen only.
+func (c Currency) ValidateAmount(amount Money) error {
+	exponent, ok := c.Exponent()
+	if !ok {
+		return fmt.Errorf("%w: unsupported currency %q", ErrInvalidCurrency, string(c))
+	}
+
+	if step := c.minorUnit(); amount%step != 0 {
+		return fmt.Errorf("%w: %s allows %d decimal places, got %s", ErrInvalidCurrency, string(c), exponent, amount)
+	}
+	return nil
+}
+
+// OrDefault treats an empty currency, as on records stored before
+// currencies existed, as DefaultCurrency.
+func (c Currency) OrDefault() Currency {
+	if c == "" {
+		return DefaultCurrency
+	}
+	return c
+}
+
+// MoneyFromFloat rounds f to the nearest minor unit of c, e.g. whole yen.
+// Unknown currencies round to the cent.
+func (c Currency) MoneyFromFloat(f float64) Money {
+	return c.round(f * moneyFactor)
+}
+
+// round rounds cents, which may be fractional, to the nearest minor unit
+// of c.
+func (c Currency) round(cents float64) Money {
+	step := c.minorUnit()
+	return Money(math.Round(cents/float64(step))) * step
+}
+
+// minorUnit is one minor unit of c in Money, e.g. 100 for JPY and 1 for
+// BRL. Unknown currencies are treated as having cents.
+func (c Currency) minorUnit() Money {
+	exponent, ok := c.Exponent()
+	if !ok {
+		exponent = MoneyScale
+	}
+	step := Money(1)
+	for i := exponent; i < MoneyScale; i++ {
+		step *= 10
+	}
+	return step
+}
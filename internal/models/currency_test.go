@@ -0,0 +1,79 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCurrency_ValidateAmount(t *testing.T) {
+	tests := []struct {
+		currency Currency
+		amount   Money
+		valid    bool
+	}{
+		{"BRL", 1990, true},
+		{"USD", 1, true},
+		{"JPY", 50000, true},
+		{"JPY", 50050, false},
+		{"CLP", 1, false},
+		{"brl", 1990, false},
+		{"XXX", 100, false},
+		{"", 100, false},
+	}
+
+	for _, tt := range tests {
+		err := tt.currency.ValidateAmount(tt.amount)
+		if tt.valid && err != nil {
+			t.Errorf("ValidateAmount(%q, %s) failed: %v", tt.currency, tt.amount, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidCurrency) {
+			t.Errorf("ValidateAmount(%q, %s) = %v, want ErrInvalidCurrency", tt.currency, tt.amount, err)
+		}
+	}
+}
+
+func TestPaymentRequest_Validate(t *testing.T) {
+	req := &PaymentRequest{CorrelationID: "c", Amount: 1000}
+	if err := req.Validate(); err != nil || req.Currency != DefaultCurrency {
+		t.Errorf("Expected a missing currency to default to %s, got %q, %v", DefaultCurrency, req.Currency, err)
+	}
+
+	record := NewPaymentRecord("c", 1000, time.Now())
+	if !record.Matches(req) {
+		t.Error("Expected a record without a currency to match the default currency")
+	}
+	if record.Matches(&PaymentRequest{CorrelationID: "c", Amount: 1000, Currency: "USD"}) {
+		t.Error("Expected a different currency not to match")
+	}
+}
+
+func TestPaymentSummary_Merge(t *testing.T) {
+	summary := PaymentSummary{}
+	summary.AddPayment("default", "BRL", 1000, 10)
+	summary.AddRefund("default", "USD", 200)
+
+	peer := PaymentSummary{}
+	peer.AddPayment("default", "USD", 500, 25)
+	summary.Merge(peer)
+	// Peers without a currency breakdown count as the default currency
+	summary.Merge(PaymentSummary{"default": {TotalRequests: 1, TotalAmount: 300}, "fallback": {}})
+
+	d := summary["default"]
+	// Only BRL, the default currency, reaches the processor totals
+	if d.TotalRequests != 2 || d.TotalAmount != 1300 || d.TotalRefunds != 0 || d.TotalRefundedAmount != 0 || d.TotalFee != 10 {
+		t.Errorf("Unexpected merged totals: %+v", d)
+	}
+	if all := d.AllCurrencies(); all.TotalRequests != 3 || all.TotalAmount != 1800 || all.TotalRefunds != 1 {
+		t.Errorf("Unexpected totals across currencies: %+v", all)
+	}
+	if d.Currencies["BRL"].TotalAmount != 1300 || d.Currencies["USD"].TotalAmount != 500 || d.Currencies["USD"].TotalRefundedAmount != 200 {
+		t.Errorf("Unexpected merged currencies: %+v", d.Currencies)
+	}
+	if f, ok := summary["fallback"]; !ok || len(f.Currencies) != 0 {
+		t.Errorf("Expected an empty fallback summary, got %+v, %v", f, ok)
+	}
+	if len(peer["default"].Currencies) != 1 {
+		t.Errorf("Merge modified the merged summary: %+v", peer)
+	}
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// EventProcessorHealth is the type of events announcing that a processor
+// became healthy or unhealthy, or started or stopped failing.
+const EventProcessorHealth = "processor.health"
+
+// Event is a real-time notification streamed on GET /events. Payment events
+// carry the payment, health events the processor's new health.
+type Event struct {
+	ID        uint64                `json:"id"`
+	Type      string                `json:"type"`
+	At        time.Time             `json:"at"`
+	Processor string                `json:"processor,omitempty"`
+	Payment   *PaymentRecord        `json:"payment,omitempty"`
+	Health    *ProcessorHealthEvent `json:"health,omitempty"`
+}
+
+type ProcessorHealthEvent struct {
+	Healthy         bool `json:"healthy"`
+	Failing         bool `json:"failing"`
+	MinResponseTime int  `json:"minResponseTime"`
+}
+
+// PaymentEventType returns the event type announcing a move to status, e.g.
+// "payment.succeeded". Payments being accepted or attempted are not
+// outcomes and have none.
+func PaymentEventType(status PaymentStatus) (string, bool) {
+	switch status {
+	case PaymentStatusPending, PaymentStatusProcessing:
+		return "", false
+	}
+	return "payment." + string(status), true
+}
+
+// EventFilter selects events by processor and type. Empty lists match
+// everything; a type matches itself and, without a dot, its whole category,
+// so "payment" matches "payment.failed".
+type EventFilter struct {
+	Processors []string
+	Types      []string
+}
+
+func (f EventFilter) Matches(event *Event) bool {
+	return f.matchesProcessor(event.Processor) && f.matchesType(event.Type)
+}
+
+func (f EventFilter) matchesProcessor(processor string) bool {
+	if len(f.Processors) == 0 {
+		return true
+	}
+	for _, p := range f.Processors {
+		if p == processor {
+			return true
+		}
+	}
+	return false
+}
+
+func (f EventFilter) matchesType(eventType string) bool {
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if t == eventType || (!strings.Contains(t, ".") && strings.HasPrefix(eventType, t+".")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned for a cursor that no page handed out.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// PaymentQuery selects payments for GET /payments. Zero fields do not
+// filter; several processors or statuses match any of them. Bounds are
+// inclusive.
+type PaymentQuery struct {
+	Processors          []string
+	Statuses            []PaymentStatus
+	MinAmount           *Money
+	MaxAmount           *Money
+	ProcessedFrom       *time.Time
+	ProcessedTo         *time.Time
+	CorrelationIDPrefix string
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+// PageSize returns Limit clamped to [1, MaxPageSize], DefaultPageSize when
+// unset.
+func (q PaymentQuery) PageSize() int {
+	switch {
+	case q.Limit <= 0:
+		return DefaultPageSize
+	case q.Limit > MaxPageSize:
+		return MaxPageSize
+	}
+	return q.Limit
+}
+
+// Matches reports whether record passes every filter of q.
+func (q PaymentQuery) Matches(record *PaymentRecord) bool {
+	if len(q.Processors) > 0 && !containsString(q.Processors, record.Processor) {
+		return false
+	}
+	if len(q.Statuses) > 0 && !containsStatus(q.Statuses, record.Status) {
+		return false
+	}
+	if (q.MinAmount != nil && record.Amount < *q.MinAmount) || (q.MaxAmount != nil && record.Amount > *q.MaxAmount) {
+		return false
+	}
+	if q.ProcessedFrom != nil || q.ProcessedTo != nil {
+		if record.ProcessedAt.IsZero() ||
+			(q.ProcessedFrom != nil && record.ProcessedAt.Before(*q.ProcessedFrom)) ||
+			(q.ProcessedTo != nil && record.ProcessedAt.After(*q.ProcessedTo)) {
+			return false
+		}
+	}
+	return strings.HasPrefix(record.CorrelationID, q.CorrelationIDPrefix)
+}
+
+// PaymentPage is one page of GET /payments, newest payments first. An empty
+// NextCursor means there are no more pages.
+type PaymentPage struct {
+	Payments   []*PaymentRecord `json:"payments"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsStatus(values []PaymentStatus, value PaymentStatus) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
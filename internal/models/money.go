@@ -0,0 +1,133 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MoneyScale is the number of decimal places Money keeps.
+const MoneyScale = 2
+
+const moneyFactor = 100
+
+// Money is an exact amount in minor units (cents). It marshals to and from
+// a JSON decimal number such as 19.90, so sums never drift the way float64
+// totals do.
+type Money int64
+
+// ParseMoney parses a decimal string such as "19.90". More than MoneyScale
+// significant decimal places is an error rather than a silent rounding.
+func ParseMoney(s string) (Money, error) {
+	if s == "" {
+		return 0, errors.New("empty amount")
+	}
+	if strings.ContainsAny(s, "eE") {
+		return 0, fmt.Errorf("invalid amount %q: exponent notation is not supported", s)
+	}
+
+	negative := false
+	digits := s
+	switch digits[0] {
+	case '-':
+		negative = true
+		digits = digits[1:]
+	case '+':
+		digits = digits[1:]
+	}
+
+	whole, frac := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		whole, frac = digits[:i], digits[i+1:]
+	}
+	if whole == "" && frac == "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	// Extra decimal places are only acceptable when they are zeros
+	if len(frac) > MoneyScale {
+		if strings.Trim(frac[MoneyScale:], "0") != "" {
+			return 0, fmt.Errorf("invalid amount %q: more than %d decimal places", s, MoneyScale)
+		}
+		frac = frac[:MoneyScale]
+	}
+	frac += strings.Repeat("0", MoneyScale-len(frac))
+
+	if whole == "" {
+		whole = "0"
+	}
+	for _, part := range []string{whole, frac} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, fmt.Errorf("invalid amount %q", s)
+			}
+		}
+	}
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units > (math.MaxInt64-moneyFactor)/moneyFactor {
+		return 0, fmt.Errorf("invalid amount %q: out of range", s)
+	}
+	cents, _ := strconv.ParseInt(frac, 10, 64)
+
+	m := Money(units*moneyFactor + cents)
+	if negative {
+		m = -m
+	}
+	return m, nil
+}
+
+// String formats m as a decimal with exactly MoneyScale places.
+func (m Money) String() string {
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, v/moneyFactor, v%moneyFactor)
+}
+
+// Float64 converts m for places that need an approximate value, such as
+// tracing attributes. Never use it for arithmetic.
+func (m Money) Float64() float64 {
+	return float64(m) / moneyFactor
+}
+
+// MoneyFromFloat rounds f to the nearest cent. It is only for amounts that
+// arrive as accumulated floats, such as the processors' summaries, where
+// the float error is below a cent.
+func MoneyFromFloat(f float64) Money {
+	return Money(math.Round(f * moneyFactor))
+}
+
+// FeeFor is the fee of percent on amount, rounded to the nearest minor unit
+// of currency.
+func FeeFor(amount Money, percent float64, currency Currency) Money {
+	return currency.round(float64(amount) * percent / 100)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number, or a string holding one.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if len(data) >= 2 && data[0] == '"' && data[len(data)-1] == '"' {
+		data = data[1 : len(data)-1]
+	}
+
+	parsed, err := ParseMoney(string(data))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Money
+		wantErr bool
+	}{
+		{in: "19.90", want: 1990},
+		{in: "19.9", want: 1990},
+		{in: "19", want: 1900},
+		{in: "0.01", want: 1},
+		{in: ".5", want: 50},
+		{in: "-3.25", want: -325},
+		{in: "19.900", want: 1990},
+		{in: "19.901", wantErr: true},
+		{in: "1e2", wantErr: true},
+		{in: "abc", wantErr: true},
+		{in: "", wantErr: true},
+		{in: ".", wantErr: true},
+		{in: "99999999999999999999", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseMoney(%q) = %v, expected error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseMoney(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestMoney_JSON(t *testing.T) {
+	var req PaymentRequest
+	if err := json.Unmarshal([]byte(`{"correlationId":"c","amount":19.90}`), &req); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if req.Amount != 1990 {
+		t.Errorf("Expected 1990 minor units, got %d", req.Amount)
+	}
+
+	if err := json.Unmarshal([]byte(`{"correlationId":"c","amount":19.999}`), &req); err == nil {
+		t.Error("Expected error for amount with three decimal places")
+	}
+
+	data, err := json.Marshal(ProcessorSummary{TotalRequests: 3, TotalAmount: 41554234598, TotalFee: 10, TotalNetAmount: 41554234588, TotalRefunds: 1, TotalRefundedAmount: 5})
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if string(data) != `{"totalRequests":3,"totalAmount":415542345.98,"totalFee":0.10,"totalNetAmount":415542345.88,"totalRefunds":1,"totalRefundedAmount":0.05}` {
+		t.Errorf("Unexpected JSON: %s", data)
+	}
+}
+
+func TestMoney_SumIsExact(t *testing.T) {
+	// 0.1 added a million times drifts in float64 but not in minor units
+	var total Money
+	for i := 0; i < 1000000; i++ {
+		total += 10
+	}
+	if total.String() != "100000.00" {
+		t.Errorf("Expected 100000.00, got %s", total)
+	}
+}
+
+func TestFeeFor(t *testing.T) {
+	cases := []struct {
+		amount   Money
+		percent  float64
+		currency Currency
+		want     Money
+	}{
+		{1990, 5, "BRL", 100},
+		{1250, 5, "BRL", 63},
+		{1000, 0, "BRL", 0},
+		{1, 1, "BRL", 0},
+		// Whole yen: 2.5% of 1990 yen is 49.75 yen
+		{199000, 2.5, "JPY", 5000},
+		{10000, 1, "JPY", 100},
+		{4000, 1, "JPY", 0},
+	}
+	for _, c := range cases {
+		if got := FeeFor(c.amount, c.percent, c.currency); got != c.want {
+			t.Errorf("FeeFor(%s, %v, %s) = %s, want %s", c.amount, c.percent, c.currency, got, c.want)
+		}
+	}
+}
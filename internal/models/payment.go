@@ -6,18 +6,42 @@ import (
 )
 
 type PaymentRequest struct {
-	CorrelationID string  `json:"correlationId" binding:"required"`
-	Amount        float64 `json:"amount" binding:"required,gt=0"`
+	CorrelationID string   `json:"correlationId" binding:"required"`
+	Amount        Money    `json:"amount" binding:"required,gt=0"`
+	Currency      Currency `json:"currency"`
+}
+
+// Validate defaults a missing currency and checks that the amount fits the
+// currency's minor unit.
+func (r *PaymentRequest) Validate() error {
+	r.Currency = r.Currency.OrDefault()
+	return r.Currency.ValidateAmount(r.Amount)
+}
+
+// Matches reports whether record was created for the same amount and
+// currency as req, which must already be validated.
+func (r *PaymentRecord) Matches(req *PaymentRequest) bool {
+	return r.Amount == req.Amount && r.Currency.OrDefault() == req.Currency
+}
+
+// SetFee records what the processor charged for the payment, keeping
+// NetAmount in step with Amount.
+func (r *PaymentRecord) SetFee(fee Money) {
+	r.Fee = fee
+	r.NetAmount = r.Amount - fee
 }
 
 type PaymentProcessorRequest struct {
 	CorrelationID string    `json:"correlationId"`
-	Amount        float64   `json:"amount"`
+	Amount        Money     `json:"amount"`
+	Currency      Currency  `json:"currency"`
 	RequestedAt   time.Time `json:"requestedAt"`
 }
 
 type PaymentProcessorResponse struct {
 	Message string `json:"message"`
+	// Only sent by processors that report what the payment cost
+	Fee *float64 `json:"fee,omitempty"`
 }
 
 type HealthCheckResponse struct {
@@ -25,23 +49,145 @@ type HealthCheckResponse struct {
 	MinResponseTime int  `json:"minResponseTime"`
 }
 
-type PaymentSummary struct {
-	Default  ProcessorSummary `json:"default"`
-	Fallback ProcessorSummary `json:"fallback"`
-}
+// PaymentSummary holds the totals of each processor, keyed by processor name.
+type PaymentSummary map[string]ProcessorSummary
 
+// ProcessorSummary totals cover DefaultCurrency only, since amounts in
+// different currencies cannot be added up; Currencies breaks down every
+// currency, the default one included.
+// TotalNetAmount is TotalAmount less TotalFee; refunds are not netted out.
 type ProcessorSummary struct {
-	TotalRequests int     `json:"totalRequests"`
-	TotalAmount   float64 `json:"totalAmount"`
+	TotalRequests       int                          `json:"totalRequests"`
+	TotalAmount         Money                        `json:"totalAmount"`
+	TotalFee            Money                        `json:"totalFee"`
+	TotalNetAmount      Money                        `json:"totalNetAmount"`
+	TotalRefunds        int                          `json:"totalRefunds"`
+	TotalRefundedAmount Money                        `json:"totalRefundedAmount"`
+	Currencies          map[Currency]CurrencySummary `json:"currencies,omitempty"`
+}
+
+type CurrencySummary struct {
+	TotalRequests       int   `json:"totalRequests"`
+	TotalAmount         Money `json:"totalAmount"`
+	TotalFee            Money `json:"totalFee"`
+	TotalNetAmount      Money `json:"totalNetAmount"`
+	TotalRefunds        int   `json:"totalRefunds"`
+	TotalRefundedAmount Money `json:"totalRefundedAmount"`
+}
+
+func (t *CurrencySummary) add(o CurrencySummary) {
+	t.TotalRequests += o.TotalRequests
+	t.TotalAmount += o.TotalAmount
+	t.TotalFee += o.TotalFee
+	t.TotalNetAmount += o.TotalNetAmount
+	t.TotalRefunds += o.TotalRefunds
+	t.TotalRefundedAmount += o.TotalRefundedAmount
+}
+
+// AddPayment counts a charged payment and the fee it cost under processor
+// and currency.
+func (s PaymentSummary) AddPayment(processor string, currency Currency, amount, fee Money) {
+	s.AddTotals(processor, currency, CurrencySummary{TotalRequests: 1, TotalAmount: amount, TotalFee: fee, TotalNetAmount: amount - fee})
+}
+
+// AddRefund counts a succeeded refund under processor and currency.
+func (s PaymentSummary) AddRefund(processor string, currency Currency, amount Money) {
+	s.AddTotals(processor, currency, CurrencySummary{TotalRefunds: 1, TotalRefundedAmount: amount})
+}
+
+// Merge adds every total of other into s, leaving other untouched. Totals
+// without a currency breakdown, as reported by older peers, count as
+// DefaultCurrency.
+func (s PaymentSummary) Merge(other PaymentSummary) {
+	for processor, processorSummary := range other {
+		if _, ok := s[processor]; !ok {
+			s[processor] = ProcessorSummary{}
+		}
+		if len(processorSummary.Currencies) == 0 {
+			totals := CurrencySummary{
+				TotalRequests:       processorSummary.TotalRequests,
+				TotalAmount:         processorSummary.TotalAmount,
+				TotalFee:            processorSummary.TotalFee,
+				TotalNetAmount:      processorSummary.TotalNetAmount,
+				TotalRefunds:        processorSummary.TotalRefunds,
+				TotalRefundedAmount: processorSummary.TotalRefundedAmount,
+			}
+			if totals != (CurrencySummary{}) {
+				s.AddTotals(processor, DefaultCurrency, totals)
+			}
+			continue
+		}
+		for currency, totals := range processorSummary.Currencies {
+			s.AddTotals(processor, currency, totals)
+		}
+	}
+}
+
+// AddTotals adds totals under processor and currency. The Currencies maps
+// belong to s and are updated in place, so a ProcessorSummary must only
+// reach another summary through Merge.
+func (s PaymentSummary) AddTotals(processor string, currency Currency, totals CurrencySummary) {
+	processorSummary := s[processor]
+	if currency == DefaultCurrency {
+		processorSummary.TotalRequests += totals.TotalRequests
+		processorSummary.TotalAmount += totals.TotalAmount
+		processorSummary.TotalFee += totals.TotalFee
+		processorSummary.TotalNetAmount += totals.TotalNetAmount
+		processorSummary.TotalRefunds += totals.TotalRefunds
+		processorSummary.TotalRefundedAmount += totals.TotalRefundedAmount
+	}
+
+	if processorSummary.Currencies == nil {
+		processorSummary.Currencies = make(map[Currency]CurrencySummary)
+	}
+	currencyTotals := processorSummary.Currencies[currency]
+	currencyTotals.add(totals)
+	processorSummary.Currencies[currency] = currencyTotals
+
+	s[processor] = processorSummary
+}
+
+// AllCurrencies adds the totals of every currency together. The sum has no
+// meaning as an amount; it is only for comparing with processors whose own
+// summaries add currencies up this way.
+func (p ProcessorSummary) AllCurrencies() CurrencySummary {
+	var totals CurrencySummary
+	for _, t := range p.Currencies {
+		totals.add(t)
+	}
+	return totals
+}
+
+type QueueStats struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+	Workers  int `json:"workers"`
 }
 
 type PaymentRecord struct {
-	ID            uuid.UUID `json:"id"`
-	CorrelationID string    `json:"correlationId"`
-	Amount        float64   `json:"amount"`
-	Processor     string    `json:"processor"`
-	ProcessedAt   time.Time `json:"processedAt"`
-	Success       bool      `json:"success"`
+	ID            uuid.UUID          `json:"id"`
+	CorrelationID string             `json:"correlationId"`
+	Amount        Money              `json:"amount"`
+	Currency      Currency           `json:"currency"`
+	Processor     string             `json:"processor"`
+	CreatedAt     time.Time          `json:"createdAt"`
+	ProcessedAt   time.Time          `json:"processedAt"`
+	Success       bool               `json:"success"`
+	Status        PaymentStatus      `json:"status"`
+	StatusHistory []StatusTransition `json:"statusHistory"`
+	Attempts      int                `json:"attempts"`
+	LastAttemptAt time.Time          `json:"lastAttemptAt"`
+	// Set when a hedged request was also charged by another processor;
+	// the payment is still only counted under Processor
+	DuplicateProcessor string `json:"duplicateProcessor,omitempty"`
+	// What the processor charged us for the payment, and Amount less that
+	Fee       Money `json:"fee"`
+	NetAmount Money `json:"netAmount"`
+	// Sum of succeeded refunds; Amount stays the original charge
+	RefundedAmount Money    `json:"refundedAmount"`
+	Refunds        []Refund `json:"refunds,omitempty"`
+	// Only set for payments made through authorize and capture
+	Authorization *Authorization `json:"authorization,omitempty"`
 }
 
 type ProcessorHealth struct {
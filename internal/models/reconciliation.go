@@ -0,0 +1,155 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ReconciliationMode selects what a reconciliation compares.
+type ReconciliationMode string
+
+const (
+	// ReconciliationModeTotals compares each processor's admin summary with
+	// the cluster's totals for the window.
+	ReconciliationModeTotals ReconciliationMode = "totals"
+	// ReconciliationModeRecords looks up every payment of this instance
+	// settled within the window at the processor.
+	ReconciliationModeRecords ReconciliationMode = "records"
+)
+
+type ReconciliationStatus string
+
+const (
+	// ReconciliationMatched means both sides report the same totals, or
+	// totals that differ only by payments settled within the clock skew of
+	// the window's edges.
+	ReconciliationMatched ReconciliationStatus = "matched"
+	// ReconciliationMismatch means the totals differ; Delta says by how much.
+	ReconciliationMismatch ReconciliationStatus = "mismatch"
+	// ReconciliationIncomplete means the totals differ but some peers could
+	// not be asked for theirs, so the difference may be theirs.
+	ReconciliationIncomplete ReconciliationStatus = "incomplete"
+	// ReconciliationUnavailable means the processor's summary could not be
+	// fetched.
+	ReconciliationUnavailable ReconciliationStatus = "unavailable"
+)
+
+// ReconciliationTotals are the totals compared for one processor.
+type ReconciliationTotals struct {
+	TotalRequests       int   `json:"totalRequests"`
+	TotalAmount         Money `json:"totalAmount"`
+	TotalRefunds        int   `json:"totalRefunds"`
+	TotalRefundedAmount Money `json:"totalRefundedAmount"`
+}
+
+// Sub returns t minus o.
+func (t ReconciliationTotals) Sub(o ReconciliationTotals) ReconciliationTotals {
+	return ReconciliationTotals{
+		TotalRequests:       t.TotalRequests - o.TotalRequests,
+		TotalAmount:         t.TotalAmount - o.TotalAmount,
+		TotalRefunds:        t.TotalRefunds - o.TotalRefunds,
+		TotalRefundedAmount: t.TotalRefundedAmount - o.TotalRefundedAmount,
+	}
+}
+
+// Between reports whether every total of t lies within low and high.
+func (t ReconciliationTotals) Between(low, high ReconciliationTotals) bool {
+	return low.TotalRequests <= t.TotalRequests && t.TotalRequests <= high.TotalRequests &&
+		low.TotalAmount <= t.TotalAmount && t.TotalAmount <= high.TotalAmount &&
+		low.TotalRefunds <= t.TotalRefunds && t.TotalRefunds <= high.TotalRefunds &&
+		low.TotalRefundedAmount <= t.TotalRefundedAmount && t.TotalRefundedAmount <= high.TotalRefundedAmount
+}
+
+// ProcessorReconciliation compares what this cluster recorded for a
+// processor with what the processor itself reports. Delta is the
+// processor's totals minus ours: positive when the processor holds
+// payments we did not record.
+type ProcessorReconciliation struct {
+	Processor string               `json:"processor"`
+	Status    ReconciliationStatus `json:"status"`
+	Local     ReconciliationTotals `json:"local"`
+	Remote    ReconciliationTotals `json:"remote"`
+	Delta     ReconciliationTotals `json:"delta"`
+	Error     string               `json:"error,omitempty"`
+}
+
+// ReconciliationReport is the outcome of one reconciliation run over the
+// window [From, To].
+type ReconciliationReport struct {
+	ID               uuid.UUID                 `json:"id"`
+	Trigger          string                    `json:"trigger"`
+	From             time.Time                 `json:"from"`
+	To               time.Time                 `json:"to"`
+	StartedAt        time.Time                 `json:"startedAt"`
+	FinishedAt       time.Time                 `json:"finishedAt"`
+	Mode             ReconciliationMode        `json:"mode"`
+	Discrepancies    int                       `json:"discrepancies"`
+	Processors       []ProcessorReconciliation `json:"processors,omitempty"`
+	Records          *RecordReconciliation     `json:"records,omitempty"`
+	UnavailablePeers []string                  `json:"unavailablePeers,omitempty"`
+}
+
+// ReconciliationRequest is the optional body of POST /admin/reconciliations.
+// A missing bound defaults to the window a scheduled run would check now and
+// a missing mode to totals. Repair only applies to the records mode.
+type ReconciliationRequest struct {
+	From   *time.Time         `json:"from"`
+	To     *time.Time         `json:"to"`
+	Mode   ReconciliationMode `json:"mode"`
+	Repair bool               `json:"repair"`
+}
+
+// RecordStatus classifies one local payment against the processors.
+type RecordStatus string
+
+const (
+	// RecordMatched means the processor holds the payment with the same
+	// amounts, or no processor holds a payment recorded as failed.
+	RecordMatched RecordStatus = "matched"
+	// RecordMissingAtProcessor means the payment is recorded as charged but
+	// its processor does not know it.
+	RecordMissingAtProcessor RecordStatus = "missing_at_processor"
+	// RecordUnknownLocally means a processor charged a payment recorded as
+	// failed.
+	RecordUnknownLocally RecordStatus = "unknown_locally"
+	// RecordAmountMismatch means the processor charged or refunded a
+	// different amount.
+	RecordAmountMismatch RecordStatus = "amount_mismatch"
+	// RecordUnverified means a processor could not be asked.
+	RecordUnverified RecordStatus = "unverified"
+)
+
+// MaxRecordDiscrepancies bounds the discrepancies listed in a report; the
+// counts still cover every record.
+const MaxRecordDiscrepancies = 1000
+
+// RecordAmounts are the amounts compared for one payment.
+type RecordAmounts struct {
+	Amount         Money `json:"amount"`
+	RefundedAmount Money `json:"refundedAmount"`
+}
+
+// RecordDiscrepancy is a local payment that did not match. Remote is what
+// the processor holds, when it holds the payment at all.
+type RecordDiscrepancy struct {
+	CorrelationID string         `json:"correlationId"`
+	Status        RecordStatus   `json:"status"`
+	LocalStatus   PaymentStatus  `json:"localStatus"`
+	Processor     string         `json:"processor,omitempty"`
+	Local         RecordAmounts  `json:"local"`
+	Remote        *RecordAmounts `json:"remote,omitempty"`
+	Repaired      bool           `json:"repaired,omitempty"`
+	Error         string         `json:"error,omitempty"`
+}
+
+// RecordReconciliation is the outcome of a records mode run. Counts has an
+// entry per RecordStatus seen; Truncated is set when more than
+// MaxRecordDiscrepancies records did not match.
+type RecordReconciliation struct {
+	Checked       int                  `json:"checked"`
+	Counts        map[RecordStatus]int `json:"counts"`
+	Repaired      int                  `json:"repaired"`
+	Discrepancies []RecordDiscrepancy  `json:"discrepancies"`
+	Truncated     bool                 `json:"truncated,omitempty"`
+}
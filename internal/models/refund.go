@@ -0,0 +1,86 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RefundStatus is where a single refund is in its lifecycle.
+type RefundStatus string
+
+const (
+	// RefundStatusPending: sent to the processor, outcome not known yet
+	RefundStatusPending RefundStatus = "pending"
+	// RefundStatusSucceeded: the processor reversed the amount
+	RefundStatusSucceeded RefundStatus = "succeeded"
+	// RefundStatusFailed: the processor did not reverse anything
+	RefundStatusFailed RefundStatus = "failed"
+)
+
+// RefundRequest is the body of POST /payments/:correlationId/refunds. A
+// missing amount refunds whatever is left of the payment.
+type RefundRequest struct {
+	Amount Money `json:"amount" binding:"omitempty,gt=0"`
+}
+
+// ProcessorRefundRequest is sent to the processor that handled the payment.
+// RefundID lets the processor recognise a retried refund.
+type ProcessorRefundRequest struct {
+	RefundID    uuid.UUID `json:"refundId"`
+	Amount      Money     `json:"amount"`
+	RequestedAt time.Time `json:"requestedAt"`
+}
+
+// Refund is one full or partial reversal of a payment, stored on the payment
+// it reverses.
+type Refund struct {
+	ID          uuid.UUID    `json:"id"`
+	Amount      Money        `json:"amount"`
+	Processor   string       `json:"processor"`
+	Status      RefundStatus `json:"status"`
+	RequestedAt time.Time    `json:"requestedAt"`
+	RefundedAt  time.Time    `json:"refundedAt"`
+	Error       string       `json:"error,omitempty"`
+	// Set on the refund of a duplicate charge a hedged request left on
+	// another processor. It reverses that charge, not the payment, so it is
+	// left out of RefundedAmount, the refundable amount and the summaries.
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// RefundableAmount is what is left to refund, counting refunds still in
+// flight as already taken.
+func (r *PaymentRecord) RefundableAmount() Money {
+	remaining := r.Amount
+	for _, refund := range r.Refunds {
+		if refund.Status != RefundStatusFailed && !refund.Duplicate {
+			remaining -= refund.Amount
+		}
+	}
+	return remaining
+}
+
+// SetRefund replaces the refund with the same ID, or appends it. Refunds is
+// copied first so records sharing the slice never see each other's changes.
+func (r *PaymentRecord) SetRefund(refund Refund) {
+	refunds := make([]Refund, 0, len(r.Refunds)+1)
+	replaced := false
+	for _, existing := range r.Refunds {
+		if existing.ID == refund.ID {
+			existing = refund
+			replaced = true
+		}
+		refunds = append(refunds, existing)
+	}
+	if !replaced {
+		refunds = append(refunds, refund)
+	}
+	r.Refunds = refunds
+
+	r.RefundedAmount = 0
+	for _, existing := range r.Refunds {
+		if existing.Status == RefundStatusSucceeded && !existing.Duplicate {
+			r.RefundedAmount += existing.Amount
+		}
+	}
+}
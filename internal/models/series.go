@@ -0,0 +1,70 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrInvalidInterval is returned for a series interval that is not a
+	// positive whole number of seconds.
+	ErrInvalidInterval = errors.New("interval must be a positive whole number of seconds, such as 30s, 1m or 1h")
+	// ErrSeriesTooLong is returned when a window holds more than
+	// MaxSeriesPoints intervals.
+	ErrSeriesTooLong = errors.New("too many intervals in the window, narrow it or use a larger interval")
+)
+
+const MaxSeriesPoints = 10000
+
+// ParseSummaryInterval parses a series interval such as "1m" or "1h".
+func ParseSummaryInterval(s string) (time.Duration, error) {
+	interval, err := time.ParseDuration(s)
+	if err != nil || interval < time.Second || interval%time.Second != 0 {
+		return 0, ErrInvalidInterval
+	}
+	return interval, nil
+}
+
+// SummaryPoint holds the totals of one interval of a series. Intervals are
+// aligned to multiples of the interval since the Unix epoch, in UTC.
+// FailedPayments counts payments that finally failed within the interval;
+// no processor charged them, so they are counted apart from the
+// per-processor totals in Processors.
+type SummaryPoint struct {
+	Start          time.Time      `json:"start"`
+	Processors     PaymentSummary `json:"processors"`
+	FailedPayments int            `json:"failedPayments"`
+}
+
+// SummarySeries is the GET /payments-summary response when an interval is
+// given: every interval of the window in order, empty ones included.
+type SummarySeries struct {
+	Interval string         `json:"interval"`
+	Points   []SummaryPoint `json:"points"`
+}
+
+// MergeSeries adds the points of b into a, matching them by start. Both
+// must be ordered by start; so is the result.
+func MergeSeries(a, b []SummaryPoint) []SummaryPoint {
+	merged := make([]SummaryPoint, 0, max(len(a), len(b)))
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || (len(a) > 0 && a[0].Start.Before(b[0].Start)):
+			merged = append(merged, a[0])
+			a = a[1:]
+		case len(a) == 0 || b[0].Start.Before(a[0].Start):
+			merged = append(merged, b[0])
+			b = b[1:]
+		default:
+			point := a[0]
+			if point.Processors == nil {
+				point.Processors = PaymentSummary{}
+			}
+			point.Processors.Merge(b[0].Processors)
+			point.FailedPayments += b[0].FailedPayments
+			merged = append(merged, point)
+			a, b = a[1:], b[1:]
+		}
+	}
+	return merged
+}
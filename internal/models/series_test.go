@@ -0,0 +1,66 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseSummaryInterval(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"1s", time.Second},
+		{"1m", time.Minute},
+		{"1h", time.Hour},
+		{"90s", 90 * time.Second},
+		{"500ms", 0},
+		{"1.5s", 0},
+		{"0s", 0},
+		{"-1m", 0},
+		{"hourly", 0},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSummaryInterval(tt.in)
+		if tt.want == 0 {
+			if !errors.Is(err, ErrInvalidInterval) {
+				t.Errorf("ParseSummaryInterval(%q) = %v, %v; want ErrInvalidInterval", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSummaryInterval(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestMergeSeries(t *testing.T) {
+	base := time.Date(2025, 7, 10, 12, 0, 0, 0, time.UTC)
+	point := func(minute int, requests, failed int) SummaryPoint {
+		return SummaryPoint{
+			Start:          base.Add(time.Duration(minute) * time.Minute),
+			Processors:     PaymentSummary{"default": {TotalRequests: requests, TotalAmount: Money(requests * 100)}},
+			FailedPayments: failed,
+		}
+	}
+
+	a := []SummaryPoint{point(0, 1, 0), point(1, 2, 1), point(3, 1, 0)}
+	b := []SummaryPoint{point(1, 3, 2), point(2, 1, 0), point(4, 1, 1)}
+	merged := MergeSeries(a, b)
+
+	want := []struct{ minute, requests, failed int }{{0, 1, 0}, {1, 5, 3}, {2, 1, 0}, {3, 1, 0}, {4, 1, 1}}
+	if len(merged) != len(want) {
+		t.Fatalf("Expected %d points, got %d: %+v", len(want), len(merged), merged)
+	}
+	for i, w := range want {
+		got := merged[i]
+		if !got.Start.Equal(base.Add(time.Duration(w.minute)*time.Minute)) || got.Processors["default"].TotalRequests != w.requests || got.FailedPayments != w.failed {
+			t.Errorf("Point %d: got %+v, want minute %d with %d requests and %d failed", i, got, w.minute, w.requests, w.failed)
+		}
+	}
+	if merged[1].Processors["default"].TotalAmount != 500 {
+		t.Errorf("Expected merged amounts to add up, got %s", merged[1].Processors["default"].TotalAmount)
+	}
+}
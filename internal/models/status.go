@@ -0,0 +1,107 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PaymentStatus is where a payment is in its lifecycle.
+type PaymentStatus string
+
+const (
+	// PaymentStatusPending: accepted and waiting in the intake queue
+	PaymentStatusPending PaymentStatus = "pending"
+	// PaymentStatusProcessing: a request to a processor is in flight
+	PaymentStatusProcessing PaymentStatus = "processing"
+	// PaymentStatusRetryScheduled: every processor failed; another attempt is due
+	PaymentStatusRetryScheduled PaymentStatus = "retry_scheduled"
+	// PaymentStatusSucceeded: a processor accepted the payment
+	PaymentStatusSucceeded PaymentStatus = "succeeded"
+	// PaymentStatusFailed: attempts or deadline exhausted; no more retries
+	PaymentStatusFailed PaymentStatus = "failed"
+	// PaymentStatusPartiallyRefunded: part of a succeeded payment was refunded
+	PaymentStatusPartiallyRefunded PaymentStatus = "partially_refunded"
+	// PaymentStatusRefunded: the whole amount was refunded
+	PaymentStatusRefunded PaymentStatus = "refunded"
+	// PaymentStatusAuthorized: an amount is held on a processor awaiting capture
+	PaymentStatusAuthorized PaymentStatus = "authorized"
+	// PaymentStatusVoided: the hold was released without capturing
+	PaymentStatusVoided PaymentStatus = "voided"
+	// PaymentStatusExpired: the hold lapsed before it was captured
+	PaymentStatusExpired PaymentStatus = "expired"
+)
+
+var paymentTransitions = map[PaymentStatus][]PaymentStatus{
+	PaymentStatusPending:        {PaymentStatusProcessing},
+	PaymentStatusProcessing:     {PaymentStatusSucceeded, PaymentStatusRetryScheduled, PaymentStatusFailed, PaymentStatusAuthorized},
+	PaymentStatusAuthorized:     {PaymentStatusSucceeded, PaymentStatusVoided, PaymentStatusExpired},
+	PaymentStatusRetryScheduled: {PaymentStatusProcessing, PaymentStatusFailed},
+	PaymentStatusSucceeded:      {PaymentStatusPartiallyRefunded, PaymentStatusRefunded},
+	// Each further partial refund is recorded as another transition
+	PaymentStatusPartiallyRefunded: {PaymentStatusPartiallyRefunded, PaymentStatusRefunded},
+	// Only reconciliation revives a failed payment, once a processor confirms
+	// it was charged after all
+	PaymentStatusFailed: {PaymentStatusSucceeded},
+}
+
+// CanTransition reports whether a payment may move from s to next.
+func (s PaymentStatus) CanTransition(next PaymentStatus) bool {
+	for _, allowed := range paymentTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTerminal reports whether no further transitions are possible.
+func (s PaymentStatus) IsTerminal() bool {
+	return len(paymentTransitions[s]) == 0
+}
+
+// IsCharged reports whether a processor accepted the payment, regardless of
+// any refunds since.
+func (s PaymentStatus) IsCharged() bool {
+	switch s {
+	case PaymentStatusSucceeded, PaymentStatusPartiallyRefunded, PaymentStatusRefunded:
+		return true
+	}
+	return false
+}
+
+type StatusTransition struct {
+	Status PaymentStatus `json:"status"`
+	At     time.Time     `json:"at"`
+	Reason string        `json:"reason,omitempty"`
+}
+
+// NewPaymentRecord creates a pending record for a payment accepted at at.
+func NewPaymentRecord(correlationID string, amount Money, at time.Time) *PaymentRecord {
+	return &PaymentRecord{
+		ID:            uuid.New(),
+		CorrelationID: correlationID,
+		Amount:        amount,
+		CreatedAt:     at,
+		ProcessedAt:   at,
+		Status:        PaymentStatusPending,
+		StatusHistory: []StatusTransition{{Status: PaymentStatusPending, At: at}},
+	}
+}
+
+// Transition moves the record to next, recording when and why. Moves not
+// allowed by the lifecycle are rejected and leave the record unchanged.
+func (r *PaymentRecord) Transition(next PaymentStatus, at time.Time, reason string) error {
+	if !r.Status.CanTransition(next) {
+		return fmt.Errorf("invalid payment status transition %s -> %s", r.Status, next)
+	}
+
+	r.Status = next
+	r.Success = next.IsCharged()
+	// Copy so records sharing a history slice never see each other's appends
+	history := make([]StatusTransition, len(r.StatusHistory), len(r.StatusHistory)+1)
+	copy(history, r.StatusHistory)
+	r.StatusHistory = append(history, StatusTransition{Status: next, At: at, Reason: reason})
+	return nil
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPaymentRecord_Transition(t *testing.T) {
+	start := time.Date(2025, 7, 10, 12, 0, 0, 0, time.UTC)
+	record := NewPaymentRecord("c", 1000, start)
+
+	if err := record.Transition(PaymentStatusSucceeded, start, ""); err == nil {
+		t.Error("Expected pending -> succeeded to be rejected")
+	}
+	if record.Status != PaymentStatusPending || len(record.StatusHistory) != 1 {
+		t.Errorf("Rejected transition changed the record: %+v", record)
+	}
+
+	steps := []PaymentStatus{
+		PaymentStatusProcessing,
+		PaymentStatusRetryScheduled,
+		PaymentStatusProcessing,
+		PaymentStatusSucceeded,
+	}
+	for i, status := range steps {
+		if err := record.Transition(status, start.Add(time.Duration(i+1)*time.Second), ""); err != nil {
+			t.Fatalf("Transition to %s failed: %v", status, err)
+		}
+	}
+
+	if !record.Success || record.Status.IsTerminal() {
+		t.Errorf("Expected successful, still refundable record, got %+v", record)
+	}
+	if len(record.StatusHistory) != 5 || !record.StatusHistory[4].At.Equal(start.Add(4*time.Second)) {
+		t.Errorf("Unexpected history: %+v", record.StatusHistory)
+	}
+	if err := record.Transition(PaymentStatusProcessing, start, ""); err == nil {
+		t.Error("Expected succeeded -> processing to be rejected")
+	}
+
+	if err := record.Transition(PaymentStatusRefunded, start.Add(time.Minute), ""); err != nil {
+		t.Fatalf("Transition to refunded failed: %v", err)
+	}
+	if !record.Success || !record.Status.IsTerminal() {
+		t.Errorf("Expected a refunded payment to stay charged and be terminal, got %+v", record)
+	}
+}
+
+func TestPaymentRecord_TransitionDoesNotShareHistory(t *testing.T) {
+	record := NewPaymentRecord("c", 1000, time.Now())
+	copied := *record
+
+	record.Transition(PaymentStatusProcessing, time.Now(), "")
+	copied.Transition(PaymentStatusProcessing, time.Now(), "other")
+
+	if record.StatusHistory[1].Reason != "" {
+		t.Errorf("Copies of a record must not share history, got %+v", record.StatusHistory)
+	}
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type WebhookEventType string
+
+const (
+	WebhookPaymentSucceeded WebhookEventType = "payment.succeeded"
+	WebhookPaymentFailed    WebhookEventType = "payment.failed"
+	WebhookPaymentRefunded  WebhookEventType = "payment.refunded"
+)
+
+// WebhookEventTypes lists every event a webhook can subscribe to.
+var WebhookEventTypes = []WebhookEventType{WebhookPaymentSucceeded, WebhookPaymentFailed, WebhookPaymentRefunded}
+
+// Valid reports whether t is a known event type.
+func (t WebhookEventType) Valid() bool {
+	for _, known := range WebhookEventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEventForStatus returns the event announcing that a payment moved to
+// status, if there is one. Only final outcomes are announced: a payment
+// waiting for a retry has not failed yet.
+func WebhookEventForStatus(status PaymentStatus) (WebhookEventType, bool) {
+	switch status {
+	case PaymentStatusSucceeded:
+		return WebhookPaymentSucceeded, true
+	case PaymentStatusFailed:
+		return WebhookPaymentFailed, true
+	case PaymentStatusPartiallyRefunded, PaymentStatusRefunded:
+		return WebhookPaymentRefunded, true
+	}
+	return "", false
+}
+
+// Webhook is an endpoint registered to receive payment events. Secret signs
+// every delivery and is only returned when the webhook is created.
+type Webhook struct {
+	ID        uuid.UUID          `json:"id"`
+	URL       string             `json:"url"`
+	Events    []WebhookEventType `json:"events"`
+	Secret    string             `json:"secret,omitempty"`
+	CreatedAt time.Time          `json:"createdAt"`
+}
+
+// Subscribes reports whether w wants events of type t.
+func (w *Webhook) Subscribes(t WebhookEventType) bool {
+	for _, event := range w.Events {
+		if event == t {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookRequest is the body of POST /webhooks. Missing events subscribe to
+// all of them; a missing secret is generated.
+type WebhookRequest struct {
+	URL    string             `json:"url" binding:"required,url"`
+	Events []WebhookEventType `json:"events"`
+	Secret string             `json:"secret"`
+}
+
+// WebhookEvent is the JSON body posted to webhooks.
+type WebhookEvent struct {
+	ID        uuid.UUID        `json:"id"`
+	Type      WebhookEventType `json:"type"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Payment   PaymentRecord    `json:"payment"`
+}
+
+// WebhookDelivery is one event on its way to one webhook.
+type WebhookDelivery struct {
+	ID            uuid.UUID    `json:"id"`
+	WebhookID     uuid.UUID    `json:"webhookId"`
+	Event         WebhookEvent `json:"event"`
+	Attempts      int          `json:"attempts"`
+	LastAttemptAt time.Time    `json:"lastAttemptAt,omitempty"`
+	LastError     string       `json:"lastError,omitempty"`
+}
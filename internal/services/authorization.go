@@ -0,0 +1,556 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"th_payment_processor/internal/models"
+)
+
+const (
+	defaultAuthorizationTTL            = 7 * 24 * time.Hour
+	defaultAuthorizationExpiryInterval = time.Minute
+
+	pendingAuthorize = "authorize"
+	pendingCapture   = "capture"
+	pendingVoid      = "void"
+)
+
+var (
+	// ErrAuthorizationFailed is returned when no processor placed the hold.
+	ErrAuthorizationFailed = errors.New("no payment processor authorized the payment")
+	// ErrAuthorizationPending is returned when the processor asked to place,
+	// capture or void a hold could not be heard from. The action stays
+	// pending and is resent to that processor until it answers.
+	ErrAuthorizationPending = errors.New("authorization outcome is not known yet")
+	// ErrNotAuthorized is returned when capturing or voiding a payment that
+	// holds no open authorization.
+	ErrNotAuthorized = errors.New("payment has no open authorization")
+	// ErrAuthorizationExpired is returned when the hold has lapsed.
+	ErrAuthorizationExpired = errors.New("authorization has expired")
+	// ErrAuthorizationBusy is returned while another capture or void of the
+	// same authorization is in progress.
+	ErrAuthorizationBusy = errors.New("authorization is being captured or voided")
+	// ErrCaptureExceedsAuthorization is returned when capturing more than was held.
+	ErrCaptureExceedsAuthorization = errors.New("capture exceeds the authorized amount")
+	// ErrProcessorRejected is returned when the processor answered a capture
+	// or void with an error status.
+	ErrProcessorRejected = errors.New("processor rejected the request")
+)
+
+// AuthorizePayment holds req.Amount on the first processor, in routing
+// order, that accepts it. Only a processor declining the hold moves on to
+// the next one; when a request times out or breaks off the hold may have
+// been placed anyway, so the payment waits on that processor with
+// ErrAuthorizationPending. The hold expires after AUTHORIZATION_TTL unless
+// captured. Repeating an authorization returns the existing payment.
+func (s *PaymentService) AuthorizePayment(ctx context.Context, req *models.PaymentRequest) (*models.PaymentRecord, error) {
+	tracer := otel.Tracer("payment-service")
+	ctx, span := tracer.Start(ctx, "AuthorizePayment")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("payment.correlation_id", req.CorrelationID),
+		attribute.Float64("payment.amount", req.Amount.Float64()),
+	)
+
+	if err := req.Validate(); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	now := time.Now()
+	record := models.NewPaymentRecord(req.CorrelationID, req.Amount, now)
+	record.Currency = req.Currency
+	record.Authorization = &models.Authorization{
+		Amount:    req.Amount,
+		ExpiresAt: now.Add(s.authorizationTTL()),
+	}
+	existing, reserved, err := s.storage.ReservePayment(record)
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to reserve payment: %w", err)
+	case reserved:
+	case existing.Authorization == nil || existing.Authorization.Amount != req.Amount || existing.Currency.OrDefault() != req.Currency:
+		return nil, ErrPaymentConflict
+	case existing.Authorization.PendingAction == pendingAuthorize:
+		span.SetAttributes(attribute.Bool("payment.already_exists", true))
+		return existing, ErrAuthorizationPending
+	default:
+		span.SetAttributes(attribute.Bool("payment.already_exists", true))
+		return existing, nil
+	}
+
+	record.Attempts = 1
+	record.LastAttemptAt = now
+	s.transition(record, models.PaymentStatusProcessing, "")
+	s.savePayment(record)
+
+	// The caller going away must not strand a hold we never recorded
+	ctx = context.WithoutCancel(ctx)
+
+	for _, candidate := range s.routing.Order(req, s.processorCandidates()) {
+		if !candidate.Healthy {
+			continue
+		}
+		p, ok := s.processors.Get(candidate.Name)
+		if !ok || !p.breaker.Allow() {
+			continue
+		}
+
+		// Stored as pending first, so a hold placed before a crash is
+		// still asked about
+		record.Processor = p.Name
+		record.LastAttemptAt = time.Now()
+		record.UpdateAuthorization(func(auth *models.Authorization) {
+			auth.PendingAction = pendingAuthorize
+		})
+		if err := s.savePayment(record); err != nil {
+			return record, err
+		}
+
+		var resp models.ProcessorAuthorizationResponse
+		err := s.postProcessor(ctx, p, "/payments/authorize", models.ProcessorAuthorizationRequest{
+			CorrelationID: req.CorrelationID,
+			Amount:        req.Amount,
+			Currency:      req.Currency,
+			RequestedAt:   now,
+			ExpiresAt:     record.Authorization.ExpiresAt,
+		}, &resp)
+		p.breaker.Record(err == nil, isTimeoutError(err))
+		if err != nil && !processorDeclined(err) {
+			// Trying another processor could hold the amount twice
+			logrus.Warnf("%s processor did not answer the authorization of payment %s, keeping it pending: %v", p.Name, req.CorrelationID, err)
+			span.SetAttributes(attribute.String("payment.processor.pending", p.Name))
+			return record, fmt.Errorf("%w: %v", ErrAuthorizationPending, err)
+		}
+		if err != nil {
+			logrus.Errorf("%s processor declined to authorize payment %s: %v", p.Name, req.CorrelationID, err)
+			continue
+		}
+
+		s.holdAuthorization(record, p.Name, resp)
+		span.SetAttributes(attribute.String("payment.processor.used", p.Name))
+		if err := s.savePayment(record); err != nil {
+			return record, err
+		}
+		return record, nil
+	}
+
+	span.SetStatus(codes.Error, ErrAuthorizationFailed.Error())
+	record.Processor = ""
+	record.UpdateAuthorization((*models.Authorization).ClearPending)
+	s.transition(record, models.PaymentStatusFailed, ErrAuthorizationFailed.Error())
+	s.savePayment(record)
+	return record, ErrAuthorizationFailed
+}
+
+// CapturePayment charges amount of an authorized payment, releasing the
+// rest of the hold; a zero amount captures all of it. The captured amount
+// becomes the payment's amount. A capture the processor did not answer
+// stays pending, returned with ErrAuthorizationPending, and is resent.
+func (s *PaymentService) CapturePayment(ctx context.Context, correlationID string, amount models.Money) (*models.PaymentRecord, error) {
+	tracer := otel.Tracer("payment-service")
+	ctx, span := tracer.Start(ctx, "CapturePayment")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("payment.correlation_id", correlationID))
+
+	record, err := s.beginAuthorizationAction(correlationID, pendingCapture, func(record *models.PaymentRecord) error {
+		auth := record.Authorization
+		if amount == 0 {
+			amount = auth.Amount
+		}
+		if amount > auth.Amount {
+			return fmt.Errorf("%w: %s authorized", ErrCaptureExceedsAuthorization, auth.Amount)
+		}
+		if err := record.Currency.OrDefault().ValidateAmount(amount); err != nil {
+			return err
+		}
+		record.UpdateAuthorization(func(auth *models.Authorization) {
+			auth.PendingAmount = amount
+		})
+		return nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(attribute.Float64("payment.capture.amount", amount.Float64()))
+
+	return s.sendCapture(context.WithoutCancel(ctx), record.Processor, correlationID, amount)
+}
+
+// sendCapture sends a capture of amount to processor and records its answer.
+func (s *PaymentService) sendCapture(ctx context.Context, processor, correlationID string, amount models.Money) (*models.PaymentRecord, error) {
+	// The processor answers with the charged payment, fee included
+	var captured processorPayment
+	sendErr := s.postAuthorizationAction(ctx, processor, authorizationActionPath(correlationID, pendingCapture), models.ProcessorCaptureRequest{Amount: amount}, &captured)
+
+	return s.finishAuthorizationAction(correlationID, pendingCapture, sendErr, func(record *models.PaymentRecord) {
+		record.Amount = amount
+		record.ProcessedAt = time.Now()
+		s.applyFee(record, captured.Fee)
+		record.UpdateAuthorization(func(auth *models.Authorization) {
+			auth.CapturedAmount = amount
+		})
+		s.transition(record, models.PaymentStatusSucceeded, fmt.Sprintf("captured %s by %s", amount, record.Processor))
+	})
+}
+
+// VoidPayment releases the hold of an authorized payment without charging
+// it. Like a capture, a void the processor did not answer stays pending.
+func (s *PaymentService) VoidPayment(ctx context.Context, correlationID string) (*models.PaymentRecord, error) {
+	tracer := otel.Tracer("payment-service")
+	ctx, span := tracer.Start(ctx, "VoidPayment")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("payment.correlation_id", correlationID))
+
+	record, err := s.beginAuthorizationAction(correlationID, pendingVoid, nil)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	return s.sendVoid(context.WithoutCancel(ctx), record.Processor, correlationID)
+}
+
+// sendVoid sends a void to processor and records its answer.
+func (s *PaymentService) sendVoid(ctx context.Context, processor, correlationID string) (*models.PaymentRecord, error) {
+	sendErr := s.postAuthorizationAction(ctx, processor, authorizationActionPath(correlationID, pendingVoid), nil, nil)
+
+	return s.finishAuthorizationAction(correlationID, pendingVoid, sendErr, func(record *models.PaymentRecord) {
+		s.transition(record, models.PaymentStatusVoided, "voided by "+record.Processor)
+	})
+}
+
+// holdAuthorization records the hold processor placed for record.
+func (s *PaymentService) holdAuthorization(record *models.PaymentRecord, processor string, resp models.ProcessorAuthorizationResponse) {
+	record.Processor = processor
+	record.UpdateAuthorization(func(auth *models.Authorization) {
+		auth.ID = resp.ID
+		auth.AuthorizedAt = time.Now()
+		auth.ClearPending()
+	})
+	s.transition(record, models.PaymentStatusAuthorized, "held by "+processor)
+}
+
+// StartAuthorizationExpiry resends authorizations, captures and voids whose
+// outcome is not known and expires lapsed authorizations every AUTHORIZATION_EXPIRY_INTERVAL until
+// ctx is cancelled.
+func (s *PaymentService) StartAuthorizationExpiry(ctx context.Context) {
+	interval := s.config.AuthorizationExpiryInterval
+	if interval <= 0 {
+		interval = defaultAuthorizationExpiryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if settled := s.retryPendingAuthorizations(ctx, time.Now()); settled > 0 {
+				logrus.Infof("Settled %d pending authorizations, captures and voids", settled)
+			}
+			if expired := s.expireAuthorizations(ctx, time.Now()); expired > 0 {
+				logrus.Infof("Expired %d uncaptured authorizations", expired)
+			}
+		}
+	}
+}
+
+// retryPendingAuthorizations resends every authorization, capture and void
+// that has been waiting on its processor for longer than the processor's
+// timeout, so requests still in flight are left alone. The processor
+// recognises the correlationId and answers with the hold, capture or void it
+// already made. It returns how many were settled.
+func (s *PaymentService) retryPendingAuthorizations(ctx context.Context, now time.Time) int {
+	var pending []*models.PaymentRecord
+	for _, record := range s.storage.GetAllPayments() {
+		if record.Authorization == nil || record.Authorization.PendingAction == "" {
+			continue
+		}
+		if p, ok := s.processors.Get(record.Processor); ok && now.Sub(record.LastAttemptAt) < p.Timeout {
+			continue
+		}
+		pending = append(pending, record)
+	}
+
+	settled := 0
+	for _, record := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		switch record.Authorization.PendingAction {
+		case pendingCapture:
+			if _, err := s.sendCapture(ctx, record.Processor, record.CorrelationID, record.Authorization.PendingAmount); !errors.Is(err, ErrAuthorizationPending) {
+				settled++
+			}
+			continue
+		case pendingVoid:
+			if _, err := s.sendVoid(ctx, record.Processor, record.CorrelationID); !errors.Is(err, ErrAuthorizationPending) {
+				settled++
+			}
+			continue
+		}
+
+		var resp models.ProcessorAuthorizationResponse
+		sendErr := s.postAuthorizationAction(ctx, record.Processor, "/payments/authorize", models.ProcessorAuthorizationRequest{
+			CorrelationID: record.CorrelationID,
+			Amount:        record.Authorization.Amount,
+			Currency:      record.Currency,
+			RequestedAt:   record.CreatedAt,
+			ExpiresAt:     record.Authorization.ExpiresAt,
+		}, &resp)
+		if s.settlePendingAuthorization(record.CorrelationID, resp, sendErr, now) {
+			settled++
+		}
+	}
+	return settled
+}
+
+// settlePendingAuthorization records the processor's answer to a resent
+// authorization and reports whether its outcome is now known. A hold that
+// could still not be confirmed once it would have lapsed is failed, since
+// the processor has released it by then either way.
+func (s *PaymentService) settlePendingAuthorization(correlationID string, resp models.ProcessorAuthorizationResponse, sendErr error, now time.Time) bool {
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+
+	record, ok := s.storage.GetPaymentByCorrelationID(correlationID)
+	if !ok || record.Authorization == nil || record.Authorization.PendingAction != pendingAuthorize {
+		return false
+	}
+
+	record.LastAttemptAt = now
+	switch {
+	case sendErr == nil:
+		s.holdAuthorization(record, record.Processor, resp)
+		logrus.Infof("Authorization of payment %s confirmed by %s", correlationID, record.Processor)
+	case processorDeclined(sendErr):
+		record.UpdateAuthorization((*models.Authorization).ClearPending)
+		s.transition(record, models.PaymentStatusFailed, fmt.Sprintf("%s: %v", ErrAuthorizationFailed, sendErr))
+		logrus.Errorf("%s processor declined the pending authorization of payment %s: %v", record.Processor, correlationID, sendErr)
+	case !now.Before(record.Authorization.ExpiresAt):
+		record.UpdateAuthorization((*models.Authorization).ClearPending)
+		s.transition(record, models.PaymentStatusFailed, "authorization not confirmed before "+record.Authorization.ExpiresAt.Format(time.RFC3339))
+		logrus.Errorf("Authorization of payment %s was never confirmed by %s and has lapsed: %v", correlationID, record.Processor, sendErr)
+	default:
+		logrus.Warnf("Authorization of payment %s still has no answer from %s: %v", correlationID, record.Processor, sendErr)
+		s.savePayment(record)
+		return false
+	}
+	s.savePayment(record)
+	return true
+}
+
+// expireAuthorizations moves every authorization that lapsed by now to
+// expired and asks its processor to release the hold. The processor lets
+// the hold lapse on its own as well, so a failed release is only logged.
+func (s *PaymentService) expireAuthorizations(ctx context.Context, now time.Time) int {
+	var lapsed []*models.PaymentRecord
+	for _, record := range s.storage.GetAllPayments() {
+		if record.Status == models.PaymentStatusAuthorized && record.Authorization.PendingAction == "" && !now.Before(record.Authorization.ExpiresAt) {
+			lapsed = append(lapsed, record)
+		}
+	}
+
+	expired := 0
+	for _, candidate := range lapsed {
+		record, ok := s.expireAuthorization(candidate.CorrelationID, now)
+		if !ok {
+			continue
+		}
+		expired++
+
+		if err := s.postAuthorizationAction(ctx, record.Processor, authorizationActionPath(record.CorrelationID, pendingVoid), nil, nil); err != nil {
+			logrus.Warnf("Failed to release expired authorization %s on %s: %v", record.CorrelationID, record.Processor, err)
+		}
+	}
+	return expired
+}
+
+// expireAuthorization moves the payment to expired if it is still an open
+// authorization that lapsed by now, re-checked under recordMu.
+func (s *PaymentService) expireAuthorization(correlationID string, now time.Time) (*models.PaymentRecord, bool) {
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+
+	record, ok := s.storage.GetPaymentByCorrelationID(correlationID)
+	if !ok || record.Status != models.PaymentStatusAuthorized || record.Authorization.PendingAction != "" || now.Before(record.Authorization.ExpiresAt) {
+		return nil, false
+	}
+
+	s.transition(record, models.PaymentStatusExpired, "not captured before "+record.Authorization.ExpiresAt.Format(time.RFC3339))
+	if err := s.savePayment(record); err != nil {
+		return nil, false
+	}
+	return record, true
+}
+
+// beginAuthorizationAction checks that the payment holds an open
+// authorization, runs prepare on it, which may turn the action down or note
+// its amount, and marks it with the pending action so a concurrent capture or
+// void is turned away.
+func (s *PaymentService) beginAuthorizationAction(correlationID, action string, prepare func(*models.PaymentRecord) error) (*models.PaymentRecord, error) {
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+
+	record, ok := s.storage.GetPaymentByCorrelationID(correlationID)
+	switch {
+	case !ok:
+		return nil, ErrPaymentNotFound
+	case record.Status != models.PaymentStatusAuthorized:
+		return nil, ErrNotAuthorized
+	case record.Authorization.PendingAction != "":
+		return nil, ErrAuthorizationBusy
+	case !time.Now().Before(record.Authorization.ExpiresAt):
+		return nil, ErrAuthorizationExpired
+	}
+	if prepare != nil {
+		if err := prepare(record); err != nil {
+			return nil, err
+		}
+	}
+
+	record.LastAttemptAt = time.Now()
+	record.UpdateAuthorization(func(auth *models.Authorization) {
+		auth.PendingAction = action
+	})
+	if err := s.savePayment(record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// finishAuthorizationAction records the processor's answer to action. Only
+// a status the processor answered with, or there being no processor to ask,
+// clears the action and turns it down; when the request timed out or broke
+// off the processor may have acted anyway, so the action stays pending for
+// retryPendingAuthorizations to resend and expiry leaves the hold alone.
+// Otherwise complete is applied to the payment. An action settled meanwhile
+// by a resend is returned as stored.
+func (s *PaymentService) finishAuthorizationAction(correlationID, action string, sendErr error, complete func(*models.PaymentRecord)) (*models.PaymentRecord, error) {
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+
+	record, ok := s.storage.GetPaymentByCorrelationID(correlationID)
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+	if record.Authorization == nil || record.Authorization.PendingAction != action {
+		if record.Status == models.PaymentStatusAuthorized {
+			return record, ErrProcessorRejected
+		}
+		return record, nil
+	}
+
+	switch {
+	case sendErr == nil:
+		record.UpdateAuthorization((*models.Authorization).ClearPending)
+		complete(record)
+	case processorDeclined(sendErr) || errors.Is(sendErr, errUnknownProcessor):
+		logrus.Errorf("Processor %s rejected %s of authorization %s: %v", record.Processor, action, correlationID, sendErr)
+		record.UpdateAuthorization((*models.Authorization).ClearPending)
+		if err := s.savePayment(record); err != nil {
+			return record, err
+		}
+		return record, fmt.Errorf("%w: %v", ErrProcessorRejected, sendErr)
+	default:
+		logrus.Warnf("Processor %s has not answered %s of authorization %s, keeping it pending: %v", record.Processor, action, correlationID, sendErr)
+		s.savePayment(record)
+		return record, fmt.Errorf("%w: %v", ErrAuthorizationPending, sendErr)
+	}
+	if err := s.savePayment(record); err != nil {
+		return record, err
+	}
+	return record, nil
+}
+
+// postAuthorizationAction sends a capture or void to the processor holding
+// the authorization, decoding its answer into out when it is not nil.
+func (s *PaymentService) postAuthorizationAction(ctx context.Context, processor, path string, payload, out any) error {
+	p, ok := s.processors.Get(processor)
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownProcessor, processor)
+	}
+	return s.postProcessor(ctx, p, path, payload, out)
+}
+
+// authorizationActionPath is the processor path of a capture or void.
+func authorizationActionPath(correlationID, action string) string {
+	return "/payments/" + url.PathEscape(correlationID) + "/" + action
+}
+
+// processorStatusError is a processor answering with a status other than
+// 200 or 201: it received the request and did not carry it out. Any other
+// error from postProcessor leaves open whether the processor acted on it.
+type processorStatusError struct {
+	StatusCode int
+}
+
+func (e *processorStatusError) Error() string {
+	return fmt.Sprintf("processor returned status %d", e.StatusCode)
+}
+
+// processorDeclined reports whether err is the processor turning a request
+// down, as opposed to an error that leaves open whether it acted on it.
+func processorDeclined(err error) bool {
+	var statusErr *processorStatusError
+	return errors.As(err, &statusErr)
+}
+
+// postProcessor posts payload as JSON to path on p and decodes the response
+// into out when it is not nil. Any status other than 200 or 201 is a
+// *processorStatusError.
+func (s *PaymentService) postProcessor(ctx context.Context, p *Processor, path string, payload, out any) error {
+	var body bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.URL+path, &body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return &processorStatusError{StatusCode: resp.StatusCode}
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *PaymentService) authorizationTTL() time.Duration {
+	if s.config.AuthorizationTTL > 0 {
+		return s.config.AuthorizationTTL
+	}
+	return defaultAuthorizationTTL
+}
@@ -0,0 +1,237 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+)
+
+// holdingProcessor records the authorization actions it receives.
+type holdingProcessor struct {
+	*httptest.Server
+	mu      sync.Mutex
+	actions []string
+}
+
+func newHoldingProcessor(t *testing.T) *holdingProcessor {
+	p := &holdingProcessor{}
+	p.Server = newFakeProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.actions = append(p.actions, r.URL.Path)
+		p.mu.Unlock()
+		w.Write([]byte(`{"id":"6f1c2f4e-3b7a-4c1d-9e8f-0a1b2c3d4e5f"}`))
+	})
+	return p
+}
+
+func (p *holdingProcessor) received() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.actions...)
+}
+
+func newAuthorizationService(processorURL string) *PaymentService {
+	return newTestService(processorURL, func(cfg *config.Config) { cfg.AuthorizationTTL = time.Hour })
+}
+
+func TestPaymentService_AuthorizeAndCapture(t *testing.T) {
+	processor := newHoldingProcessor(t)
+	service := newAuthorizationService(processor.URL)
+	ctx := context.Background()
+
+	record, err := service.AuthorizePayment(ctx, &models.PaymentRequest{CorrelationID: "auth-1", Amount: 1000})
+	if err != nil || record.Status != models.PaymentStatusAuthorized || record.Authorization.ID.String() != "6f1c2f4e-3b7a-4c1d-9e8f-0a1b2c3d4e5f" {
+		t.Fatalf("Expected an authorized payment, got %+v, %v", record, err)
+	}
+	if summary := service.GetPaymentsSummary(nil, nil); summary["default"].TotalRequests != 0 {
+		t.Errorf("Expected a hold not to count as a payment, got %+v", summary["default"])
+	}
+
+	if _, err := service.CapturePayment(ctx, "auth-1", 1500); !errors.Is(err, ErrCaptureExceedsAuthorization) {
+		t.Errorf("Expected ErrCaptureExceedsAuthorization, got %v", err)
+	}
+
+	captured, err := service.CapturePayment(ctx, "auth-1", 600)
+	if err != nil || captured.Status != models.PaymentStatusSucceeded || captured.Amount != 600 || captured.Authorization.CapturedAmount != 600 {
+		t.Fatalf("Expected a partial capture of 600, got %+v, %v", captured, err)
+	}
+	if _, err := service.CapturePayment(ctx, "auth-1", 0); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("Expected a second capture to be rejected, got %v", err)
+	}
+	if _, err := service.VoidPayment(ctx, "auth-1"); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("Expected a void after capture to be rejected, got %v", err)
+	}
+
+	if summary := service.GetPaymentsSummary(nil, nil); summary["default"].TotalRequests != 1 || summary["default"].TotalAmount != 600 {
+		t.Errorf("Expected the captured amount in the summary, got %+v", summary["default"])
+	}
+
+	want := []string{"/payments/authorize", "/payments/auth-1/capture"}
+	if got := processor.received(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Processor received %v, want %v", got, want)
+	}
+}
+
+func TestPaymentService_VoidAndExpireAuthorizations(t *testing.T) {
+	processor := newHoldingProcessor(t)
+	service := newAuthorizationService(processor.URL)
+	ctx := context.Background()
+
+	for _, id := range []string{"void-me", "expire-me"} {
+		if _, err := service.AuthorizePayment(ctx, &models.PaymentRequest{CorrelationID: id, Amount: 500}); err != nil {
+			t.Fatalf("Authorization of %s failed: %v", id, err)
+		}
+	}
+	if _, err := service.AuthorizePayment(ctx, &models.PaymentRequest{CorrelationID: "void-me", Amount: 700}); !errors.Is(err, ErrPaymentConflict) {
+		t.Errorf("Expected ErrPaymentConflict for a different amount, got %v", err)
+	}
+
+	voided, err := service.VoidPayment(ctx, "void-me")
+	if err != nil || voided.Status != models.PaymentStatusVoided {
+		t.Fatalf("Expected a voided payment, got %+v, %v", voided, err)
+	}
+
+	if expired := service.expireAuthorizations(ctx, time.Now()); expired != 0 {
+		t.Errorf("Expected nothing to expire yet, expired %d", expired)
+	}
+	if expired := service.expireAuthorizations(ctx, time.Now().Add(2*time.Hour)); expired != 1 {
+		t.Errorf("Expected one authorization to expire, expired %d", expired)
+	}
+
+	record, _ := service.GetPayment("expire-me")
+	if record.Status != models.PaymentStatusExpired {
+		t.Errorf("Expected expire-me to be expired, got %s", record.Status)
+	}
+	if _, err := service.CapturePayment(ctx, "expire-me", 0); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("Expected capture of an expired authorization to be rejected, got %v", err)
+	}
+
+	got := processor.received()
+	if len(got) != 4 || got[2] != "/payments/void-me/void" || got[3] != "/payments/expire-me/void" {
+		t.Errorf("Expected voids for both holds to reach the processor, got %v", got)
+	}
+}
+
+func TestPaymentService_AuthorizationWaitsOnUnansweredProcessor(t *testing.T) {
+	// The default places the hold but answers after the request timed out
+	var slow atomic.Bool
+	slow.Store(true)
+	slowDefault := newFakeProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		if slow.Load() {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte(`{"id":"6f1c2f4e-3b7a-4c1d-9e8f-0a1b2c3d4e5f"}`))
+	})
+	fallback := newHoldingProcessor(t)
+	service := newTestService(slowDefault.URL, func(cfg *config.Config) {
+		cfg.FallbackProcessorURL = fallback.URL
+		cfg.RequestTimeout = 100 * time.Millisecond
+		cfg.AuthorizationTTL = time.Hour
+	})
+	ctx := context.Background()
+
+	record, err := service.AuthorizePayment(ctx, &models.PaymentRequest{CorrelationID: "auth-slow", Amount: 1000})
+	if !errors.Is(err, ErrAuthorizationPending) || record.Status != models.PaymentStatusProcessing || record.Processor != "default" {
+		t.Fatalf("Expected the authorization to wait on default, got %+v, %v", record, err)
+	}
+	if got := fallback.received(); len(got) != 0 {
+		t.Errorf("Expected no hold to be placed on fallback, got %v", got)
+	}
+	if _, err := service.AuthorizePayment(ctx, &models.PaymentRequest{CorrelationID: "auth-slow", Amount: 1000}); !errors.Is(err, ErrAuthorizationPending) {
+		t.Errorf("Expected a repeated authorization to report it pending, got %v", err)
+	}
+
+	slow.Store(false)
+	if settled := service.retryPendingAuthorizations(ctx, time.Now().Add(time.Second)); settled != 1 {
+		t.Fatalf("Expected the resent authorization to settle, settled %d", settled)
+	}
+	stored, _ := service.GetPayment("auth-slow")
+	if stored.Status != models.PaymentStatusAuthorized || stored.Authorization.PendingAction != "" || stored.Authorization.ID.String() != "6f1c2f4e-3b7a-4c1d-9e8f-0a1b2c3d4e5f" {
+		t.Errorf("Expected the hold on default to be confirmed, got %+v", stored)
+	}
+}
+
+func TestPaymentService_AuthorizationMovesOnWhenDeclined(t *testing.T) {
+	decliningDefault := newFakeProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	fallback := newHoldingProcessor(t)
+	service := newTestService(decliningDefault.URL, func(cfg *config.Config) {
+		cfg.FallbackProcessorURL = fallback.URL
+		cfg.AuthorizationTTL = time.Hour
+	})
+
+	record, err := service.AuthorizePayment(context.Background(), &models.PaymentRequest{CorrelationID: "auth-declined", Amount: 1000})
+	if err != nil || record.Status != models.PaymentStatusAuthorized || record.Processor != "fallback" {
+		t.Fatalf("Expected the hold to be placed on fallback, got %+v, %v", record, err)
+	}
+}
+
+func TestPaymentService_CaptureWithoutAnswerStaysPending(t *testing.T) {
+	// The processor captures but answers the first capture too late
+	var answered atomic.Bool
+	processor := newHoldingProcessor(t)
+	slow := newFakeProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/void"):
+			w.WriteHeader(http.StatusConflict)
+			return
+		case strings.HasSuffix(r.URL.Path, "/capture") && !answered.Load():
+			time.Sleep(300 * time.Millisecond)
+		}
+		processor.Config.Handler.ServeHTTP(w, r)
+	})
+	service := newTestService(slow.URL, func(cfg *config.Config) {
+		cfg.RequestTimeout = 100 * time.Millisecond
+		cfg.AuthorizationTTL = time.Hour
+	})
+	ctx := context.Background()
+
+	for _, id := range []string{"capture-slow", "void-rejected"} {
+		if _, err := service.AuthorizePayment(ctx, &models.PaymentRequest{CorrelationID: id, Amount: 1000}); err != nil {
+			t.Fatalf("Authorization of %s failed: %v", id, err)
+		}
+	}
+
+	record, err := service.CapturePayment(ctx, "capture-slow", 600)
+	if !errors.Is(err, ErrAuthorizationPending) || record.Status != models.PaymentStatusAuthorized ||
+		record.Authorization.PendingAction != pendingCapture || record.Authorization.PendingAmount != 600 {
+		t.Fatalf("Expected the capture to stay pending, got %+v, %v", record, err)
+	}
+	if _, err := service.VoidPayment(ctx, "capture-slow"); !errors.Is(err, ErrAuthorizationBusy) {
+		t.Errorf("Expected a void during the pending capture to be turned away, got %v", err)
+	}
+
+	record, err = service.VoidPayment(ctx, "void-rejected")
+	if !errors.Is(err, ErrProcessorRejected) || record.Status != models.PaymentStatusAuthorized || record.Authorization.PendingAction != "" {
+		t.Errorf("Expected a declined void to leave the hold open, got %+v, %v", record, err)
+	}
+
+	// Expiry must not release a hold that may have been captured
+	if expired := service.expireAuthorizations(ctx, time.Now().Add(2*time.Hour)); expired != 1 {
+		t.Errorf("Expected only the open authorization to expire, expired %d", expired)
+	}
+
+	answered.Store(true)
+	if settled := service.retryPendingAuthorizations(ctx, time.Now().Add(time.Second)); settled != 1 {
+		t.Fatalf("Expected the resent capture to settle, settled %d", settled)
+	}
+	stored, _ := service.GetPayment("capture-slow")
+	if stored.Status != models.PaymentStatusSucceeded || stored.Amount != 600 || stored.Authorization.PendingAction != "" {
+		t.Errorf("Expected the resent capture to charge 600, got %+v", stored)
+	}
+	for _, path := range processor.received() {
+		if path == "/payments/capture-slow/void" {
+			t.Errorf("Expected the captured hold never to be voided, got %v", processor.received())
+		}
+	}
+}
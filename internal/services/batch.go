@@ -0,0 +1,96 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"th_payment_processor/internal/models"
+)
+
+const (
+	defaultBatchMaxSize     = 10000
+	defaultBatchConcurrency = 16
+)
+
+// ErrBatchTooLarge is returned for batches over BATCH_MAX_SIZE payments.
+var ErrBatchTooLarge = errors.New("batch exceeds the maximum size")
+
+// ProcessBatch runs every request through ProcessPayment, at most
+// BATCH_CONCURRENCY at a time, and returns one result per request in the
+// same order. Requests not yet started when ctx is cancelled are rejected;
+// the ones already in flight finish as usual.
+func (s *PaymentService) ProcessBatch(ctx context.Context, reqs []*models.PaymentRequest) ([]models.BatchItemResult, error) {
+	tracer := otel.Tracer("payment-service")
+	ctx, span := tracer.Start(ctx, "ProcessBatch")
+	defer span.End()
+
+	span.SetAttributes(attribute.Int("batch.size", len(reqs)))
+	if len(reqs) > s.MaxBatchSize() {
+		span.RecordError(ErrBatchTooLarge)
+		return nil, ErrBatchTooLarge
+	}
+
+	results := make([]models.BatchItemResult, len(reqs))
+	slots := make(chan struct{}, s.batchConcurrency())
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		results[i].Index = i
+		results[i].CorrelationID = req.CorrelationID
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			results[i].Status = models.BatchItemRejected
+			results[i].Error = err.Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *models.BatchItemResult, req *models.PaymentRequest) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			s.processBatchItem(result, req)
+		}(&results[i], req)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+func (s *PaymentService) processBatchItem(result *models.BatchItemResult, req *models.PaymentRequest) {
+	record, err := s.ProcessPayment(req)
+	if err != nil {
+		result.Error = err.Error()
+		// A failed payment stays with the retry scheduler, so report the
+		// stored copy rather than the record it keeps updating
+		if record == nil {
+			result.Status = models.BatchItemRejected
+			return
+		}
+		if stored, ok := s.storage.GetPaymentByCorrelationID(req.CorrelationID); ok {
+			record = stored
+		}
+	}
+	result.Status = string(record.Status)
+	result.Processor = record.Processor
+}
+
+// MaxBatchSize is the largest number of payments ProcessBatch accepts.
+func (s *PaymentService) MaxBatchSize() int {
+	if s.config.BatchMaxSize <= 0 {
+		return defaultBatchMaxSize
+	}
+	return s.config.BatchMaxSize
+}
+
+func (s *PaymentService) batchConcurrency() int {
+	if s.config.BatchConcurrency <= 0 {
+		return defaultBatchConcurrency
+	}
+	return s.config.BatchConcurrency
+}
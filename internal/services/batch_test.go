@@ -0,0 +1,91 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+)
+
+func TestPaymentService_ProcessBatch(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	processor := newFakeProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			peak := maxInFlight.Load()
+			if n <= peak || maxInFlight.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(`{"message":"payment processed successfully"}`))
+	})
+
+	service := newTestService(processor.URL, func(cfg *config.Config) {
+		cfg.BatchMaxSize = 20
+		cfg.BatchConcurrency = 3
+	})
+
+	if err := service.EnqueuePayment(&models.PaymentRequest{CorrelationID: "taken", Amount: 1000}); err != nil {
+		t.Fatalf("Expected payment to be queued, got %v", err)
+	}
+
+	var reqs []*models.PaymentRequest
+	for _, id := range []string{"b-1", "b-2", "b-3", "b-4", "b-5", "b-6"} {
+		reqs = append(reqs, &models.PaymentRequest{CorrelationID: id, Amount: 1000})
+	}
+	reqs = append(reqs,
+		&models.PaymentRequest{CorrelationID: "taken", Amount: 2000},
+		&models.PaymentRequest{CorrelationID: "bad-currency", Amount: 1000, Currency: "XYZ"},
+	)
+
+	results, err := service.ProcessBatch(context.Background(), reqs)
+	if err != nil {
+		t.Fatalf("ProcessBatch failed: %v", err)
+	}
+	if len(results) != len(reqs) {
+		t.Fatalf("Expected %d results, got %d", len(reqs), len(results))
+	}
+	for i, result := range results[:6] {
+		if result.Index != i || result.CorrelationID != reqs[i].CorrelationID || result.Status != string(models.PaymentStatusSucceeded) || result.Processor == "" {
+			t.Errorf("Unexpected result %d: %+v", i, result)
+		}
+	}
+	for _, result := range results[6:] {
+		if result.Status != models.BatchItemRejected || result.Error == "" {
+			t.Errorf("Expected %s to be rejected, got %+v", result.CorrelationID, result)
+		}
+	}
+	if peak := maxInFlight.Load(); peak > 3 {
+		t.Errorf("Expected at most 3 concurrent payments, saw %d", peak)
+	}
+
+	counts := models.NewBatchResponse(results).Counts
+	if counts["succeeded"] != 6 || counts[models.BatchItemRejected] != 2 {
+		t.Errorf("Unexpected counts: %v", counts)
+	}
+
+	if _, err := service.ProcessBatch(context.Background(), make([]*models.PaymentRequest, 21)); !errors.Is(err, ErrBatchTooLarge) {
+		t.Errorf("Expected ErrBatchTooLarge, got %v", err)
+	}
+}
+
+func TestPaymentService_ProcessBatchCancelled(t *testing.T) {
+	service := newTestService("http://localhost:8001")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := service.ProcessBatch(ctx, []*models.PaymentRequest{{CorrelationID: "late", Amount: 1000}})
+	if err != nil || results[0].Status != models.BatchItemRejected {
+		t.Fatalf("Expected the item to be rejected, got %+v, %v", results, err)
+	}
+	if _, ok := service.GetPayment("late"); ok {
+		t.Error("Expected no record for an item that never started")
+	}
+}
@@ -0,0 +1,265 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"th_payment_processor/internal/config"
+)
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// ErrCircuitOpen is returned when a processor call is short-circuited.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+const (
+	defaultCircuitFailureThreshold = 5
+	defaultCircuitTimeoutThreshold = 3
+	defaultCircuitErrorRate        = 0.5
+	defaultCircuitMinRequests      = 20
+	defaultCircuitWindow           = 10 * time.Second
+	defaultCircuitOpenTimeout      = 5 * time.Second
+	defaultCircuitHalfOpenRequests = 1
+)
+
+type CircuitBreakerSettings struct {
+	// Consecutive failures, or consecutive timeouts, that trip the breaker
+	FailureThreshold int
+	TimeoutThreshold int
+	// Error rate over the sliding window that trips the breaker, once the
+	// window holds at least MinRequests outcomes
+	ErrorRate   float64
+	MinRequests int
+	Window      time.Duration
+	// How long to stay open before letting probes through, and how many
+	// probes must succeed in half-open before closing again
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+}
+
+func circuitBreakerSettings(cfg *config.Config) CircuitBreakerSettings {
+	settings := CircuitBreakerSettings{
+		FailureThreshold: cfg.CircuitFailureThreshold,
+		TimeoutThreshold: cfg.CircuitTimeoutThreshold,
+		ErrorRate:        cfg.CircuitErrorRate,
+		MinRequests:      cfg.CircuitMinRequests,
+		Window:           cfg.CircuitWindow,
+		OpenTimeout:      cfg.CircuitOpenTimeout,
+		HalfOpenRequests: cfg.CircuitHalfOpenRequests,
+	}
+	if settings.FailureThreshold <= 0 {
+		settings.FailureThreshold = defaultCircuitFailureThreshold
+	}
+	if settings.TimeoutThreshold <= 0 {
+		settings.TimeoutThreshold = defaultCircuitTimeoutThreshold
+	}
+	if settings.ErrorRate <= 0 {
+		settings.ErrorRate = defaultCircuitErrorRate
+	}
+	if settings.MinRequests <= 0 {
+		settings.MinRequests = defaultCircuitMinRequests
+	}
+	if settings.Window < time.Second {
+		settings.Window = defaultCircuitWindow
+	}
+	if settings.OpenTimeout <= 0 {
+		settings.OpenTimeout = defaultCircuitOpenTimeout
+	}
+	if settings.HalfOpenRequests <= 0 {
+		settings.HalfOpenRequests = defaultCircuitHalfOpenRequests
+	}
+	return settings
+}
+
+// windowBucket counts outcomes for one second of the sliding window.
+type windowBucket struct {
+	second   int64
+	total    int
+	failures int
+}
+
+// CircuitBreaker tracks live outcomes for one processor. Closed lets every
+// call through, open rejects them until OpenTimeout passes, and half-open
+// lets a limited number of probes decide whether to close or re-open.
+type CircuitBreaker struct {
+	name     string
+	settings CircuitBreakerSettings
+	now      func() time.Time
+
+	mu                  sync.Mutex
+	state               CircuitState
+	consecutiveFailures int
+	consecutiveTimeouts int
+	buckets             []windowBucket
+	openedAt            time.Time
+	halfOpenInFlight    int
+	halfOpenSuccesses   int
+}
+
+func NewCircuitBreaker(name string, settings CircuitBreakerSettings) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:     name,
+		settings: settings,
+		now:      time.Now,
+		state:    CircuitClosed,
+		buckets:  make([]windowBucket, int(settings.Window/time.Second)),
+	}
+}
+
+// State returns the current state, moving an expired open breaker to half-open.
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.advanceLocked()
+	return cb.state
+}
+
+// Allow reports whether a call may go through. In half-open it reserves one
+// of the limited probe slots, which Record releases.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.advanceLocked()
+	switch cb.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		if cb.halfOpenInFlight >= cb.settings.HalfOpenRequests {
+			return false
+		}
+		cb.halfOpenInFlight++
+	}
+	return true
+}
+
+// Record feeds the outcome of a call allowed through by Allow.
+func (cb *CircuitBreaker) Record(success, timeout bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.recordWindowLocked(success)
+
+	if cb.state == CircuitHalfOpen {
+		if cb.halfOpenInFlight > 0 {
+			cb.halfOpenInFlight--
+		}
+		if !success {
+			cb.transitionLocked(CircuitOpen)
+			return
+		}
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.settings.HalfOpenRequests {
+			cb.transitionLocked(CircuitClosed)
+		}
+		return
+	}
+
+	if success {
+		cb.consecutiveFailures = 0
+		cb.consecutiveTimeouts = 0
+		return
+	}
+
+	cb.consecutiveFailures++
+	if timeout {
+		cb.consecutiveTimeouts++
+	} else {
+		cb.consecutiveTimeouts = 0
+	}
+
+	if cb.state == CircuitClosed && cb.shouldTripLocked() {
+		cb.transitionLocked(CircuitOpen)
+	}
+}
+
+// Release gives back a half-open probe slot without recording an outcome,
+// for calls abandoned by the caller.
+func (cb *CircuitBreaker) Release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == CircuitHalfOpen && cb.halfOpenInFlight > 0 {
+		cb.halfOpenInFlight--
+	}
+}
+
+// HealthRecovered lets a passing health check shorten the open period, so a
+// processor that reports itself healthy gets probed right away.
+func (cb *CircuitBreaker) HealthRecovered() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == CircuitOpen {
+		cb.transitionLocked(CircuitHalfOpen)
+	}
+}
+
+func (cb *CircuitBreaker) shouldTripLocked() bool {
+	if cb.consecutiveFailures >= cb.settings.FailureThreshold {
+		return true
+	}
+	if cb.consecutiveTimeouts >= cb.settings.TimeoutThreshold {
+		return true
+	}
+
+	total, failures := cb.windowCountsLocked()
+	return total >= cb.settings.MinRequests &&
+		float64(failures)/float64(total) >= cb.settings.ErrorRate
+}
+
+func (cb *CircuitBreaker) advanceLocked() {
+	if cb.state == CircuitOpen && cb.now().Sub(cb.openedAt) >= cb.settings.OpenTimeout {
+		cb.transitionLocked(CircuitHalfOpen)
+	}
+}
+
+func (cb *CircuitBreaker) transitionLocked(state CircuitState) {
+	if cb.state == state {
+		return
+	}
+	logrus.Warnf("Circuit breaker for %s processor: %s -> %s", cb.name, cb.state, state)
+
+	cb.state = state
+	cb.halfOpenInFlight = 0
+	cb.halfOpenSuccesses = 0
+	switch state {
+	case CircuitOpen:
+		cb.openedAt = cb.now()
+	case CircuitClosed:
+		cb.consecutiveFailures = 0
+		cb.consecutiveTimeouts = 0
+		for i := range cb.buckets {
+			cb.buckets[i] = windowBucket{}
+		}
+	}
+}
+
+func (cb *CircuitBreaker) recordWindowLocked(success bool) {
+	second := cb.now().Unix()
+	bucket := &cb.buckets[second%int64(len(cb.buckets))]
+	if bucket.second != second {
+		*bucket = windowBucket{second: second}
+	}
+	bucket.total++
+	if !success {
+		bucket.failures++
+	}
+}
+
+func (cb *CircuitBreaker) windowCountsLocked() (total, failures int) {
+	oldest := cb.now().Unix() - int64(len(cb.buckets)) + 1
+	for _, bucket := range cb.buckets {
+		if bucket.second >= oldest {
+			total += bucket.total
+			failures += bucket.failures
+		}
+	}
+	return total, failures
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestBreaker(settings CircuitBreakerSettings) (*CircuitBreaker, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2025, 7, 10, 12, 0, 0, 0, time.UTC)}
+	cb := NewCircuitBreaker("test", settings)
+	cb.now = clock.now
+	return cb, clock
+}
+
+func testBreakerSettings() CircuitBreakerSettings {
+	return CircuitBreakerSettings{
+		FailureThreshold: 3,
+		TimeoutThreshold: 2,
+		ErrorRate:        0.5,
+		MinRequests:      10,
+		Window:           10 * time.Second,
+		OpenTimeout:      5 * time.Second,
+		HalfOpenRequests: 1,
+	}
+}
+
+func TestCircuitBreaker_OpensOnConsecutiveFailures(t *testing.T) {
+	cb, clock := newTestBreaker(testBreakerSettings())
+
+	for i := 0; i < 3; i++ {
+		if !cb.Allow() {
+			t.Fatalf("Expected call %d to be allowed", i)
+		}
+		cb.Record(false, false)
+	}
+
+	if cb.State() != CircuitOpen || cb.Allow() {
+		t.Fatal("Expected breaker to open and reject calls")
+	}
+
+	// After the open timeout a single probe goes through
+	clock.advance(5 * time.Second)
+	if !cb.Allow() {
+		t.Fatal("Expected half-open probe to be allowed")
+	}
+	if cb.Allow() {
+		t.Error("Expected only one concurrent half-open probe")
+	}
+
+	cb.Record(true, false)
+	if cb.State() != CircuitClosed {
+		t.Errorf("Expected successful probe to close the breaker, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreaker_FailedProbeReopens(t *testing.T) {
+	cb, clock := newTestBreaker(testBreakerSettings())
+	for i := 0; i < 3; i++ {
+		cb.Record(false, false)
+	}
+
+	clock.advance(5 * time.Second)
+	cb.Allow()
+	cb.Record(false, false)
+
+	if cb.State() != CircuitOpen {
+		t.Errorf("Expected failed probe to re-open the breaker, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreaker_OpensOnTimeouts(t *testing.T) {
+	cb, _ := newTestBreaker(testBreakerSettings())
+
+	cb.Record(false, true)
+	cb.Record(false, true)
+
+	if cb.State() != CircuitOpen {
+		t.Errorf("Expected consecutive timeouts to open the breaker, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreaker_OpensOnErrorRate(t *testing.T) {
+	cb, clock := newTestBreaker(testBreakerSettings())
+
+	// Alternating outcomes never hit the consecutive threshold
+	for i := 0; i < 10; i++ {
+		cb.Record(i%2 == 0, false)
+		clock.advance(100 * time.Millisecond)
+	}
+
+	if cb.State() != CircuitOpen {
+		t.Errorf("Expected 50%% error rate to open the breaker, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreaker_WindowForgetsOldOutcomes(t *testing.T) {
+	cb, clock := newTestBreaker(testBreakerSettings())
+
+	for i := 0; i < 8; i++ {
+		cb.Record(i%2 == 0, false)
+	}
+	clock.advance(11 * time.Second)
+	for i := 0; i < 4; i++ {
+		cb.Record(i%2 == 0, false)
+	}
+
+	if cb.State() != CircuitClosed {
+		t.Errorf("Expected old outcomes to fall out of the window, got %s", cb.State())
+	}
+}
+
+func TestCircuitBreaker_HealthRecoveredProbesEarly(t *testing.T) {
+	cb, _ := newTestBreaker(testBreakerSettings())
+	for i := 0; i < 3; i++ {
+		cb.Record(false, false)
+	}
+
+	cb.HealthRecovered()
+	if cb.State() != CircuitHalfOpen {
+		t.Errorf("Expected passing health check to move breaker to half-open, got %s", cb.State())
+	}
+}
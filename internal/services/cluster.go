@@ -0,0 +1,163 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"th_payment_processor/internal/models"
+)
+
+const defaultPeerTimeout = 2 * time.Second
+
+// PeerUnavailableError is returned by GetClusterPaymentsSummary and
+// GetClusterPaymentsSeries when one or more peers could not be queried.
+// Summary, or Series for a series, still holds the merged totals of every
+// instance that did answer.
+type PeerUnavailableError struct {
+	Summary models.PaymentSummary
+	Series  []models.SummaryPoint
+	Peers   []string
+}
+
+func (e *PeerUnavailableError) Error() string {
+	return fmt.Sprintf("peers unavailable: %s", strings.Join(e.Peers, ", "))
+}
+
+// GetClusterPaymentsSummary merges the local summary with the local-only
+// summaries of every configured peer.
+func (s *PaymentService) GetClusterPaymentsSummary(ctx context.Context, from, to *time.Time) (models.PaymentSummary, error) {
+	ctx, span := otel.Tracer("payment-service").Start(ctx, "GetClusterPaymentsSummary")
+	defer span.End()
+
+	summary := s.GetPaymentsSummary(from, to)
+	span.SetAttributes(attribute.Int("cluster.peers", len(s.config.PeerURLs)))
+
+	unavailable := queryPeers(ctx, s, peerQuery(from, to), func(peerSummary models.PaymentSummary) {
+		summary = mergeSummaries(summary, peerSummary)
+	})
+	if len(unavailable) > 0 {
+		span.SetAttributes(attribute.StringSlice("cluster.peers.unavailable", unavailable))
+		return summary, &PeerUnavailableError{Summary: summary, Peers: unavailable}
+	}
+	return summary, nil
+}
+
+// GetClusterPaymentsSeries merges the local series with the local-only
+// series of every configured peer, interval by interval.
+func (s *PaymentService) GetClusterPaymentsSeries(ctx context.Context, from, to *time.Time, interval time.Duration) ([]models.SummaryPoint, error) {
+	ctx, span := otel.Tracer("payment-service").Start(ctx, "GetClusterPaymentsSeries")
+	defer span.End()
+
+	points, err := s.GetPaymentsSeries(from, to, interval)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("cluster.peers", len(s.config.PeerURLs)))
+
+	query := peerQuery(from, to)
+	query.Set("interval", interval.String())
+	unavailable := queryPeers(ctx, s, query, func(peerSeries models.SummarySeries) {
+		points = models.MergeSeries(points, peerSeries.Points)
+	})
+	if len(unavailable) > 0 {
+		span.SetAttributes(attribute.StringSlice("cluster.peers.unavailable", unavailable))
+		return points, &PeerUnavailableError{Series: points, Peers: unavailable}
+	}
+	return points, nil
+}
+
+// queryPeers asks every peer for its /payments-summary with query and hands
+// each answer to merge, one at a time. It returns the peers that failed.
+func queryPeers[T any](ctx context.Context, s *PaymentService, query url.Values, merge func(T)) []string {
+	if len(s.config.PeerURLs) == 0 {
+		return nil
+	}
+
+	type peerResult struct {
+		peer   string
+		answer T
+		err    error
+	}
+
+	results := make(chan peerResult, len(s.config.PeerURLs))
+	var wg sync.WaitGroup
+	for _, peer := range s.config.PeerURLs {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			var answer T
+			err := s.fetchPeerSummary(ctx, peer, query, &answer)
+			results <- peerResult{peer: peer, answer: answer, err: err}
+		}(peer)
+	}
+	wg.Wait()
+	close(results)
+
+	var unavailable []string
+	for result := range results {
+		if result.err != nil {
+			logrus.Errorf("Failed to fetch payments summary from peer %s: %v", result.peer, result.err)
+			unavailable = append(unavailable, result.peer)
+			continue
+		}
+		merge(result.answer)
+	}
+	return unavailable
+}
+
+// peerQuery asks for a peer's own totals only, so the fan-out never recurses.
+func peerQuery(from, to *time.Time) url.Values {
+	query := url.Values{}
+	query.Set("local", "true")
+	if from != nil {
+		query.Set("from", from.Format(time.RFC3339Nano))
+	}
+	if to != nil {
+		query.Set("to", to.Format(time.RFC3339Nano))
+	}
+	return query
+}
+
+func (s *PaymentService) fetchPeerSummary(ctx context.Context, peer string, query url.Values, answer any) error {
+	timeout := s.config.PeerTimeout
+	if timeout <= 0 {
+		timeout = defaultPeerTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(peer, "/")+"/payments-summary?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer returned status %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(answer); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// mergeSummaries adds the per-processor totals of b into a.
+func mergeSummaries(a, b models.PaymentSummary) models.PaymentSummary {
+	a.Merge(b)
+	return a
+}
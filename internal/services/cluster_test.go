@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+	"th_payment_processor/internal/storage"
+)
+
+func TestPaymentService_GetClusterPaymentsSummary(t *testing.T) {
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("local") != "true" {
+			t.Errorf("Expected peer to be queried with local=true, got %q", r.URL.RawQuery)
+		}
+		w.Write([]byte(`{"default":{"totalRequests":2,"totalAmount":30},"fallback":{"totalRequests":1,"totalAmount":5}}`))
+	}))
+	defer peer.Close()
+
+	store := storage.NewInMemoryStorage()
+	store.StorePayment(&models.PaymentRecord{CorrelationID: "local-1", Amount: 1000, Processor: "default", Success: true, ProcessedAt: time.Now()})
+
+	cfg := &config.Config{PeerURLs: []string{peer.URL}}
+	service := NewPaymentService(cfg, store)
+
+	summary, err := service.GetClusterPaymentsSummary(context.Background(), nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if summary["default"].TotalRequests != 3 || summary["default"].TotalAmount != 4000 {
+		t.Errorf("Unexpected merged default summary: %+v", summary["default"])
+	}
+	if summary["fallback"].TotalRequests != 1 || summary["fallback"].TotalAmount != 500 {
+		t.Errorf("Unexpected merged fallback summary: %+v", summary["fallback"])
+	}
+}
+
+func TestPaymentService_GetClusterPaymentsSummary_PeerUnavailable(t *testing.T) {
+	peer := httptest.NewServer(http.NotFoundHandler())
+	peer.Close()
+
+	store := storage.NewInMemoryStorage()
+	store.StorePayment(&models.PaymentRecord{CorrelationID: "local-1", Amount: 1000, Processor: "default", Success: true, ProcessedAt: time.Now()})
+
+	cfg := &config.Config{PeerURLs: []string{peer.URL}, PeerTimeout: 500 * time.Millisecond}
+	service := NewPaymentService(cfg, store)
+
+	_, err := service.GetClusterPaymentsSummary(context.Background(), nil, nil)
+
+	var peerErr *PeerUnavailableError
+	if !errors.As(err, &peerErr) {
+		t.Fatalf("Expected PeerUnavailableError, got %v", err)
+	}
+	if len(peerErr.Peers) != 1 || peerErr.Peers[0] != peer.URL {
+		t.Errorf("Unexpected unavailable peers: %v", peerErr.Peers)
+	}
+	if peerErr.Summary["default"].TotalRequests != 1 {
+		t.Errorf("Expected partial summary to keep local totals, got %+v", peerErr.Summary)
+	}
+}
+
+func TestPaymentService_GetClusterPaymentsSeries(t *testing.T) {
+	base := time.Now().UTC().Truncate(time.Hour)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("local") != "true" || r.URL.Query().Get("interval") != "1m0s" {
+			t.Errorf("Expected a local series query, got %q", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode(models.SummarySeries{Interval: "1m0s", Points: []models.SummaryPoint{
+			{Start: base, Processors: models.PaymentSummary{"fallback": {TotalRequests: 1, TotalAmount: 500}}, FailedPayments: 2},
+			{Start: base.Add(time.Minute), Processors: models.PaymentSummary{"default": {TotalRequests: 1, TotalAmount: 100}}},
+		}})
+	}))
+	defer peer.Close()
+
+	store := storage.NewInMemoryStorage()
+	store.StorePayment(&models.PaymentRecord{CorrelationID: "local-1", Amount: 1000, Processor: "default", Success: true, ProcessedAt: base.Add(10 * time.Second)})
+
+	cfg := &config.Config{PeerURLs: []string{peer.URL}}
+	service := NewPaymentService(cfg, store)
+
+	from, to := base, base.Add(2*time.Minute-time.Nanosecond)
+	points, err := service.GetClusterPaymentsSeries(context.Background(), &from, &to, time.Minute)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("Expected 2 points, got %+v", points)
+	}
+	first := points[0]
+	if first.Processors["default"].TotalAmount != 1000 || first.Processors["fallback"].TotalAmount != 500 || first.FailedPayments != 2 {
+		t.Errorf("Unexpected merged first point: %+v", first)
+	}
+	if points[1].Processors["default"].TotalRequests != 1 {
+		t.Errorf("Unexpected merged second point: %+v", points[1])
+	}
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"th_payment_processor/internal/models"
+)
+
+const defaultEventBufferSize = 256
+
+// Subscription receives the events matching its filter until it is
+// unsubscribed, or dropped for falling behind. Either way Events is closed.
+type Subscription struct {
+	filter  models.EventFilter
+	events  chan models.Event
+	dropped atomic.Bool
+}
+
+func (s *Subscription) Events() <-chan models.Event {
+	return s.events
+}
+
+// Dropped reports whether the subscription was closed because its buffer
+// filled up.
+func (s *Subscription) Dropped() bool {
+	return s.dropped.Load()
+}
+
+// EventBroker fans events out to subscribers. Publishing never blocks: a
+// subscriber whose buffer is full is dropped rather than slowing payments.
+type EventBroker struct {
+	bufferSize int
+
+	mu          sync.Mutex
+	nextID      uint64
+	subscribers map[*Subscription]struct{}
+}
+
+func NewEventBroker(bufferSize int) *EventBroker {
+	if bufferSize <= 0 {
+		bufferSize = defaultEventBufferSize
+	}
+	return &EventBroker{
+		bufferSize:  bufferSize,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+func (b *EventBroker) Subscribe(filter models.EventFilter) *Subscription {
+	sub := &Subscription{
+		filter: filter,
+		events: make(chan models.Event, b.bufferSize),
+	}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+func (b *EventBroker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeLocked(sub)
+}
+
+// Publish stamps event with an ID and time and hands it to every matching
+// subscriber. The payment, if any, is copied so later changes to the record
+// do not show up in the event.
+func (b *EventBroker) Publish(event models.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.subscribers) == 0 {
+		return
+	}
+
+	b.nextID++
+	event.ID = b.nextID
+	event.At = time.Now()
+	if event.Payment != nil {
+		copied := *event.Payment
+		event.Payment = &copied
+	}
+
+	for sub := range b.subscribers {
+		if !sub.filter.Matches(&event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			logrus.Warnf("Dropping event subscriber: %d events behind", b.bufferSize)
+			sub.dropped.Store(true)
+			b.removeLocked(sub)
+		}
+	}
+}
+
+func (b *EventBroker) removeLocked(sub *Subscription) {
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
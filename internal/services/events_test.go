@@ -0,0 +1,84 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/models"
+)
+
+func TestEventBroker_Filters(t *testing.T) {
+	broker := NewEventBroker(8)
+	all := broker.Subscribe(models.EventFilter{})
+	payments := broker.Subscribe(models.EventFilter{Types: []string{"payment"}})
+	fallbackHealth := broker.Subscribe(models.EventFilter{Processors: []string{"fallback"}, Types: []string{models.EventProcessorHealth}})
+
+	record := models.NewPaymentRecord("evt", 1000, time.Now())
+	record.Processor = "fallback"
+	broker.Publish(models.Event{Type: "payment.succeeded", Processor: "fallback", Payment: record})
+	broker.Publish(models.Event{Type: models.EventProcessorHealth, Processor: "default"})
+	broker.Publish(models.Event{Type: models.EventProcessorHealth, Processor: "fallback"})
+	record.Amount = 1
+
+	if got := len(all.Events()); got != 3 {
+		t.Errorf("Expected 3 events without a filter, got %d", got)
+	}
+	if got := len(payments.Events()); got != 1 {
+		t.Errorf("Expected 1 payment event, got %d", got)
+	}
+	if event := <-payments.Events(); event.ID != 1 || event.Payment.Amount != 1000 {
+		t.Errorf("Expected the first event with a copy of the payment, got %+v", event)
+	}
+	if event := <-fallbackHealth.Events(); len(fallbackHealth.Events()) != 0 || event.Processor != "fallback" || event.ID != 3 {
+		t.Errorf("Unexpected filtered health event: %+v", event)
+	}
+
+	broker.Unsubscribe(all)
+	if all.Dropped() {
+		t.Error("Expected an unsubscribed subscription not to be marked dropped")
+	}
+}
+
+func TestEventBroker_DropsSlowSubscriber(t *testing.T) {
+	broker := NewEventBroker(2)
+	slow := broker.Subscribe(models.EventFilter{})
+
+	for i := 0; i < 3; i++ {
+		broker.Publish(models.Event{Type: models.EventProcessorHealth})
+	}
+
+	if !slow.Dropped() {
+		t.Fatal("Expected the slow subscriber to be dropped")
+	}
+	received := 0
+	for range slow.Events() {
+		received++
+	}
+	if received != 2 {
+		t.Errorf("Expected the buffered events before the drop, got %d", received)
+	}
+	// Unsubscribing after a drop must not close the channel twice
+	broker.Unsubscribe(slow)
+}
+
+func TestPaymentService_PublishesEvents(t *testing.T) {
+	service := newTestService("http://localhost:8001")
+	sub := service.Events().Subscribe(models.EventFilter{})
+
+	service.updateProcessorHealth("default", true, 10, false)
+	service.updateProcessorHealth("default", false, 0, true)
+
+	record := models.NewPaymentRecord("evt", 1000, time.Now())
+	service.transition(record, models.PaymentStatusProcessing, "")
+	service.transition(record, models.PaymentStatusFailed, "gave up")
+
+	var types []string
+	for len(sub.Events()) > 0 {
+		event := <-sub.Events()
+		types = append(types, event.Type)
+	}
+	// Unchanged health and in-progress payments are not announced
+	if len(types) != 2 || types[0] != models.EventProcessorHealth || types[1] != "payment.failed" {
+		t.Errorf("Unexpected events: %v", types)
+	}
+}
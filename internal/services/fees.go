@@ -0,0 +1,67 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"th_payment_processor/internal/models"
+)
+
+const defaultFeeRefreshInterval = 5 * time.Minute
+
+// StartFeeDiscovery learns every processor's fee rate from its admin summary
+// now and every FEE_REFRESH_INTERVAL until ctx is cancelled. A processor
+// that cannot be asked keeps the rate it had, at first the configured one.
+func (s *PaymentService) StartFeeDiscovery(ctx context.Context) {
+	if !s.config.FeeDiscoveryEnabled {
+		return
+	}
+	s.refreshFees(ctx)
+
+	ticker := time.NewTicker(s.feeRefreshInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshFees(ctx)
+		}
+	}
+}
+
+func (s *PaymentService) refreshFees(ctx context.Context) {
+	// Only the rate is wanted, so ask for an empty window
+	now := time.Now()
+	for _, p := range s.processors.All() {
+		if _, err := s.fetchProcessorSummary(ctx, p, now, now); err != nil {
+			logrus.Warnf("Could not learn the fee rate of processor %s, keeping %.2f%%: %v", p.Name, p.Fee(), err)
+		}
+	}
+}
+
+// applyFee records what record cost on record.Processor: the fee the
+// processor reported, or else its fee rate applied to the amount. Either is
+// rounded to the minor unit of the payment's currency.
+func (s *PaymentService) applyFee(record *models.PaymentRecord, reported *float64) {
+	currency := record.Currency.OrDefault()
+	if reported != nil {
+		record.SetFee(currency.MoneyFromFloat(*reported))
+		return
+	}
+
+	rate := 0.0
+	if p, ok := s.processors.Get(record.Processor); ok {
+		rate = p.Fee()
+	}
+	record.SetFee(models.FeeFor(record.Amount, rate, currency))
+}
+
+func (s *PaymentService) feeRefreshInterval() time.Duration {
+	if s.config.FeeRefreshInterval > 0 {
+		return s.config.FeeRefreshInterval
+	}
+	return defaultFeeRefreshInterval
+}
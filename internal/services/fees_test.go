@@ -0,0 +1,115 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+	"th_payment_processor/internal/storage"
+)
+
+// newFeeProcessor charges payments, reporting the fee only for the
+// correlation ID "reported" and for captures, and answers its admin summary
+// with a 2.5% rate.
+func newFeeProcessor() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/capture"):
+			w.Write([]byte(`{"amount":10,"fee":0.42}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/payments/authorize":
+			w.Write([]byte(`{"id":"6f1c2f4e-3b7a-4c1d-9e8f-0a1b2c3d4e5f"}`))
+		case "/payments":
+			var req models.PaymentProcessorRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.CorrelationID == "reported" {
+				w.Write([]byte(`{"message":"payment processed successfully","fee":0.125}`))
+				return
+			}
+			w.Write([]byte(`{"message":"payment processed successfully"}`))
+		case "/admin/payments-summary":
+			w.Write([]byte(`{"totalRequests":0,"totalAmount":0,"totalFee":0,"feePerTransaction":2.5}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestPaymentService_Fees(t *testing.T) {
+	processor := newFeeProcessor()
+	defer processor.Close()
+	locked := newSummaryProcessor(t, "other", `{}`)
+	defer locked.Close()
+
+	cfg := &config.Config{
+		RequestTimeout:      time.Second,
+		ProcessorAdminToken: "123",
+		Processors: []config.ProcessorConfig{
+			{Name: "default", URL: processor.URL, Priority: 1, FeePercentage: 1},
+			{Name: "fallback", URL: locked.URL, Priority: 2, FeePercentage: 5},
+		},
+	}
+	service := NewPaymentService(cfg, storage.NewInMemoryStorage())
+
+	defaultProcessor, _ := service.processors.Get("default")
+	fallbackProcessor, _ := service.processors.Get("fallback")
+	if defaultProcessor.Fee() != 1 {
+		t.Fatalf("Expected the configured fee before discovery, got %v", defaultProcessor.Fee())
+	}
+	service.refreshFees(context.Background())
+	if defaultProcessor.Fee() != 2.5 || fallbackProcessor.Fee() != 5 {
+		t.Errorf("Expected default to report 2.5%% and fallback to keep 5%%, got %v and %v", defaultProcessor.Fee(), fallbackProcessor.Fee())
+	}
+
+	record, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "computed", Amount: 1000})
+	if err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if record.Fee != 25 || record.NetAmount != 975 {
+		t.Errorf("Expected a 0.25 fee from the learned rate, got fee %s net %s", record.Fee, record.NetAmount)
+	}
+
+	// A fee the processor reports wins over the rate
+	record, err = service.ProcessPayment(&models.PaymentRequest{CorrelationID: "reported", Amount: 1000})
+	if err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if record.Fee != 13 || record.NetAmount != 987 {
+		t.Errorf("Expected the reported fee rounded to 0.13, got fee %s net %s", record.Fee, record.NetAmount)
+	}
+
+	// Fees round to the currency's minor unit: 2.5% of 1990 yen is 50 yen
+	record, err = service.ProcessPayment(&models.PaymentRequest{CorrelationID: "yen", Amount: 199000, Currency: "JPY"})
+	if err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if record.Fee != 5000 || record.NetAmount != 194000 {
+		t.Errorf("Expected a whole-yen fee of 50, got fee %s net %s", record.Fee, record.NetAmount)
+	}
+
+	// A capture takes the fee the processor reports for it
+	ctx := context.Background()
+	if _, err := service.AuthorizePayment(ctx, &models.PaymentRequest{CorrelationID: "held", Amount: 1000}); err != nil {
+		t.Fatalf("AuthorizePayment failed: %v", err)
+	}
+	record, err = service.CapturePayment(ctx, "held", 0)
+	if err != nil {
+		t.Fatalf("CapturePayment failed: %v", err)
+	}
+	if record.Fee != 42 || record.NetAmount != 958 {
+		t.Errorf("Expected the reported capture fee of 0.42, got fee %s net %s", record.Fee, record.NetAmount)
+	}
+
+	summary := service.GetPaymentsSummary(nil, nil)["default"].Currencies["BRL"]
+	if summary.TotalAmount != 3000 || summary.TotalFee != 80 || summary.TotalNetAmount != 2920 {
+		t.Errorf("Unexpected fee totals: %+v", summary)
+	}
+}
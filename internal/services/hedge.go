@@ -0,0 +1,357 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"th_payment_processor/internal/models"
+)
+
+const (
+	defaultHedgeDelayMultiplier = 2.0
+	defaultHedgeMinDelay        = 50 * time.Millisecond
+	defaultHedgeMaxDelay        = 1 * time.Second
+	// Losing requests that can wait for a recheck at once
+	hedgeRecheckBuffer = 1024
+)
+
+type hedgeResult struct {
+	processor string
+	record    models.PaymentRecord
+	err       error
+}
+
+// hedgedAttempt sends the payment to primary and, if it has not answered
+// within the hedge delay (or fails outright), to secondary as well. The
+// first success wins and the other request is cancelled. Every losing
+// request, cancelled or failed, is then checked against its processor so a
+// payment charged by both is still counted once and the duplicate is
+// recorded.
+func (s *PaymentService) hedgedAttempt(ctx context.Context, req *models.PaymentRequest, record *models.PaymentRecord, primary, secondary string) error {
+	span := trace.SpanFromContext(ctx)
+
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan hedgeResult, 2)
+	launch := func(processor string) {
+		logrus.Infof("Trying %s processor for payment: %s", processor, req.CorrelationID)
+		go func() {
+			attempt := *record
+			err := s.processWithProcessor(hedgeCtx, req, &attempt, processor)
+			results <- hedgeResult{processor: processor, record: attempt, err: err}
+		}()
+	}
+
+	delay := s.hedgeDelay(primary)
+	span.SetAttributes(attribute.Int64("payment.hedge.delay_ms", delay.Milliseconds()))
+
+	launch(primary)
+	inFlight := 1
+	secondaryLaunched := false
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var winner *hedgeResult
+	var failed []hedgeResult
+	for inFlight > 0 && winner == nil {
+		select {
+		case <-timer.C:
+			if !secondaryLaunched {
+				logrus.Infof("Hedging payment %s to %s processor after %s", req.CorrelationID, secondary, delay)
+				span.SetAttributes(attribute.Bool("payment.hedge.fired", true))
+				launch(secondary)
+				inFlight++
+				secondaryLaunched = true
+			}
+		case result := <-results:
+			inFlight--
+			if result.err == nil {
+				winner = &result
+				continue
+			}
+			logrus.Errorf("%s processor failed for payment %s: %v", result.processor, req.CorrelationID, result.err)
+			failed = append(failed, result)
+			span.SetAttributes(attribute.String("payment.processor."+result.processor+".error", result.err.Error()))
+			if !secondaryLaunched {
+				launch(secondary)
+				inFlight++
+				secondaryLaunched = true
+			}
+		}
+	}
+
+	if winner == nil {
+		return fmt.Errorf("hedged processors %s and %s both failed", primary, secondary)
+	}
+
+	cancel()
+	*record = winner.record
+	logrus.Infof("Payment processed successfully with %s processor: %s", winner.processor, req.CorrelationID)
+	span.SetAttributes(attribute.String("payment.processor.used", winner.processor))
+
+	// Settle the other request before the record is counted
+	if inFlight > 0 {
+		failed = append(failed, <-results)
+	}
+	for _, loser := range failed {
+		s.reconcileHedgeLoser(ctx, record, loser)
+	}
+	return nil
+}
+
+// reconcileHedgeLoser works out whether the losing request was charged
+// anyway, either because it completed or because the processor had taken it
+// before it was cancelled, timed out or lost its answer, and refunds a
+// duplicate charge on the loser. Only a processor declining the payment, or
+// a request never sent, rules a charge out. A request the processor does not
+// know about, or could not be asked about, may still land, so it is looked
+// up again once its timeout has passed.
+func (s *PaymentService) reconcileHedgeLoser(ctx context.Context, record *models.PaymentRecord, loser hedgeResult) {
+	span := trace.SpanFromContext(ctx)
+
+	charged := loser.err == nil
+	if !charged && !hedgeLoserDeclined(loser.err) {
+		found, err := s.lookupProcessorPayment(ctx, loser.processor, record.CorrelationID)
+		if err != nil {
+			logrus.Warnf("Could not verify yet whether %s processor charged hedged payment %s: %v",
+				loser.processor, record.CorrelationID, err)
+			span.SetAttributes(attribute.String("payment.hedge.unverified", loser.processor))
+		}
+		if found == nil {
+			s.recheckHedgeLoser(record.CorrelationID, loser.processor)
+			return
+		}
+		charged = true
+	}
+
+	if charged {
+		logrus.Errorf("Hedged payment %s was also charged by %s processor; counted once under %s, refunding the duplicate",
+			record.CorrelationID, loser.processor, record.Processor)
+		span.SetAttributes(attribute.String("payment.hedge.duplicate", loser.processor))
+		s.refundDuplicateCharge(ctx, record, loser.processor)
+	}
+}
+
+// hedgeLoserDeclined reports whether err means the losing processor did not
+// charge the payment: it answered with an error status, or the request was
+// never sent.
+func hedgeLoserDeclined(err error) bool {
+	var statusErr *processorStatusError
+	return errors.As(err, &statusErr) || errors.Is(err, ErrCircuitOpen)
+}
+
+// refundDuplicateCharge refunds the charge processor made for record, which
+// is not stored yet, and keeps the refund on the record. A refund without an
+// answer stays pending for StartRefundRetries.
+func (s *PaymentService) refundDuplicateCharge(ctx context.Context, record *models.PaymentRecord, processor string) {
+	record.DuplicateProcessor = processor
+	refund := newDuplicateRefund(record, processor)
+
+	sendErr := s.sendRefund(context.WithoutCancel(ctx), record.CorrelationID, &refund)
+	switch {
+	case !settleRefund(&refund, sendErr):
+		logrus.Warnf("Refund of the duplicate charge of payment %s on %s has no answer yet, keeping it pending: %v",
+			record.CorrelationID, processor, sendErr)
+	case refund.Status == models.RefundStatusFailed:
+		logrus.Errorf("Could not refund the duplicate charge of payment %s on %s: %v", record.CorrelationID, processor, sendErr)
+	}
+	record.SetRefund(refund)
+}
+
+// hedgeRecheck is a losing hedged request to look up again at processor
+// once due.
+type hedgeRecheck struct {
+	correlationID string
+	processor     string
+	due           time.Time
+}
+
+// recheckHedgeLoser queues another lookup of the payment at processor for
+// StartHedgeRechecks, once the losing request has had its timeout to land.
+func (s *PaymentService) recheckHedgeLoser(correlationID, processor string) {
+	p, ok := s.processors.Get(processor)
+	if !ok {
+		return
+	}
+	select {
+	case s.hedgeRechecks <- hedgeRecheck{correlationID: correlationID, processor: processor, due: time.Now().Add(p.Timeout)}:
+	default:
+		logrus.Errorf("Too many hedged payments waiting for a recheck, not rechecking %s on %s processor", correlationID, processor)
+	}
+}
+
+// StartHedgeRechecks looks up losing hedged requests again as they come due
+// until ctx is cancelled. Rechecks still waiting then are run at once, and
+// it returns when they have finished, so call it with a context that
+// outlives the payment workers.
+func (s *PaymentService) StartHedgeRechecks(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	run := func(recheck hedgeRecheck) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runHedgeRecheck(ctx, recheck)
+		}()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case recheck := <-s.hedgeRechecks:
+					run(recheck)
+				default:
+					return
+				}
+			}
+		case recheck := <-s.hedgeRechecks:
+			run(recheck)
+		}
+	}
+}
+
+// runHedgeRecheck waits until recheck is due, or ctx is cancelled, then
+// refunds the payment at its processor if it was charged there after all.
+func (s *PaymentService) runHedgeRecheck(ctx context.Context, recheck hedgeRecheck) {
+	p, ok := s.processors.Get(recheck.processor)
+	if !ok {
+		return
+	}
+	timer := time.NewTimer(time.Until(recheck.due))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		logrus.Infof("Rechecking hedged payment %s on %s processor early for shutdown", recheck.correlationID, recheck.processor)
+	}
+
+	lookupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), p.Timeout)
+	defer cancel()
+
+	found, err := s.lookupProcessorPayment(lookupCtx, recheck.processor, recheck.correlationID)
+	switch {
+	case err != nil:
+		logrus.Errorf("Could not verify whether %s processor charged hedged payment %s: %v", recheck.processor, recheck.correlationID, err)
+		return
+	case found == nil:
+		return
+	}
+
+	refund, ok := s.recordDuplicateCharge(recheck.correlationID, recheck.processor)
+	if !ok {
+		return
+	}
+	logrus.Errorf("Hedged payment %s was charged late by %s processor, refunding the duplicate", recheck.correlationID, recheck.processor)
+	s.finishRefund(recheck.correlationID, refund, s.sendRefund(lookupCtx, recheck.correlationID, refund))
+}
+
+// recordDuplicateCharge flags the stored payment as also charged by
+// processor and stores a pending refund of the duplicate, unless the
+// payment is not charged elsewhere or the duplicate is already known.
+func (s *PaymentService) recordDuplicateCharge(correlationID, processor string) (*models.Refund, bool) {
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+
+	record, ok := s.storage.GetPaymentByCorrelationID(correlationID)
+	if !ok || !record.Status.IsCharged() || record.Processor == processor || record.DuplicateProcessor != "" {
+		return nil, false
+	}
+	record.DuplicateProcessor = processor
+	refund := newDuplicateRefund(record, processor)
+	record.SetRefund(refund)
+	if s.savePayment(record) != nil {
+		return nil, false
+	}
+	return &refund, true
+}
+
+func newDuplicateRefund(record *models.PaymentRecord, processor string) models.Refund {
+	return models.Refund{
+		ID:          uuid.New(),
+		Amount:      record.Amount,
+		Processor:   processor,
+		Status:      models.RefundStatusPending,
+		RequestedAt: time.Now(),
+		Duplicate:   true,
+	}
+}
+
+// lookupProcessorPayment asks a processor for the payment with the given
+// correlation ID, returning nil when it holds none.
+func (s *PaymentService) lookupProcessorPayment(ctx context.Context, processor, correlationID string) (*processorPayment, error) {
+	p, ok := s.processors.Get(processor)
+	if !ok {
+		return nil, fmt.Errorf("unknown processor: %s", processor)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", p.URL+"/payments/"+url.PathEscape(correlationID), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("processor returned status %d", resp.StatusCode)
+	}
+
+	var payment processorPayment
+	if err := json.NewDecoder(resp.Body).Decode(&payment); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &payment, nil
+}
+
+// hedgeDelay derives how long to wait on processor before hedging from its
+// observed latency, clamped to the configured bounds. Until a latency has
+// been observed the maximum delay is used.
+func (s *PaymentService) hedgeDelay(processor string) time.Duration {
+	minDelay := s.config.HedgeMinDelay
+	if minDelay <= 0 {
+		minDelay = defaultHedgeMinDelay
+	}
+	maxDelay := s.config.HedgeMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultHedgeMaxDelay
+	}
+	multiplier := s.config.HedgeDelayMultiplier
+	if multiplier <= 0 {
+		multiplier = defaultHedgeDelayMultiplier
+	}
+
+	p, ok := s.processors.Get(processor)
+	if !ok || p.Latency() == 0 {
+		return maxDelay
+	}
+
+	delay := time.Duration(multiplier * float64(p.Latency()))
+	if delay < minDelay {
+		return minDelay
+	}
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
@@ -0,0 +1,260 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+	"th_payment_processor/internal/storage"
+)
+
+// slowProcessor answers payments after delay. With chargeFirst it commits
+// the charge before waiting, so a client that gives up is charged anyway;
+// otherwise an abandoned payment is never charged, like the mock processor.
+// Refunds are answered at once.
+type slowProcessor struct {
+	*httptest.Server
+	mu       sync.Mutex
+	charged  map[string]bool
+	refunded map[string]int
+}
+
+func newSlowProcessor(t *testing.T, delay time.Duration, chargeFirst bool) *slowProcessor {
+	p := &slowProcessor{charged: make(map[string]bool), refunded: make(map[string]int)}
+	p.Server = newFakeProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/refunds"):
+			p.mu.Lock()
+			p.refunded[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/payments/"), "/refunds")]++
+			p.mu.Unlock()
+			w.Write([]byte(`{}`))
+		case r.Method == http.MethodGet:
+			p.mu.Lock()
+			found := p.charged[strings.TrimPrefix(r.URL.Path, "/payments/")]
+			p.mu.Unlock()
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{}`))
+		default:
+			var body struct {
+				CorrelationID string `json:"correlationId"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+
+			if chargeFirst {
+				p.charge(body.CorrelationID)
+			}
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+			if !chargeFirst {
+				p.charge(body.CorrelationID)
+			}
+			w.Write([]byte(`{"message":"payment processed successfully"}`))
+		}
+	})
+	return p
+}
+
+func (p *slowProcessor) charge(correlationID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.charged[correlationID] = true
+}
+
+func (p *slowProcessor) wasCharged(correlationID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.charged[correlationID]
+}
+
+func (p *slowProcessor) refunds(correlationID string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.refunded[correlationID]
+}
+
+func newHedgingService(defaultURL, fallbackURL string, opts ...func(*config.Config)) (*PaymentService, storage.Store) {
+	hedging := func(cfg *config.Config) {
+		cfg.FallbackProcessorURL = fallbackURL
+		cfg.RequestTimeout = 2 * time.Second
+		cfg.HedgingEnabled = true
+		cfg.HedgeMaxDelay = 50 * time.Millisecond
+	}
+	service := newTestService(defaultURL, append([]func(*config.Config){hedging}, opts...)...)
+	return service, service.storage
+}
+
+func TestPaymentService_HedgesSlowDefault(t *testing.T) {
+	slowDefault := newSlowProcessor(t, 500*time.Millisecond, false)
+	fastFallback := newSlowProcessor(t, 0, false)
+
+	service, store := newHedgingService(slowDefault.URL, fastFallback.URL)
+
+	start := time.Now()
+	record, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "hedge-1", Amount: 1000})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Expected hedge to beat the slow default, took %s", elapsed)
+	}
+	if record.Processor != "fallback" || record.DuplicateProcessor != "" {
+		t.Errorf("Expected a single charge on fallback, got %+v", record)
+	}
+	if slowDefault.wasCharged("hedge-1") {
+		t.Error("Expected cancelled default request not to be charged")
+	}
+
+	summary := store.GetPaymentsSummary(nil, nil)
+	if summary["fallback"].TotalRequests != 1 || summary["default"].TotalRequests != 0 {
+		t.Errorf("Expected payment counted once, got %v", summary)
+	}
+}
+
+func TestPaymentService_HedgeRecordsDuplicateCharge(t *testing.T) {
+	// The default commits the charge but is slow to answer
+	slowDefault := newSlowProcessor(t, 500*time.Millisecond, true)
+	fastFallback := newSlowProcessor(t, 0, false)
+
+	service, store := newHedgingService(slowDefault.URL, fastFallback.URL)
+
+	record, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "hedge-2", Amount: 1000})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if record.Processor != "fallback" || record.DuplicateProcessor != "default" {
+		t.Errorf("Expected fallback charge with duplicate flagged on default, got %+v", record)
+	}
+	if slowDefault.refunds("hedge-2") != 1 || fastFallback.refunds("hedge-2") != 0 {
+		t.Errorf("Expected the duplicate to be refunded on default only")
+	}
+	if len(record.Refunds) != 1 || !record.Refunds[0].Duplicate || record.Refunds[0].Status != models.RefundStatusSucceeded {
+		t.Errorf("Expected a succeeded duplicate refund on the record, got %+v", record.Refunds)
+	}
+	// The duplicate refund leaves the payment itself untouched
+	if record.Status != models.PaymentStatusSucceeded || record.RefundedAmount != 0 || record.RefundableAmount() != 1000 {
+		t.Errorf("Expected the payment to stay fully charged, got %+v", record)
+	}
+	summary := store.GetPaymentsSummary(nil, nil)
+	if summary["fallback"].TotalRequests+summary["default"].TotalRequests != 1 || summary["default"].TotalRefunds != 0 {
+		t.Errorf("Expected payment counted once, got %v", summary)
+	}
+}
+
+func TestPaymentService_HedgeChecksTimedOutLoser(t *testing.T) {
+	// The default commits the charge but answers only after the request
+	// has timed out, which sends the payment on to the fallback
+	slowDefault := newSlowProcessor(t, 500*time.Millisecond, true)
+	fastFallback := newSlowProcessor(t, 0, false)
+
+	service, _ := newHedgingService(slowDefault.URL, fastFallback.URL, func(cfg *config.Config) {
+		cfg.RequestTimeout = 100 * time.Millisecond
+		cfg.HedgeMaxDelay = time.Second
+	})
+
+	record, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "hedge-timeout", Amount: 1000})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if record.Processor != "fallback" || record.DuplicateProcessor != "default" {
+		t.Errorf("Expected fallback charge with the timed out duplicate flagged on default, got %+v", record)
+	}
+	if slowDefault.refunds("hedge-timeout") != 1 {
+		t.Errorf("Expected the duplicate to be refunded on default")
+	}
+}
+
+func TestPaymentService_HedgeRechecksCancelledLoser(t *testing.T) {
+	// The default only commits a cancelled charge some time after the
+	// cancellation, so the first lookup finds nothing
+	slowDefault := newSlowProcessor(t, 500*time.Millisecond, false)
+	fastFallback := newSlowProcessor(t, 0, false)
+
+	service, _ := newHedgingService(slowDefault.URL, fastFallback.URL, func(cfg *config.Config) { cfg.RequestTimeout = 200 * time.Millisecond })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.StartHedgeRechecks(ctx)
+
+	record, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "hedge-late", Amount: 1000})
+	if err != nil || record.Processor != "fallback" || record.DuplicateProcessor != "" {
+		t.Fatalf("Expected a single charge on fallback, got %+v, %v", record, err)
+	}
+	slowDefault.charge("hedge-late")
+
+	waitFor(t, "the late duplicate to be refunded", func() bool {
+		return slowDefault.refunds("hedge-late") == 1
+	})
+	waitFor(t, "the refund to be recorded", func() bool {
+		stored, _ := service.GetPayment("hedge-late")
+		return len(stored.Refunds) == 1 && stored.Refunds[0].Status == models.RefundStatusSucceeded
+	})
+	stored, _ := service.GetPayment("hedge-late")
+	if stored.DuplicateProcessor != "default" || stored.Status != models.PaymentStatusSucceeded || stored.RefundedAmount != 0 {
+		t.Errorf("Expected the late duplicate to be flagged without touching the payment, got %+v", stored)
+	}
+}
+
+func TestPaymentService_HedgeRechecksRunOnShutdown(t *testing.T) {
+	slowDefault := newSlowProcessor(t, 0, false)
+	fastFallback := newSlowProcessor(t, 0, false)
+	service, store := newHedgingService(slowDefault.URL, fastFallback.URL, func(cfg *config.Config) { cfg.RequestTimeout = time.Hour })
+
+	record := models.NewPaymentRecord("hedge-shutdown", 1000, time.Now())
+	record.Transition(models.PaymentStatusProcessing, time.Now(), "")
+	record.Processor = "fallback"
+	record.Transition(models.PaymentStatusSucceeded, time.Now(), "")
+	store.StorePayment(record)
+	slowDefault.charge("hedge-shutdown")
+
+	// The recheck is not due for an hour, but shutdown must not drop it
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		service.StartHedgeRechecks(ctx)
+		close(done)
+	}()
+	service.recheckHedgeLoser("hedge-shutdown", "default")
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the rechecks to finish after cancellation")
+	}
+	if slowDefault.refunds("hedge-shutdown") != 1 {
+		t.Error("Expected the waiting recheck to run before shutdown")
+	}
+	stored, _ := store.GetPaymentByCorrelationID("hedge-shutdown")
+	if stored.DuplicateProcessor != "default" || len(stored.Refunds) != 1 {
+		t.Errorf("Expected the duplicate to be recorded, got %+v", stored)
+	}
+}
+
+func TestPaymentService_HedgeDelayFromLatency(t *testing.T) {
+	service, _ := newHedgingService("http://default", "http://fallback")
+	service.config.HedgeMinDelay = 10 * time.Millisecond
+	service.config.HedgeMaxDelay = time.Second
+
+	if got := service.hedgeDelay("default"); got != time.Second {
+		t.Errorf("Expected max delay before any observation, got %s", got)
+	}
+
+	p, _ := service.processors.Get("default")
+	p.observeLatency(100 * time.Millisecond)
+	if got := service.hedgeDelay("default"); got != 200*time.Millisecond {
+		t.Errorf("Expected twice the observed latency, got %s", got)
+	}
+}
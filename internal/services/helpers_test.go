@@ -0,0 +1,42 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/storage"
+)
+
+// newFakeProcessor serves handler as a payment processor that always
+// reports itself healthy on /service-health. It is closed when t ends.
+func newFakeProcessor(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	processor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/service-health") {
+			w.Write([]byte(`{"failing":false,"minResponseTime":0}`))
+			return
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(processor.Close)
+	return processor
+}
+
+// newTestService returns a service on in-memory storage whose default and
+// fallback processors are both at processorURL, with a one second request
+// timeout. opts adjust the config before the service is built.
+func newTestService(processorURL string, opts ...func(*config.Config)) *PaymentService {
+	cfg := &config.Config{
+		DefaultProcessorURL:  processorURL,
+		FallbackProcessorURL: processorURL,
+		RequestTimeout:       time.Second,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return NewPaymentService(cfg, storage.NewInMemoryStorage())
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"errors"
+	"sync"
+
+	"th_payment_processor/internal/models"
+)
+
+// ErrPaymentConflict is returned when a correlation ID is reused with a
+// different amount or currency.
+var ErrPaymentConflict = errors.New("payment with this correlation ID already exists with a different amount or currency")
+
+// inflightCall is a ProcessPayment in progress that duplicates wait on.
+type inflightCall struct {
+	done     chan struct{}
+	amount   models.Money
+	currency models.Currency
+	record   *models.PaymentRecord
+	err      error
+}
+
+// wait blocks until the owning call finishes and returns its outcome. A
+// duplicate asking for a different amount or currency is rejected without
+// waiting.
+func (c *inflightCall) wait(req *models.PaymentRequest) (*models.PaymentRecord, error) {
+	if req.Amount != c.amount || req.Currency != c.currency {
+		return nil, ErrPaymentConflict
+	}
+
+	<-c.done
+	if c.record == nil {
+		return nil, c.err
+	}
+	copied := *c.record
+	return &copied, c.err
+}
+
+// inflightGroup coalesces concurrent ProcessPayment calls for the same
+// correlation ID so only the first one reaches a processor.
+type inflightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+func newInflightGroup() *inflightGroup {
+	return &inflightGroup{calls: make(map[string]*inflightCall)}
+}
+
+// join returns the call in flight for req.CorrelationID, or registers a new one
+// and reports that the caller owns it and must finish it.
+func (g *inflightGroup) join(req *models.PaymentRequest) (*inflightCall, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if call, ok := g.calls[req.CorrelationID]; ok {
+		return call, false
+	}
+	call := &inflightCall{done: make(chan struct{}), amount: req.Amount, currency: req.Currency}
+	g.calls[req.CorrelationID] = call
+	return call, true
+}
+
+// finish hands the owner's outcome to every waiter and forgets the call.
+func (g *inflightGroup) finish(correlationID string, call *inflightCall, record *models.PaymentRecord, err error) {
+	g.mu.Lock()
+	delete(g.calls, correlationID)
+	g.mu.Unlock()
+
+	if record != nil {
+		copied := *record
+		call.record = &copied
+	}
+	call.err = err
+	close(call.done)
+}
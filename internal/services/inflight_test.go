@@ -0,0 +1,76 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+)
+
+func TestPaymentService_ConcurrentDuplicatesChargeOnce(t *testing.T) {
+	var charges atomic.Int32
+	processor := newFakeProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		charges.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(`{"message":"payment processed successfully"}`))
+	})
+
+	service := newTestService(processor.URL, func(cfg *config.Config) { cfg.RequestTimeout = 2 * time.Second })
+
+	const duplicates = 10
+	records := make([]*models.PaymentRecord, duplicates)
+	var wg sync.WaitGroup
+	for i := 0; i < duplicates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			record, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "dup", Amount: 1000})
+			if err != nil {
+				t.Errorf("Duplicate %d failed: %v", i, err)
+			}
+			records[i] = record
+		}(i)
+	}
+	wg.Wait()
+
+	if got := charges.Load(); got != 1 {
+		t.Errorf("Expected exactly one processor charge, got %d", got)
+	}
+	for i, record := range records {
+		if record == nil || record.ID != records[0].ID || record.Status != models.PaymentStatusSucceeded {
+			t.Errorf("Duplicate %d did not share the original outcome: %+v", i, record)
+		}
+	}
+}
+
+func TestPaymentService_ConflictingDuplicateRejected(t *testing.T) {
+	service := newTestService("http://localhost:8001")
+
+	if err := service.EnqueuePayment(&models.PaymentRequest{CorrelationID: "conflict", Amount: 1000}); err != nil {
+		t.Fatalf("Expected payment to be queued, got %v", err)
+	}
+	if err := service.EnqueuePayment(&models.PaymentRequest{CorrelationID: "conflict", Amount: 1000}); err != nil {
+		t.Errorf("Expected an identical duplicate to be accepted, got %v", err)
+	}
+	if err := service.EnqueuePayment(&models.PaymentRequest{CorrelationID: "conflict", Amount: 2000}); !errors.Is(err, ErrPaymentConflict) {
+		t.Errorf("Expected ErrPaymentConflict from the queue, got %v", err)
+	}
+	if _, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "conflict", Amount: 2000}); !errors.Is(err, ErrPaymentConflict) {
+		t.Errorf("Expected ErrPaymentConflict from ProcessPayment, got %v", err)
+	}
+	if err := service.EnqueuePayment(&models.PaymentRequest{CorrelationID: "conflict", Amount: 1000, Currency: "USD"}); !errors.Is(err, ErrPaymentConflict) {
+		t.Errorf("Expected ErrPaymentConflict for a different currency, got %v", err)
+	}
+
+	if stats := service.QueueStats(); stats.Depth != 1 {
+		t.Errorf("Expected duplicates not to take queue slots, got depth %d", stats.Depth)
+	}
+	if record, _ := service.GetPayment("conflict"); record.Amount != 1000 {
+		t.Errorf("Conflicting duplicate changed the stored amount to %s", record.Amount)
+	}
+}
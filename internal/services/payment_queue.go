@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"th_payment_processor/internal/models"
+)
+
+const (
+	defaultQueueSize   = 10000
+	defaultWorkerCount = 16
+)
+
+var (
+	// ErrQueueFull is returned when the intake queue has no room left.
+	ErrQueueFull = errors.New("payment queue is full")
+	// ErrQueueClosed is returned once the worker pool has been shut down.
+	ErrQueueClosed = errors.New("payment queue is closed")
+)
+
+// EnqueuePayment accepts a payment for asynchronous processing without
+// blocking. It never waits for room in the queue. Payments whose amount does
+// not fit their currency are rejected with models.ErrInvalidCurrency.
+func (s *PaymentService) EnqueuePayment(req *models.PaymentRequest) error {
+	if err := req.Validate(); err != nil {
+		return err
+	}
+
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+
+	if !s.accepting {
+		return ErrQueueClosed
+	}
+
+	// Reserve a slot first so a pending record is never left behind for a
+	// payment the queue then turns away
+	if s.queueSlots.Add(1) > int64(cap(s.queue)) {
+		s.queueSlots.Add(-1)
+		logrus.Warnf("Payment queue full, rejecting payment: %s", req.CorrelationID)
+		return ErrQueueFull
+	}
+
+	record := models.NewPaymentRecord(req.CorrelationID, req.Amount, time.Now())
+	record.Currency = req.Currency
+	existing, reserved, err := s.storage.ReservePayment(record)
+	if err != nil {
+		s.queueSlots.Add(-1)
+		logrus.Errorf("Failed to reserve payment %s: %v", req.CorrelationID, err)
+		return fmt.Errorf("failed to reserve payment: %w", err)
+	}
+	if !reserved {
+		s.queueSlots.Add(-1)
+		if !existing.Matches(req) {
+			logrus.Warnf("Payment %s reused with a different amount or currency", req.CorrelationID)
+			return ErrPaymentConflict
+		}
+		logrus.Infof("Payment already exists: %s", req.CorrelationID)
+		return nil
+	}
+
+	s.queue <- req
+	return nil
+}
+
+// StartWorkers runs the worker pool until ctx is cancelled. On shutdown it
+// stops accepting new payments and drains whatever is already queued.
+func (s *PaymentService) StartWorkers(ctx context.Context) {
+	workers := s.workerCount()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range s.queue {
+				s.queueSlots.Add(-1)
+				if _, err := s.ProcessPayment(req); err != nil {
+					logrus.Errorf("Queued payment %s failed: %v", req.CorrelationID, err)
+				}
+			}
+		}()
+	}
+	logrus.Infof("Started %d payment workers (queue capacity %d)", workers, cap(s.queue))
+
+	<-ctx.Done()
+
+	s.queueMu.Lock()
+	s.accepting = false
+	close(s.queue)
+	s.queueMu.Unlock()
+
+	wg.Wait()
+	logrus.Info("Payment workers stopped")
+}
+
+// QueueStats reports the current intake queue depth for monitoring.
+func (s *PaymentService) QueueStats() models.QueueStats {
+	return models.QueueStats{
+		Depth:    len(s.queue),
+		Capacity: cap(s.queue),
+		Workers:  s.workerCount(),
+	}
+}
+
+func (s *PaymentService) workerCount() int {
+	if s.config.WorkerCount <= 0 {
+		return defaultWorkerCount
+	}
+	return s.config.WorkerCount
+}
@@ -4,57 +4,110 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"th_payment_processor/internal/config"
 	"th_payment_processor/internal/models"
 	"th_payment_processor/internal/storage"
-	"sync"
 	"time"
 )
 
 type PaymentService struct {
 	config  *config.Config
-	storage *storage.InMemoryStorage
+	storage storage.Store
 	client  *http.Client
 
-	// Health monitoring
-	healthMu       sync.RWMutex
-	defaultHealth  *models.ProcessorHealth
-	fallbackHealth *models.ProcessorHealth
+	// Processors with their health state, keyed by name
+	processors *ProcessorRegistry
+
+	// Intake queue drained by the worker pool
+	queue      chan *models.PaymentRequest
+	queueMu    sync.RWMutex
+	queueSlots atomic.Int64
+	accepting  bool
+
+	// Payments waiting for another attempt after every processor failed
+	retries *retryScheduler
+
+	routing RoutingPolicy
+
+	// ProcessPayment calls in progress, keyed by correlation ID
+	inflight *inflightGroup
+
+	// Serialises read-modify-write of refunds and authorizations on records
+	recordMu sync.Mutex
+
+	// Notifies registered webhooks of payment outcomes
+	webhooks *WebhookDispatcher
 
-	// Rate limiting for health checks (per processor)
-	lastDefaultHealthCheck  time.Time
-	lastFallbackHealthCheck time.Time
-	healthCheckMu           sync.Mutex
+	// Streams payment outcomes and health changes to GET /events
+	events *EventBroker
+
+	// Recent reconciliation reports
+	reconciliations *reconciliationLog
+
+	// Losing hedged requests waiting to be looked up again
+	hedgeRechecks chan hedgeRecheck
 }
 
-func NewPaymentService(cfg *config.Config, storage *storage.InMemoryStorage) *PaymentService {
+func NewPaymentService(cfg *config.Config, storage storage.Store) *PaymentService {
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	processors, err := NewProcessorRegistry(cfg)
+	if err != nil {
+		logrus.Errorf("Invalid processor configuration, keeping the first processor of each name: %v", err)
+	}
+
+	routing, err := NewRoutingPolicy(cfg)
+	if err != nil {
+		logrus.Errorf("Invalid routing configuration, using %s routing: %v", RoutingPriority, err)
+		routing = priorityPolicy{}
+	}
+
 	return &PaymentService{
-		config:  cfg,
-		storage: storage,
+		config:    cfg,
+		storage:   storage,
+		queue:     make(chan *models.PaymentRequest, queueSize),
+		accepting: true,
+		retries:   newRetryScheduler(),
+		routing:   routing,
+		inflight:  newInflightGroup(),
 		client: &http.Client{
 			Timeout:   cfg.RequestTimeout,
 			Transport: otelhttp.NewTransport(http.DefaultTransport),
 		},
-		defaultHealth: &models.ProcessorHealth{
-			IsHealthy: true,
-			LastCheck: time.Now(),
-		},
-		fallbackHealth: &models.ProcessorHealth{
-			IsHealthy: true,
-			LastCheck: time.Now(),
-		},
+		processors:      processors,
+		webhooks:        NewWebhookDispatcher(cfg),
+		events:          NewEventBroker(cfg.EventsBufferSize),
+		reconciliations: &reconciliationLog{limit: reconciliationHistory(cfg)},
+		hedgeRechecks:   make(chan hedgeRecheck, hedgeRecheckBuffer),
 	}
 }
 
-func (s *PaymentService) ProcessPayment(req *models.PaymentRequest) (*models.PaymentRecord, error) {
+// Events returns the broker streaming payment and processor health events.
+func (s *PaymentService) Events() *EventBroker {
+	return s.events
+}
+
+// Webhooks returns the dispatcher that notifies webhooks of payment events.
+func (s *PaymentService) Webhooks() *WebhookDispatcher {
+	return s.webhooks
+}
+
+func (s *PaymentService) ProcessPayment(req *models.PaymentRequest) (record *models.PaymentRecord, err error) {
 	ctx := context.Background()
 	tracer := otel.Tracer("payment-service")
 	ctx, span := tracer.Start(ctx, "ProcessPayment")
@@ -62,72 +115,177 @@ func (s *PaymentService) ProcessPayment(req *models.PaymentRequest) (*models.Pay
 
 	span.SetAttributes(
 		attribute.String("payment.correlation_id", req.CorrelationID),
-		attribute.Float64("payment.amount", req.Amount),
+		attribute.Float64("payment.amount", req.Amount.Float64()),
 	)
 
-	logrus.Infof("Processing payment: correlationId=%s, amount=%.2f", req.CorrelationID, req.Amount)
+	logrus.Infof("Processing payment: correlationId=%s, amount=%s", req.CorrelationID, req.Amount)
 
-	// Check if payment already exists
-	if existing, exists := s.storage.GetPaymentByCorrelationID(req.CorrelationID); exists {
+	if err := req.Validate(); err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+
+	// Duplicates arriving while the payment is in flight share its outcome
+	// instead of reaching a processor themselves
+	call, owner := s.inflight.join(req)
+	if !owner {
+		logrus.Infof("Payment already in flight, waiting for it: %s", req.CorrelationID)
+		span.SetAttributes(attribute.Bool("payment.coalesced", true))
+		return call.wait(req)
+	}
+	defer func() { s.inflight.finish(req.CorrelationID, call, record, err) }()
+
+	// Payments accepted through the queue already have a pending record;
+	// anything further along is a duplicate
+	record = models.NewPaymentRecord(req.CorrelationID, req.Amount, time.Now())
+	record.Currency = req.Currency
+	existing, reserved, err := s.storage.ReservePayment(record)
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to reserve payment: %w", err)
+	case reserved:
+	case !existing.Matches(req):
+		logrus.Warnf("Payment %s reused with a different amount or currency", req.CorrelationID)
+		span.SetAttributes(attribute.Bool("payment.conflict", true))
+		return nil, ErrPaymentConflict
+	case existing.Status != models.PaymentStatusPending:
 		logrus.Infof("Payment already exists: %s", req.CorrelationID)
 		span.SetAttributes(attribute.Bool("payment.already_exists", true))
 		return existing, nil
+	default:
+		record = existing
 	}
 
-	// Create payment record
-	record := &models.PaymentRecord{
-		ID:            uuid.New(),
-		CorrelationID: req.CorrelationID,
-		Amount:        req.Amount,
-		ProcessedAt:   time.Now(),
-		Success:       false,
-	}
-
-	// try default processor first
-	if s.isProcessorHealthy("default") {
-		logrus.Infof("Trying default processor for payment: %s", req.CorrelationID)
-		span.SetAttributes(attribute.String("payment.processor.attempted", "default"))
-		if err := s.processWithProcessor(ctx, req, record, "default"); err == nil {
-			logrus.Infof("Payment processed successfully with default processor: %s", req.CorrelationID)
-			span.SetAttributes(attribute.String("payment.processor.used", "default"))
-			s.storage.StorePayment(record)
-			return record, nil
-		} else {
-			logrus.Errorf("Default processor failed for payment %s: %v", req.CorrelationID, err)
-			span.SetAttributes(attribute.String("payment.processor.default.error", err.Error()))
-		}
-	} else {
-		logrus.Warnf("Default processor not healthy for payment: %s", req.CorrelationID)
-		span.SetAttributes(attribute.Bool("payment.processor.default.unhealthy", true))
-	}
-
-	// try fallback processor
-	if s.isProcessorHealthy("fallback") {
-		logrus.Infof("Trying fallback processor for payment: %s", req.CorrelationID)
-		span.SetAttributes(attribute.String("payment.processor.attempted", "fallback"))
-		if err := s.processWithProcessor(ctx, req, record, "fallback"); err == nil {
-			logrus.Infof("Payment processed successfully with fallback processor: %s", req.CorrelationID)
-			span.SetAttributes(attribute.String("payment.processor.used", "fallback"))
-			s.storage.StorePayment(record)
-			return record, nil
-		} else {
-			logrus.Errorf("Fallback processor failed for payment %s: %v", req.CorrelationID, err)
-			span.SetAttributes(attribute.String("payment.processor.fallback.error", err.Error()))
+	record.Attempts = 1
+	record.LastAttemptAt = time.Now()
+	s.transition(record, models.PaymentStatusProcessing, "")
+	s.savePayment(record)
+
+	err = s.attemptProcessors(ctx, req, record)
+	if err == nil {
+		record.ProcessedAt = time.Now()
+		s.transition(record, models.PaymentStatusSucceeded, "accepted by "+record.Processor)
+		if err := s.savePayment(record); err != nil {
+			span.RecordError(err)
+			return record, err
 		}
-	} else {
-		logrus.Warnf("Fallback processor not healthy for payment: %s", req.CorrelationID)
-		span.SetAttributes(attribute.Bool("payment.processor.fallback.unhealthy", true))
+		return record, nil
 	}
 
-	// if  both  fail, mark as failed but still store
-	record.Processor = "failed"
-	s.storage.StorePayment(record)
-	logrus.Errorf("Both processors failed for payment: %s", req.CorrelationID)
+	// if  every processor fails, hand it to the retry scheduler, which stores it as retrying or failed
+	logrus.Errorf("All processors failed for payment: %s", req.CorrelationID)
 
-	span.SetStatus(codes.Error, "both payment processors are unavailable")
+	span.SetStatus(codes.Error, "all payment processors are unavailable")
 	span.SetAttributes(attribute.String("payment.processor.used", "failed"))
 
-	return record, fmt.Errorf("both payment processors are unavailable")
+	s.scheduleRetry(req, record, err.Error())
+
+	return record, fmt.Errorf("all payment processors are unavailable")
+}
+
+// GetPayment returns the payment with the given correlation ID, including
+// its status history.
+func (s *PaymentService) GetPayment(correlationID string) (*models.PaymentRecord, bool) {
+	return s.storage.GetPaymentByCorrelationID(correlationID)
+}
+
+// ListPayments returns one page of this instance's payments, newest first.
+func (s *PaymentService) ListPayments(query models.PaymentQuery) (models.PaymentPage, error) {
+	return s.storage.ListPayments(query)
+}
+
+// transition moves record to status, logging lifecycle violations rather
+// than failing the payment over them. Outcomes are published to webhooks
+// and event subscribers as they happen.
+func (s *PaymentService) transition(record *models.PaymentRecord, status models.PaymentStatus, reason string) {
+	if err := record.Transition(status, time.Now(), reason); err != nil {
+		logrus.Errorf("Payment %s: %v", record.CorrelationID, err)
+		return
+	}
+	if event, ok := models.WebhookEventForStatus(status); ok {
+		s.webhooks.Publish(event, record)
+	}
+	if eventType, ok := models.PaymentEventType(status); ok {
+		s.events.Publish(models.Event{Type: eventType, Processor: record.Processor, Payment: record})
+	}
+}
+
+// savePayment persists record, logging storage failures so the async paths
+// that cannot return them still leave a trace.
+func (s *PaymentService) savePayment(record *models.PaymentRecord) error {
+	if err := s.storage.StorePayment(record); err != nil {
+		logrus.Errorf("Failed to store payment %s: %v", record.CorrelationID, err)
+		return fmt.Errorf("failed to store payment: %w", err)
+	}
+	return nil
+}
+
+// attemptProcessors tries processors in the order chosen by the routing
+// policy, updating record when one of them accepts the payment.
+func (s *PaymentService) attemptProcessors(ctx context.Context, req *models.PaymentRequest, record *models.PaymentRecord) error {
+	span := trace.SpanFromContext(ctx)
+
+	candidates := s.routing.Order(req, s.processorCandidates())
+	order := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		order[i] = candidate.Name
+	}
+	span.SetAttributes(
+		attribute.String("payment.routing.policy", s.routing.Name()),
+		attribute.StringSlice("payment.routing.order", order),
+	)
+
+	var healthy []string
+	for _, candidate := range candidates {
+		if !candidate.Healthy {
+			logrus.Warnf("%s processor not healthy for payment: %s", candidate.Name, req.CorrelationID)
+			span.SetAttributes(attribute.Bool("payment.processor."+candidate.Name+".unhealthy", true))
+			continue
+		}
+		healthy = append(healthy, candidate.Name)
+	}
+
+	// Race the first two processors instead of waiting out a slow one
+	if s.config.HedgingEnabled && len(healthy) >= 2 {
+		if err := s.hedgedAttempt(ctx, req, record, healthy[0], healthy[1]); err == nil {
+			return nil
+		}
+		healthy = healthy[2:]
+	}
+
+	for _, processor := range healthy {
+		logrus.Infof("Trying %s processor for payment: %s", processor, req.CorrelationID)
+		span.SetAttributes(attribute.String("payment.processor.attempted", processor))
+		if err := s.processWithProcessor(ctx, req, record, processor); err != nil {
+			logrus.Errorf("%s processor failed for payment %s: %v", processor, req.CorrelationID, err)
+			span.SetAttributes(attribute.String("payment.processor."+processor+".error", err.Error()))
+			continue
+		}
+
+		logrus.Infof("Payment processed successfully with %s processor: %s", processor, req.CorrelationID)
+		span.SetAttributes(attribute.String("payment.processor.used", processor))
+		return nil
+	}
+
+	return fmt.Errorf("all payment processors are unavailable")
+}
+
+// processorCandidates snapshots the processors and their health for routing.
+func (s *PaymentService) processorCandidates() []ProcessorCandidate {
+	processors := s.processors.All()
+	candidates := make([]ProcessorCandidate, len(processors))
+	for i, processor := range processors {
+		health := processor.Health()
+		candidates[i] = ProcessorCandidate{
+			Name:            processor.Name,
+			Priority:        processor.Priority,
+			FeePercentage:   processor.Fee(),
+			Healthy:         health.IsHealthy && !health.Failing && processor.breaker.State() != CircuitOpen,
+			MinResponseTime: time.Duration(health.MinResponseTime) * time.Millisecond,
+		}
+	}
+	return candidates
 }
 
 func (s *PaymentService) processWithProcessor(ctx context.Context, req *models.PaymentRequest, record *models.PaymentRecord, processor string) error {
@@ -138,20 +296,42 @@ func (s *PaymentService) processWithProcessor(ctx context.Context, req *models.P
 		attribute.String("payment.processor.name", processor),
 		attribute.String("payment.correlation_id", req.CorrelationID),
 	)
-	var url string
-	switch processor {
-	case "default":
-		url = s.config.DefaultProcessorURL + "/payments"
-	case "fallback":
-		url = s.config.FallbackProcessorURL + "/payments"
-	default:
+	p, ok := s.processors.Get(processor)
+	if !ok {
 		return fmt.Errorf("unknown processor: %s", processor)
 	}
 
+	if !p.breaker.Allow() {
+		span.SetAttributes(attribute.String("payment.processor.circuit", string(CircuitOpen)))
+		return ErrCircuitOpen
+	}
+
+	start := time.Now()
+	err := s.sendPayment(ctx, span, p, req, record)
+	if err == nil {
+		p.observeLatency(time.Since(start))
+	}
+	if errors.Is(err, context.Canceled) {
+		// The caller gave up, which says nothing about the processor
+		p.breaker.Release()
+	} else {
+		p.breaker.Record(err == nil, isTimeoutError(err))
+	}
+	span.SetAttributes(attribute.String("payment.processor.circuit", string(p.breaker.State())))
+
+	return err
+}
+
+// sendPayment posts the payment to p and marks record as processed by it
+// when the processor accepts it.
+func (s *PaymentService) sendPayment(ctx context.Context, span trace.Span, p *Processor, req *models.PaymentRequest, record *models.PaymentRecord) error {
+	url := p.URL + "/payments"
+
 	// prepare request
 	processorReq := models.PaymentProcessorRequest{
 		CorrelationID: req.CorrelationID,
 		Amount:        req.Amount,
+		Currency:      req.Currency,
 		RequestedAt:   time.Now(),
 	}
 
@@ -170,7 +350,7 @@ func (s *PaymentService) processWithProcessor(ctx context.Context, req *models.P
 	httpReq.Header.Set("Content-Type", "application/json")
 	span.SetAttributes(attribute.String("http.url", url))
 
-	resp, err := s.client.Do(httpReq)
+	resp, err := p.client.Do(httpReq)
 	if err != nil {
 		span.RecordError(err)
 		return fmt.Errorf("request failed: %w", err)
@@ -180,7 +360,7 @@ func (s *PaymentService) processWithProcessor(ctx context.Context, req *models.P
 	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
 
 	if resp.StatusCode != http.StatusOK {
-		err := fmt.Errorf("processor returned status %d", resp.StatusCode)
+		err := &processorStatusError{StatusCode: resp.StatusCode}
 		span.RecordError(err)
 		return err
 	}
@@ -192,24 +372,26 @@ func (s *PaymentService) processWithProcessor(ctx context.Context, req *models.P
 	}
 
 	// Update record
-	record.Processor = processor
+	record.Processor = p.Name
 	record.Success = true
+	s.applyFee(record, processorResp.Fee)
 
 	return nil
 }
 
 func (s *PaymentService) isProcessorHealthy(processor string) bool {
-	s.healthMu.RLock()
-	defer s.healthMu.RUnlock()
-
-	switch processor {
-	case "default":
-		return s.defaultHealth.IsHealthy && !s.defaultHealth.Failing
-	case "fallback":
-		return s.fallbackHealth.IsHealthy && !s.fallbackHealth.Failing
-	default:
-		return false
+	p, ok := s.processors.Get(processor)
+	return ok && p.available()
+}
+
+// anyProcessorHealthy reports whether at least one processor can take payments.
+func (s *PaymentService) anyProcessorHealthy() bool {
+	for _, p := range s.processors.All() {
+		if p.available() {
+			return true
+		}
 	}
+	return false
 }
 
 func (s *PaymentService) StartHealthMonitoring(ctx context.Context) {
@@ -221,46 +403,33 @@ func (s *PaymentService) StartHealthMonitoring(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			s.checkProcessorHealth("default")
-			s.checkProcessorHealth("fallback")
+			s.checkAllProcessorsHealth()
 		}
 	}
 }
 
-func (s *PaymentService) checkProcessorHealth(processor string) {
-	// Rate limiting: only check every 5 seconds per processor
-	s.healthCheckMu.Lock()
-	var lastCheck time.Time
-	switch processor {
-	case "default":
-		lastCheck = s.lastDefaultHealthCheck
-	case "fallback":
-		lastCheck = s.lastFallbackHealthCheck
+func (s *PaymentService) checkAllProcessorsHealth() {
+	for _, p := range s.processors.All() {
+		s.checkProcessorHealth(p.Name)
 	}
+}
 
-	if time.Since(lastCheck) < 5*time.Second {
-		s.healthCheckMu.Unlock()
+func (s *PaymentService) checkProcessorHealth(processor string) {
+	p, ok := s.processors.Get(processor)
+	if !ok {
 		return
 	}
 
-	// Update the last check time for this processor
-	switch processor {
-	case "default":
-		s.lastDefaultHealthCheck = time.Now()
-	case "fallback":
-		s.lastFallbackHealthCheck = time.Now()
-	}
-	s.healthCheckMu.Unlock()
-
-	var url string
-	switch processor {
-	case "default":
-		url = s.config.DefaultProcessorURL + "/payments/service-health"
-	case "fallback":
-		url = s.config.FallbackProcessorURL + "/payments/service-health"
-	default:
+	// Rate limiting: only check every 5 seconds per processor
+	p.healthCheckMu.Lock()
+	if time.Since(p.lastHealthCheck) < 5*time.Second {
+		p.healthCheckMu.Unlock()
 		return
 	}
+	p.lastHealthCheck = time.Now()
+	p.healthCheckMu.Unlock()
+
+	url := p.URL + "/payments/service-health"
 
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -268,7 +437,7 @@ func (s *PaymentService) checkProcessorHealth(processor string) {
 		return
 	}
 
-	resp, err := s.client.Do(req)
+	resp, err := p.client.Do(req)
 	if err != nil {
 		s.updateProcessorHealth(processor, false, 0, true)
 		return
@@ -295,26 +464,72 @@ func (s *PaymentService) checkProcessorHealth(processor string) {
 }
 
 func (s *PaymentService) GetPaymentsSummary(from, to *time.Time) models.PaymentSummary {
-	return s.storage.GetPaymentsSummary(from, to)
+	summary := s.storage.GetPaymentsSummary(from, to)
+
+	// Every configured processor appears, even with no payments yet
+	for _, name := range s.processors.Names() {
+		if _, ok := summary[name]; !ok {
+			summary[name] = models.ProcessorSummary{}
+		}
+	}
+	return summary
+}
+
+// GetPaymentsSeries is GetPaymentsSummary split into intervals.
+func (s *PaymentService) GetPaymentsSeries(from, to *time.Time, interval time.Duration) ([]models.SummaryPoint, error) {
+	points, err := s.storage.GetPaymentsSeries(from, to, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, point := range points {
+		for _, name := range s.processors.Names() {
+			if _, ok := point.Processors[name]; !ok {
+				point.Processors[name] = models.ProcessorSummary{}
+			}
+		}
+	}
+	return points, nil
 }
 
 func (s *PaymentService) updateProcessorHealth(processor string, isHealthy bool, minResponseTime int, failing bool) {
-	s.healthMu.Lock()
-	defer s.healthMu.Unlock()
-
-	switch processor {
-	case "default":
-		s.defaultHealth.IsHealthy = isHealthy
-		s.defaultHealth.MinResponseTime = minResponseTime
-		s.defaultHealth.Failing = failing
-		s.defaultHealth.LastCheck = time.Now()
-	case "fallback":
-		s.fallbackHealth.IsHealthy = isHealthy
-		s.fallbackHealth.MinResponseTime = minResponseTime
-		s.fallbackHealth.Failing = failing
-		s.fallbackHealth.LastCheck = time.Now()
+	p, ok := s.processors.Get(processor)
+	if !ok {
+		return
+	}
+
+	p.healthMu.Lock()
+	changed := p.health.IsHealthy != isHealthy || p.health.Failing != failing
+	p.health.IsHealthy = isHealthy
+	p.health.MinResponseTime = minResponseTime
+	p.health.Failing = failing
+	p.health.LastCheck = time.Now()
+	p.healthMu.Unlock()
+
+	if changed {
+		s.events.Publish(models.Event{
+			Type:      models.EventProcessorHealth,
+			Processor: processor,
+			Health:    &models.ProcessorHealthEvent{Healthy: isHealthy, Failing: failing, MinResponseTime: minResponseTime},
+		})
+	}
+
+	if isHealthy && !failing {
+		p.breaker.HealthRecovered()
 	}
 
 	logrus.Infof("Processor %s health updated: healthy=%v, failing=%v, minResponseTime=%d",
 		processor, isHealthy, failing, minResponseTime)
 }
+
+// isTimeoutError reports whether err came from a deadline rather than a response.
+func isTimeoutError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
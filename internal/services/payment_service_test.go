@@ -1,6 +1,9 @@
 package services
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
 	"th_payment_processor/internal/config"
 	"th_payment_processor/internal/models"
 	"th_payment_processor/internal/storage"
@@ -20,7 +23,7 @@ func TestPaymentService_ProcessPayment(t *testing.T) {
 
 	req := &models.PaymentRequest{
 		CorrelationID: "test-123",
-		Amount:        100.00,
+		Amount:        10000,
 	}
 
 	record, err := service.ProcessPayment(req)
@@ -47,7 +50,68 @@ func TestPaymentService_GetPaymentsSummary(t *testing.T) {
 	summary := service.GetPaymentsSummary(nil, nil)
 
 	// Should return empty summary
-	if summary.Default.TotalRequests != 0 || summary.Fallback.TotalRequests != 0 {
+	if summary["default"].TotalRequests != 0 || summary["fallback"].TotalRequests != 0 {
 		t.Error("Expected empty summary for new service")
 	}
 }
+
+func TestPaymentService_EnqueuePayment(t *testing.T) {
+	service := newTestService("http://localhost:8001", func(cfg *config.Config) { cfg.QueueSize = 2 })
+
+	// No workers running, so the queue fills up
+	for _, id := range []string{"queued-1", "queued-2"} {
+		if err := service.EnqueuePayment(&models.PaymentRequest{CorrelationID: id, Amount: 1000}); err != nil {
+			t.Fatalf("Expected payment to be queued, got %v", err)
+		}
+	}
+
+	if record, ok := service.GetPayment("queued-1"); !ok || record.Status != models.PaymentStatusPending {
+		t.Errorf("Expected queued payment to be stored as pending, got %+v", record)
+	}
+
+	if err := service.EnqueuePayment(&models.PaymentRequest{CorrelationID: "overflow", Amount: 1000}); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	if _, ok := service.GetPayment("overflow"); ok {
+		t.Error("Expected no record for a payment the queue rejected")
+	}
+
+	stats := service.QueueStats()
+	if stats.Depth != 2 || stats.Capacity != 2 {
+		t.Errorf("Unexpected queue stats: %+v", stats)
+	}
+}
+
+func TestPaymentService_Currency(t *testing.T) {
+	forwarded := make(chan models.Currency, 1)
+	processor := newFakeProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		var req models.PaymentProcessorRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		forwarded <- req.Currency
+		w.Write([]byte(`{"message":"payment processed successfully"}`))
+	})
+	service := newTestService(processor.URL)
+
+	for _, req := range []*models.PaymentRequest{
+		{CorrelationID: "unknown", Amount: 1000, Currency: "XYZ"},
+		{CorrelationID: "fractional-yen", Amount: 1050, Currency: "JPY"},
+	} {
+		if err := service.EnqueuePayment(req); !errors.Is(err, models.ErrInvalidCurrency) {
+			t.Errorf("Expected ErrInvalidCurrency for %s, got %v", req.CorrelationID, err)
+		}
+		if _, ok := service.GetPayment(req.CorrelationID); ok {
+			t.Errorf("Expected no record for rejected payment %s", req.CorrelationID)
+		}
+	}
+
+	record, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "yen", Amount: 50000, Currency: "JPY"})
+	if err != nil || record.Currency != "JPY" {
+		t.Fatalf("Expected a JPY payment, got %+v, %v", record, err)
+	}
+	if got := <-forwarded; got != "JPY" {
+		t.Errorf("Processor received currency %q, want JPY", got)
+	}
+	if summary := service.GetPaymentsSummary(nil, nil); summary[record.Processor].Currencies["JPY"].TotalAmount != 50000 {
+		t.Errorf("Expected the payment under JPY in the summary, got %+v", summary[record.Processor])
+	}
+}
@@ -0,0 +1,329 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+)
+
+const (
+	defaultReconciliationInterval = 5 * time.Minute
+	defaultReconciliationDelay    = time.Minute
+	defaultReconciliationHistory  = 100
+
+	reconciliationScheduled = "scheduled"
+	reconciliationManual    = "manual"
+)
+
+var (
+	// ErrInvalidReconciliationWindow is returned for a window ending before it starts.
+	ErrInvalidReconciliationWindow = errors.New("reconciliation window must not end before it starts")
+	// ErrInvalidReconciliationMode is returned for a mode other than totals or records.
+	ErrInvalidReconciliationMode = errors.New("reconciliation mode must be totals or records")
+	// ErrReconciliationNotFound is returned for an unknown or discarded report.
+	ErrReconciliationNotFound = errors.New("reconciliation report not found")
+)
+
+// reconciliationLog keeps the most recent reports, oldest first.
+type reconciliationLog struct {
+	mu      sync.Mutex
+	reports []models.ReconciliationReport
+	limit   int
+}
+
+func (l *reconciliationLog) add(report models.ReconciliationReport) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.reports = append(l.reports, report)
+	if len(l.reports) > l.limit {
+		l.reports = append(l.reports[:0], l.reports[len(l.reports)-l.limit:]...)
+	}
+}
+
+// list returns the reports newest first.
+func (l *reconciliationLog) list() []models.ReconciliationReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reports := make([]models.ReconciliationReport, len(l.reports))
+	for i, report := range l.reports {
+		reports[len(reports)-1-i] = report
+	}
+	return reports
+}
+
+func (l *reconciliationLog) get(id uuid.UUID) (models.ReconciliationReport, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, report := range l.reports {
+		if report.ID == id {
+			return report, true
+		}
+	}
+	return models.ReconciliationReport{}, false
+}
+
+// StartReconciliation checks the totals of every processor against its
+// admin summary every RECONCILIATION_INTERVAL until ctx is cancelled. Each
+// run covers the interval that ended RECONCILIATION_DELAY ago, so
+// consecutive runs tile time and payments still in flight have settled.
+// The totals are the cluster's, so only one instance needs to run it.
+func (s *PaymentService) StartReconciliation(ctx context.Context) {
+	if !s.config.ReconciliationEnabled {
+		return
+	}
+	ticker := time.NewTicker(s.reconciliationInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			from, to := s.reconciliationWindow(nil, nil)
+			s.reconcile(ctx, from, to, reconciliationScheduled, models.ReconciliationModeTotals, false)
+		}
+	}
+}
+
+// ReconcilePayments runs a reconciliation now. A missing to defaults to
+// RECONCILIATION_DELAY ago and a missing from to RECONCILIATION_INTERVAL
+// before to.
+func (s *PaymentService) ReconcilePayments(ctx context.Context, req models.ReconciliationRequest) (models.ReconciliationReport, error) {
+	start, end := s.reconciliationWindow(req.From, req.To)
+	if end.Before(start) {
+		return models.ReconciliationReport{}, ErrInvalidReconciliationWindow
+	}
+	mode := req.Mode
+	switch mode {
+	case "":
+		mode = models.ReconciliationModeTotals
+	case models.ReconciliationModeTotals, models.ReconciliationModeRecords:
+	default:
+		return models.ReconciliationReport{}, ErrInvalidReconciliationMode
+	}
+	return s.reconcile(ctx, start, end, reconciliationManual, mode, req.Repair && mode == models.ReconciliationModeRecords), nil
+}
+
+// Reconciliations returns the most recent reports, newest first.
+func (s *PaymentService) Reconciliations() []models.ReconciliationReport {
+	return s.reconciliations.list()
+}
+
+func (s *PaymentService) GetReconciliation(id uuid.UUID) (models.ReconciliationReport, error) {
+	report, ok := s.reconciliations.get(id)
+	if !ok {
+		return report, ErrReconciliationNotFound
+	}
+	return report, nil
+}
+
+func (s *PaymentService) reconciliationWindow(from, to *time.Time) (time.Time, time.Time) {
+	end := time.Now().Add(-s.reconciliationDelay())
+	if to != nil {
+		end = *to
+	}
+	start := end.Add(-s.reconciliationInterval())
+	if from != nil {
+		start = *from
+	}
+	return start, end
+}
+
+// reconcile checks [from, to] in the given mode and records the report.
+func (s *PaymentService) reconcile(ctx context.Context, from, to time.Time, trigger string, mode models.ReconciliationMode, repair bool) models.ReconciliationReport {
+	ctx, span := otel.Tracer("payment-service").Start(ctx, "ReconcilePayments")
+	defer span.End()
+
+	report := models.ReconciliationReport{
+		ID:        uuid.New(),
+		Trigger:   trigger,
+		Mode:      mode,
+		From:      from,
+		To:        to,
+		StartedAt: time.Now(),
+	}
+	if mode == models.ReconciliationModeRecords {
+		s.reconcileRecords(ctx, &report, repair)
+	} else {
+		s.reconcileTotals(ctx, &report)
+	}
+
+	report.FinishedAt = time.Now()
+	span.SetAttributes(
+		attribute.String("reconciliation.trigger", trigger),
+		attribute.String("reconciliation.mode", string(mode)),
+		attribute.Int("reconciliation.discrepancies", report.Discrepancies),
+	)
+	s.reconciliations.add(report)
+	return report
+}
+
+// reconcileTotals compares the cluster-wide totals of the report's window
+// with what each processor reports for the same window.
+func (s *PaymentService) reconcileTotals(ctx context.Context, report *models.ReconciliationReport) {
+	from, to := report.From, report.To
+
+	// The processors see every instance's payments, so compare cluster totals
+	local, err := s.GetClusterPaymentsSummary(ctx, &from, &to)
+	var peerErr *PeerUnavailableError
+	if errors.As(err, &peerErr) {
+		report.UnavailablePeers = peerErr.Peers
+	}
+	inner, outer := s.edgeSummaries(ctx, from, to, local)
+
+	for _, p := range s.processors.All() {
+		result := models.ProcessorReconciliation{
+			Processor: p.Name,
+			Local:     reconciliationTotals(local[p.Name]),
+		}
+		low, high := reconciliationTotals(inner[p.Name]), reconciliationTotals(outer[p.Name])
+
+		remote, err := s.fetchProcessorSummary(ctx, p, from, to)
+		switch {
+		case err != nil:
+			logrus.Errorf("Reconciliation could not fetch the summary of processor %s: %v", p.Name, err)
+			result.Status = models.ReconciliationUnavailable
+			result.Error = err.Error()
+		case remote == result.Local:
+			result.Remote = remote
+			result.Status = models.ReconciliationMatched
+		case remote.Between(low, high):
+			// Only payments at the edges differ, which the processor's clock
+			// may have put on the other side
+			logrus.Debugf("Reconciliation of processor %s differs only within %s of the window's edges", p.Name, s.config.ReconciliationClockSkew)
+			result.Remote = remote
+			result.Status = models.ReconciliationMatched
+		default:
+			result.Remote = remote
+			result.Delta = remote.Sub(result.Local)
+			result.Status = models.ReconciliationMismatch
+			if len(report.UnavailablePeers) > 0 {
+				result.Status = models.ReconciliationIncomplete
+				break
+			}
+			report.Discrepancies++
+			logrus.Errorf("Reconciliation mismatch for processor %s between %s and %s: processor minus local is %d requests, %s amount, %d refunds, %s refunded",
+				p.Name, from.Format(time.RFC3339), to.Format(time.RFC3339),
+				result.Delta.TotalRequests, result.Delta.TotalAmount, result.Delta.TotalRefunds, result.Delta.TotalRefundedAmount)
+		}
+		report.Processors = append(report.Processors, result)
+	}
+}
+
+// edgeSummaries returns the cluster summaries of [from, to] shrunk and
+// widened by RECONCILIATION_CLOCK_SKEW. The processors stamp payments on
+// their own clocks, so a payment settled near an edge may fall on the other
+// side of it there; whatever a processor reports then lies between the two.
+// Without a skew both are local.
+func (s *PaymentService) edgeSummaries(ctx context.Context, from, to time.Time, local models.PaymentSummary) (models.PaymentSummary, models.PaymentSummary) {
+	skew := s.config.ReconciliationClockSkew
+	if skew <= 0 {
+		return local, local
+	}
+
+	// Peers that did not answer are already reported by the exact summary
+	outerFrom, outerTo := from.Add(-skew), to.Add(skew)
+	outer, _ := s.GetClusterPaymentsSummary(ctx, &outerFrom, &outerTo)
+
+	// A window shorter than twice the skew may hold nothing at all
+	innerFrom, innerTo := from.Add(skew), to.Add(-skew)
+	if innerTo.Before(innerFrom) {
+		return models.PaymentSummary{}, outer
+	}
+	inner, _ := s.GetClusterPaymentsSummary(ctx, &innerFrom, &innerTo)
+	return inner, outer
+}
+
+// reconciliationTotals adds up every currency of summary, as the processors'
+// summaries do, so the two can be compared.
+func reconciliationTotals(summary models.ProcessorSummary) models.ReconciliationTotals {
+	totals := summary.AllCurrencies()
+	return models.ReconciliationTotals{
+		TotalRequests:       totals.TotalRequests,
+		TotalAmount:         totals.TotalAmount,
+		TotalRefunds:        totals.TotalRefunds,
+		TotalRefundedAmount: totals.TotalRefundedAmount,
+	}
+}
+
+// fetchProcessorSummary asks p for its GET /admin/payments-summary over
+// [from, to]. The processors add amounts up as floats, so they are rounded
+// back to cents. The fee rate the summary reports becomes p's fee.
+func (s *PaymentService) fetchProcessorSummary(ctx context.Context, p *Processor, from, to time.Time) (models.ReconciliationTotals, error) {
+	query := url.Values{}
+	query.Set("from", from.UTC().Format(time.RFC3339Nano))
+	query.Set("to", to.UTC().Format(time.RFC3339Nano))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", p.URL+"/admin/payments-summary?"+query.Encode(), nil)
+	if err != nil {
+		return models.ReconciliationTotals{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("X-Rinha-Token", p.AdminToken)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return models.ReconciliationTotals{}, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return models.ReconciliationTotals{}, fmt.Errorf("processor returned status %d", resp.StatusCode)
+	}
+
+	var summary struct {
+		TotalRequests       int     `json:"totalRequests"`
+		TotalAmount         float64 `json:"totalAmount"`
+		TotalRefunds        int     `json:"totalRefunds"`
+		TotalRefundedAmount float64 `json:"totalRefundedAmount"`
+		// In percent, as the bundled processors report it
+		FeePerTransaction *float64 `json:"feePerTransaction"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		return models.ReconciliationTotals{}, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if summary.FeePerTransaction != nil {
+		p.learnFee(*summary.FeePerTransaction)
+	}
+	return models.ReconciliationTotals{
+		TotalRequests:       summary.TotalRequests,
+		TotalAmount:         models.MoneyFromFloat(summary.TotalAmount),
+		TotalRefunds:        summary.TotalRefunds,
+		TotalRefundedAmount: models.MoneyFromFloat(summary.TotalRefundedAmount),
+	}, nil
+}
+
+func reconciliationHistory(cfg *config.Config) int {
+	if cfg.ReconciliationHistory > 0 {
+		return cfg.ReconciliationHistory
+	}
+	return defaultReconciliationHistory
+}
+
+func (s *PaymentService) reconciliationInterval() time.Duration {
+	if s.config.ReconciliationInterval > 0 {
+		return s.config.ReconciliationInterval
+	}
+	return defaultReconciliationInterval
+}
+
+func (s *PaymentService) reconciliationDelay() time.Duration {
+	if s.config.ReconciliationDelay > 0 {
+		return s.config.ReconciliationDelay
+	}
+	return defaultReconciliationDelay
+}
@@ -0,0 +1,351 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+	"th_payment_processor/internal/storage"
+)
+
+// newSummaryProcessor answers GET /admin/payments-summary with body when
+// called with token.
+func newSummaryProcessor(t *testing.T, token, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/payments-summary" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("X-Rinha-Token") != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// The processors parse the window as RFC3339
+		_, errFrom := time.Parse(time.RFC3339, r.URL.Query().Get("from"))
+		_, errTo := time.Parse(time.RFC3339, r.URL.Query().Get("to"))
+		if errFrom != nil || errTo != nil {
+			t.Errorf("Unexpected summary window: %q", r.URL.RawQuery)
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+func TestPaymentService_ReconcilePayments(t *testing.T) {
+	// Three payments of 0.10 summed as floats come to 0.30000000000000004
+	matching := newSummaryProcessor(t, "secret", `{"totalRequests":3,"totalAmount":0.30000000000000004,"totalFee":0,"feePerTransaction":0.05,"totalRefunds":1,"totalRefundedAmount":0.1}`)
+	defer matching.Close()
+	missing := newSummaryProcessor(t, "123", `{"totalRequests":2,"totalAmount":25.5,"totalRefunds":0,"totalRefundedAmount":0}`)
+	defer missing.Close()
+	locked := newSummaryProcessor(t, "other", `{}`)
+	defer locked.Close()
+
+	cfg := &config.Config{
+		RequestTimeout:      time.Second,
+		ProcessorAdminToken: "123",
+		Processors: []config.ProcessorConfig{
+			{Name: "default", URL: matching.URL, Priority: 1, AdminToken: "secret"},
+			{Name: "fallback", URL: missing.URL, Priority: 2},
+			{Name: "backup", URL: locked.URL, Priority: 3},
+		},
+	}
+	store := storage.NewInMemoryStorage()
+	service := NewPaymentService(cfg, store)
+
+	now := time.Now().UTC()
+	for i, id := range []string{"a", "b", "c"} {
+		record := models.NewPaymentRecord(id, 10, now.Add(-time.Duration(i+1)*time.Minute))
+		record.Processor = "default"
+		record.Success = true
+		if id == "a" {
+			record.SetRefund(models.Refund{Amount: 10, Processor: "default", Status: models.RefundStatusSucceeded, RefundedAt: now.Add(-30 * time.Second)})
+		}
+		store.StorePayment(record)
+	}
+	fallback := models.NewPaymentRecord("d", 1550, now.Add(-time.Minute))
+	fallback.Processor = "fallback"
+	fallback.Success = true
+	store.StorePayment(fallback)
+
+	from, to := now.Add(-time.Hour), now
+	report, err := service.ReconcilePayments(context.Background(), models.ReconciliationRequest{From: &from, To: &to})
+	if err != nil {
+		t.Fatalf("ReconcilePayments failed: %v", err)
+	}
+	if report.Trigger != reconciliationManual || !report.From.Equal(from) || !report.To.Equal(to) || len(report.Processors) != 3 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	byName := make(map[string]models.ProcessorReconciliation)
+	for _, result := range report.Processors {
+		byName[result.Processor] = result
+	}
+	if got := byName["default"]; got.Status != models.ReconciliationMatched || got.Remote.TotalAmount != 30 || got.Remote.TotalRefundedAmount != 10 {
+		t.Errorf("Expected default to match after rounding, got %+v", got)
+	}
+	want := models.ReconciliationTotals{TotalRequests: 1, TotalAmount: 1000}
+	if got := byName["fallback"]; got.Status != models.ReconciliationMismatch || got.Delta != want {
+		t.Errorf("Expected fallback to be missing one payment of 10.00, got %+v", got)
+	}
+	if got := byName["backup"]; got.Status != models.ReconciliationUnavailable || got.Error == "" {
+		t.Errorf("Expected backup to be unavailable with the wrong token, got %+v", got)
+	}
+	if report.Discrepancies != 1 {
+		t.Errorf("Expected 1 discrepancy, got %d", report.Discrepancies)
+	}
+
+	stored, err := service.GetReconciliation(report.ID)
+	if err != nil || stored.ID != report.ID {
+		t.Errorf("Expected the report to be kept, got %+v, %v", stored, err)
+	}
+
+	if _, err := service.ReconcilePayments(context.Background(), models.ReconciliationRequest{From: &to, To: &from}); !errors.Is(err, ErrInvalidReconciliationWindow) {
+		t.Errorf("Expected ErrInvalidReconciliationWindow, got %v", err)
+	}
+}
+
+func TestPaymentService_ReconciliationWindows(t *testing.T) {
+	processor := newSummaryProcessor(t, "123", `{"totalRequests":0,"totalAmount":0}`)
+	defer processor.Close()
+
+	cfg := &config.Config{
+		RequestTimeout:         time.Second,
+		ProcessorAdminToken:    "123",
+		Processors:             []config.ProcessorConfig{{Name: "default", URL: processor.URL}},
+		ReconciliationEnabled:  true,
+		ReconciliationInterval: 20 * time.Millisecond,
+		ReconciliationDelay:    time.Second,
+		ReconciliationHistory:  2,
+	}
+	service := NewPaymentService(cfg, storage.NewInMemoryStorage())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.StartReconciliation(ctx)
+
+	waitFor(t, "scheduled reconciliations", func() bool { return len(service.Reconciliations()) == 2 })
+	time.Sleep(60 * time.Millisecond)
+	cancel()
+
+	reports := service.Reconciliations()
+	if len(reports) != 2 {
+		t.Fatalf("Expected the history to keep 2 reports, got %d", len(reports))
+	}
+	if !reports[0].StartedAt.After(reports[1].StartedAt) {
+		t.Errorf("Expected newest report first")
+	}
+	for _, report := range reports {
+		if report.Trigger != reconciliationScheduled || report.To.Sub(report.From) != 20*time.Millisecond {
+			t.Errorf("Unexpected scheduled window: %+v", report)
+		}
+		if lag := report.StartedAt.Sub(report.To); lag < time.Second {
+			t.Errorf("Expected the window to end RECONCILIATION_DELAY ago, ended %s before the run", lag)
+		}
+	}
+}
+
+func TestPaymentService_ReconcileClockSkew(t *testing.T) {
+	processor := newSummaryProcessor(t, "123", `{"totalRequests":2,"totalAmount":20,"totalRefunds":0,"totalRefundedAmount":0}`)
+	defer processor.Close()
+
+	cfg := &config.Config{
+		RequestTimeout:          time.Second,
+		ProcessorAdminToken:     "123",
+		Processors:              []config.ProcessorConfig{{Name: "default", URL: processor.URL}},
+		ReconciliationClockSkew: time.Second,
+	}
+	store := storage.NewInMemoryStorage()
+	service := NewPaymentService(cfg, store)
+
+	// We stamped one payment just after the window that the processor's
+	// clock put inside it
+	to := time.Now().UTC().Truncate(time.Second).Add(-time.Minute)
+	from := to.Add(-time.Minute)
+	for id, at := range map[string]time.Time{"inside": to.Add(-10 * time.Second), "edge": to.Add(500 * time.Millisecond)} {
+		record := models.NewPaymentRecord(id, 1000, at)
+		record.Processor = "default"
+		record.Success = true
+		store.StorePayment(record)
+	}
+
+	report, err := service.ReconcilePayments(context.Background(), models.ReconciliationRequest{From: &from, To: &to})
+	if err != nil {
+		t.Fatalf("ReconcilePayments failed: %v", err)
+	}
+	if got := report.Processors[0]; got.Status != models.ReconciliationMatched || got.Local.TotalRequests != 1 || report.Discrepancies != 0 {
+		t.Errorf("Expected the edge payment to be tolerated, got %+v", got)
+	}
+
+	cfg.ReconciliationClockSkew = 0
+	report, _ = service.ReconcilePayments(context.Background(), models.ReconciliationRequest{From: &from, To: &to})
+	if got := report.Processors[0]; got.Status != models.ReconciliationMismatch || got.Delta.TotalRequests != 1 {
+		t.Errorf("Expected a mismatch without a skew, got %+v", got)
+	}
+
+	// A skew does not hide a payment the processor charged mid-window
+	cfg.ReconciliationClockSkew = time.Second
+	inside, _ := store.GetPaymentByCorrelationID("inside")
+	inside.Success = false
+	inside.Status = models.PaymentStatusFailed
+	store.StorePayment(inside)
+	report, _ = service.ReconcilePayments(context.Background(), models.ReconciliationRequest{From: &from, To: &to})
+	if got := report.Processors[0]; got.Status != models.ReconciliationMismatch {
+		t.Errorf("Expected a mismatch for a payment missing mid-window, got %+v", got)
+	}
+}
+
+// newLookupProcessor answers GET /payments/:id with the payment stored
+// under the ID, and fails the lookups of the IDs in failing.
+func newLookupProcessor(payments map[string]string, failing ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/payments/")
+		for _, failed := range failing {
+			if id == failed {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		body, ok := payments[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+func TestPaymentService_ReconcileRecords(t *testing.T) {
+	now := time.Now().UTC()
+	chargedAt := now.Add(-2 * time.Minute).Format(time.RFC3339Nano)
+
+	primary := newLookupProcessor(map[string]string{
+		"ok":       `{"amount":10,"refundedAmount":0}`,
+		"refunded": `{"amount":10,"refundedAmount":4}`,
+		"short":    `{"amount":9.99,"refundedAmount":0}`,
+	})
+	defer primary.Close()
+	secondary := newLookupProcessor(map[string]string{
+		"charged": `{"amount":10,"refundedAmount":0,"processedAt":"` + chargedAt + `"}`,
+	})
+	defer secondary.Close()
+	broken := newLookupProcessor(nil, "broken")
+	defer broken.Close()
+
+	cfg := &config.Config{
+		RequestTimeout: time.Second,
+		Processors: []config.ProcessorConfig{
+			{Name: "default", URL: primary.URL, Priority: 1},
+			{Name: "fallback", URL: secondary.URL, Priority: 2},
+			{Name: "backup", URL: broken.URL, Priority: 3},
+		},
+	}
+	store := storage.NewInMemoryStorage()
+	service := NewPaymentService(cfg, store)
+
+	charged := func(id, processor string) *models.PaymentRecord {
+		record := models.NewPaymentRecord(id, 1000, now.Add(-time.Minute))
+		record.Transition(models.PaymentStatusProcessing, now.Add(-time.Minute), "")
+		record.Transition(models.PaymentStatusSucceeded, now.Add(-time.Minute), "")
+		record.Processor = processor
+		return record
+	}
+	failed := func(id string) *models.PaymentRecord {
+		record := models.NewPaymentRecord(id, 1000, now.Add(-time.Minute))
+		record.Transition(models.PaymentStatusProcessing, now.Add(-time.Minute), "")
+		record.Transition(models.PaymentStatusFailed, now.Add(-time.Minute), "")
+		return record
+	}
+	refunded := charged("refunded", "default")
+	refunded.SetRefund(models.Refund{Amount: 400, Processor: "default", Status: models.RefundStatusSucceeded, RefundedAt: now})
+	for _, record := range []*models.PaymentRecord{
+		charged("ok", "default"),
+		refunded,
+		charged("gone", "default"),
+		charged("short", "default"),
+		charged("broken", "backup"),
+		failed("charged"),
+		failed("declined"),
+		models.NewPaymentRecord("pending", 1000, now.Add(-time.Minute)),
+	} {
+		store.StorePayment(record)
+	}
+
+	from, to := now.Add(-time.Hour), now
+	req := models.ReconciliationRequest{From: &from, To: &to, Mode: models.ReconciliationModeRecords}
+	report, err := service.ReconcilePayments(context.Background(), req)
+	if err != nil {
+		t.Fatalf("ReconcilePayments failed: %v", err)
+	}
+	if report.Mode != models.ReconciliationModeRecords || report.Records == nil || len(report.Processors) != 0 {
+		t.Fatalf("Unexpected report: %+v", report)
+	}
+
+	records := report.Records
+	want := map[models.RecordStatus]int{
+		// No processor charged the failed payment "declined"
+		models.RecordMatched:            3,
+		models.RecordMissingAtProcessor: 1,
+		models.RecordAmountMismatch:     1,
+		models.RecordUnknownLocally:     1,
+		models.RecordUnverified:         1,
+	}
+	if records.Checked != 7 || records.Repaired != 0 || len(records.Counts) != len(want) {
+		t.Errorf("Unexpected record reconciliation: %+v", records)
+	}
+	for status, count := range want {
+		if records.Counts[status] != count {
+			t.Errorf("Expected %d %s records, got %d", count, status, records.Counts[status])
+		}
+	}
+	if report.Discrepancies != 3 || len(records.Discrepancies) != 4 {
+		t.Errorf("Expected 3 discrepancies out of 4 listed records, got %d of %+v", report.Discrepancies, records.Discrepancies)
+	}
+	for _, d := range records.Discrepancies {
+		switch d.CorrelationID {
+		case "short":
+			if d.Remote == nil || d.Remote.Amount != 999 || d.Local.Amount != 1000 {
+				t.Errorf("Expected the amounts of the mismatch, got %+v", d)
+			}
+		case "charged":
+			if d.Status != models.RecordUnknownLocally || d.Processor != "fallback" || d.Repaired {
+				t.Errorf("Expected an unrepaired payment charged by fallback, got %+v", d)
+			}
+		case "broken":
+			if d.Status != models.RecordUnverified || d.Error == "" {
+				t.Errorf("Expected an unverified payment with the lookup error, got %+v", d)
+			}
+		}
+	}
+	if record, _ := store.GetPaymentByCorrelationID("charged"); record.Status != models.PaymentStatusFailed {
+		t.Errorf("Expected no repair unless asked, got %s", record.Status)
+	}
+
+	req.Repair = true
+	report, err = service.ReconcilePayments(context.Background(), req)
+	if err != nil || report.Records.Repaired != 1 {
+		t.Fatalf("Expected one repaired payment, got %+v, %v", report.Records, err)
+	}
+	record, _ := store.GetPaymentByCorrelationID("charged")
+	if record.Status != models.PaymentStatusSucceeded || !record.Success || record.Processor != "fallback" || record.ProcessedAt.Format(time.RFC3339Nano) != chargedAt {
+		t.Errorf("Expected the payment to succeed on fallback when it was charged, got %+v", record)
+	}
+	if summary := store.GetPaymentsSummary(&from, &to); summary["fallback"].TotalRequests != 1 {
+		t.Errorf("Expected the repaired payment in the summary, got %+v", summary)
+	}
+
+	req.Repair = false
+	report, _ = service.ReconcilePayments(context.Background(), req)
+	if report.Records.Counts[models.RecordUnknownLocally] != 0 || report.Records.Counts[models.RecordMatched] != 4 {
+		t.Errorf("Expected the repaired payment to match, got %+v", report.Records.Counts)
+	}
+
+	req.Mode = "ledger"
+	if _, err := service.ReconcilePayments(context.Background(), req); !errors.Is(err, ErrInvalidReconciliationMode) {
+		t.Errorf("Expected ErrInvalidReconciliationMode, got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"th_payment_processor/internal/models"
+)
+
+// reconciliationLookups bounds the payment lookups in flight during a
+// records mode run.
+const reconciliationLookups = 8
+
+// processorPayment is a payment as a processor's GET /payments/:id returns
+// it; the id may be our correlation ID.
+type processorPayment struct {
+	Amount         float64   `json:"amount"`
+	RefundedAmount float64   `json:"refundedAmount"`
+	ProcessedAt    time.Time `json:"processedAt"`
+	Fee            *float64  `json:"fee"`
+}
+
+// amounts rounds the processor's float amounts back to cents.
+func (p *processorPayment) amounts() models.RecordAmounts {
+	return models.RecordAmounts{
+		Amount:         models.MoneyFromFloat(p.Amount),
+		RefundedAmount: models.MoneyFromFloat(p.RefundedAmount),
+	}
+}
+
+// recordCheck is the outcome of looking up one local payment. processor is
+// the one that answered, or the one that could not be asked.
+type recordCheck struct {
+	record    *models.PaymentRecord
+	status    models.RecordStatus
+	processor string
+	remote    *processorPayment
+	err       error
+}
+
+// reconcileRecords looks up every payment of this instance settled within
+// the report's window at the processors. Payments still pending, retrying
+// or held are skipped as they may yet change. With repair, a failed payment
+// a processor confirms is marked succeeded on that processor.
+func (s *PaymentService) reconcileRecords(ctx context.Context, report *models.ReconciliationReport, repair bool) {
+	report.Records = &models.RecordReconciliation{
+		Counts:        make(map[models.RecordStatus]int),
+		Discrepancies: []models.RecordDiscrepancy{},
+	}
+
+	query := models.PaymentQuery{
+		Statuses: []models.PaymentStatus{
+			models.PaymentStatusSucceeded,
+			models.PaymentStatusPartiallyRefunded,
+			models.PaymentStatusRefunded,
+			models.PaymentStatusFailed,
+		},
+		ProcessedFrom: &report.From,
+		ProcessedTo:   &report.To,
+		Limit:         models.MaxPageSize,
+	}
+	for {
+		page, err := s.storage.ListPayments(query)
+		if err != nil {
+			logrus.Errorf("Reconciliation could not list payments: %v", err)
+			return
+		}
+		for _, check := range s.checkRecords(ctx, page.Payments) {
+			s.addRecordCheck(report, check, repair)
+		}
+		if page.NextCursor == "" || ctx.Err() != nil {
+			return
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+// checkRecords looks up records concurrently, returning the checks in the
+// same order.
+func (s *PaymentService) checkRecords(ctx context.Context, records []*models.PaymentRecord) []recordCheck {
+	checks := make([]recordCheck, len(records))
+	sem := make(chan struct{}, reconciliationLookups)
+	var wg sync.WaitGroup
+	for i, record := range records {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, record *models.PaymentRecord) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			checks[i] = s.checkRecord(ctx, record)
+		}(i, record)
+	}
+	wg.Wait()
+	return checks
+}
+
+// checkRecord looks a charged payment up at its processor. A failed payment
+// is looked up at every processor, since any of them may have charged it
+// after we gave up waiting.
+func (s *PaymentService) checkRecord(ctx context.Context, record *models.PaymentRecord) recordCheck {
+	check := recordCheck{record: record, processor: record.Processor}
+
+	if record.Status != models.PaymentStatusFailed {
+		remote, err := s.lookupProcessorPayment(ctx, record.Processor, record.CorrelationID)
+		switch {
+		case err != nil:
+			check.status = models.RecordUnverified
+			check.err = err
+		case remote == nil:
+			check.status = models.RecordMissingAtProcessor
+		case remote.amounts() != recordAmounts(record):
+			check.status = models.RecordAmountMismatch
+			check.remote = remote
+		default:
+			check.status = models.RecordMatched
+			check.remote = remote
+		}
+		return check
+	}
+
+	check.status = models.RecordMatched
+	for _, p := range s.processors.All() {
+		remote, err := s.lookupProcessorPayment(ctx, p.Name, record.CorrelationID)
+		switch {
+		case err != nil:
+			check.status = models.RecordUnverified
+			check.processor = p.Name
+			check.err = err
+		case remote != nil:
+			return recordCheck{record: record, status: models.RecordUnknownLocally, processor: p.Name, remote: remote}
+		}
+	}
+	return check
+}
+
+// addRecordCheck counts check into the report, repairing the payment when
+// asked and a processor confirmed it.
+func (s *PaymentService) addRecordCheck(report *models.ReconciliationReport, check recordCheck, repair bool) {
+	result := report.Records
+	result.Checked++
+	result.Counts[check.status]++
+	if check.status == models.RecordMatched {
+		return
+	}
+
+	discrepancy := models.RecordDiscrepancy{
+		CorrelationID: check.record.CorrelationID,
+		Status:        check.status,
+		LocalStatus:   check.record.Status,
+		Processor:     check.processor,
+		Local:         recordAmounts(check.record),
+	}
+	if check.remote != nil {
+		remote := check.remote.amounts()
+		discrepancy.Remote = &remote
+	}
+
+	switch {
+	case check.err != nil:
+		logrus.Errorf("Reconciliation could not verify payment %s at processor %s: %v", check.record.CorrelationID, check.processor, check.err)
+		discrepancy.Error = check.err.Error()
+	default:
+		report.Discrepancies++
+		logrus.Errorf("Reconciliation found payment %s %s at processor %s", check.record.CorrelationID, check.status, check.processor)
+	}
+
+	if repair && check.status == models.RecordUnknownLocally && s.repairPayment(check) {
+		discrepancy.Repaired = true
+		result.Repaired++
+	}
+
+	if len(result.Discrepancies) >= models.MaxRecordDiscrepancies {
+		result.Truncated = true
+		return
+	}
+	result.Discrepancies = append(result.Discrepancies, discrepancy)
+}
+
+// repairPayment marks a failed payment succeeded on the processor that
+// charged it, unless it changed since it was looked up.
+func (s *PaymentService) repairPayment(check recordCheck) bool {
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+
+	record, ok := s.storage.GetPaymentByCorrelationID(check.record.CorrelationID)
+	if !ok || record.Status != models.PaymentStatusFailed {
+		return false
+	}
+
+	record.Processor = check.processor
+	// Count the payment when the processor charged it
+	if !check.remote.ProcessedAt.IsZero() {
+		record.ProcessedAt = check.remote.ProcessedAt
+	}
+	s.applyFee(record, check.remote.Fee)
+	s.transition(record, models.PaymentStatusSucceeded, "confirmed by "+check.processor+" during reconciliation")
+	return s.savePayment(record) == nil
+}
+
+func recordAmounts(record *models.PaymentRecord) models.RecordAmounts {
+	return models.RecordAmounts{Amount: record.Amount, RefundedAmount: record.RefundedAmount}
+}
@@ -0,0 +1,274 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"th_payment_processor/internal/models"
+)
+
+var (
+	// ErrPaymentNotFound is returned for an unknown correlation ID.
+	ErrPaymentNotFound = errors.New("payment not found")
+	// ErrPaymentNotRefundable is returned when the payment was never charged
+	// or has already been refunded in full.
+	ErrPaymentNotRefundable = errors.New("payment cannot be refunded in its current status")
+	// ErrRefundExceedsPayment is returned when the refund is larger than what
+	// is left of the payment.
+	ErrRefundExceedsPayment = errors.New("refund exceeds the refundable amount")
+	// ErrRefundFailed is returned when the processor did not reverse the payment.
+	ErrRefundFailed = errors.New("processor did not refund the payment")
+	// ErrRefundPending is returned when the processor could not be heard
+	// from. The refund stays pending and is resent until it answers.
+	ErrRefundPending = errors.New("refund outcome is not known yet")
+
+	errUnknownProcessor = errors.New("unknown processor")
+)
+
+const defaultRefundRetryInterval = 30 * time.Second
+
+// RefundPayment reverses amount of a charged payment through the processor
+// that charged it; a zero amount refunds whatever is left. The refund is
+// stored as pending before the processor is called, so concurrent refunds
+// can never add up to more than the payment. On ErrRefundFailed and
+// ErrRefundPending the refund is returned alongside the error.
+func (s *PaymentService) RefundPayment(ctx context.Context, correlationID string, amount models.Money) (*models.Refund, error) {
+	tracer := otel.Tracer("payment-service")
+	ctx, span := tracer.Start(ctx, "RefundPayment")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("payment.correlation_id", correlationID))
+
+	refund, err := s.reserveRefund(correlationID, amount)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(
+		attribute.String("refund.id", refund.ID.String()),
+		attribute.Float64("refund.amount", refund.Amount.Float64()),
+		attribute.String("refund.processor", refund.Processor),
+	)
+
+	// The client going away must not leave the refund half-recorded; the
+	// processor client's timeout still bounds the call
+	sendErr := s.sendRefund(context.WithoutCancel(ctx), correlationID, refund)
+
+	refund, err = s.finishRefund(correlationID, refund, sendErr)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return refund, err
+}
+
+// finishRefund records the processor's answer to refund. Only a status the
+// processor answered with fails it; when the request timed out or broke off
+// the processor may have refunded anyway, so the refund stays pending, its
+// amount still reserved, for StartRefundRetries to resend. A refund that is
+// no longer pending, settled meanwhile by a retry, is returned as stored.
+func (s *PaymentService) finishRefund(correlationID string, refund *models.Refund, sendErr error) (*models.Refund, error) {
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+
+	record, ok := s.storage.GetPaymentByCorrelationID(correlationID)
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+	stored, ok := findRefund(record, refund.ID)
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+	if stored.Status != models.RefundStatusPending {
+		if stored.Status == models.RefundStatusFailed {
+			return &stored, fmt.Errorf("%w: %s", ErrRefundFailed, stored.Error)
+		}
+		return &stored, nil
+	}
+	refund = &stored
+
+	if !settleRefund(refund, sendErr) {
+		logrus.Warnf("Refund %s of payment %s has no answer yet, keeping it pending: %v", refund.ID, correlationID, sendErr)
+		record.SetRefund(*refund)
+		s.savePayment(record)
+		return refund, fmt.Errorf("%w: %v", ErrRefundPending, sendErr)
+	}
+	record.SetRefund(*refund)
+
+	if refund.Status == models.RefundStatusFailed {
+		logrus.Errorf("Refund %s of payment %s failed: %v", refund.ID, correlationID, sendErr)
+		s.savePayment(record)
+		return refund, fmt.Errorf("%w: %v", ErrRefundFailed, sendErr)
+	}
+	if refund.Duplicate {
+		logrus.Infof("Refunded the duplicate charge of payment %s on %s", correlationID, refund.Processor)
+		return refund, s.savePayment(record)
+	}
+
+	status := models.PaymentStatusPartiallyRefunded
+	if record.RefundedAmount >= record.Amount {
+		status = models.PaymentStatusRefunded
+	}
+	s.transition(record, status, fmt.Sprintf("refunded %s via %s", refund.Amount, refund.Processor))
+	if err := s.savePayment(record); err != nil {
+		return refund, err
+	}
+
+	logrus.Infof("Refunded %s of payment %s via %s", refund.Amount, correlationID, refund.Processor)
+	return refund, nil
+}
+
+// settleRefund records the processor's answer on refund and reports whether
+// the outcome is known. Only an answer from the processor fails a refund;
+// when the request timed out or broke off the refund stays pending.
+func settleRefund(refund *models.Refund, sendErr error) bool {
+	switch {
+	case sendErr == nil:
+		refund.Status = models.RefundStatusSucceeded
+		refund.RefundedAt = time.Now()
+		refund.Error = ""
+	case refundRejected(sendErr):
+		refund.Status = models.RefundStatusFailed
+		refund.Error = sendErr.Error()
+	default:
+		refund.Error = sendErr.Error()
+		return false
+	}
+	return true
+}
+
+// refundRejected reports whether err is a definite no: the processor
+// answered with an error status, or there was no processor to ask.
+func refundRejected(err error) bool {
+	var statusErr *processorStatusError
+	return errors.As(err, &statusErr) || errors.Is(err, errUnknownProcessor)
+}
+
+func findRefund(record *models.PaymentRecord, id uuid.UUID) (models.Refund, bool) {
+	for _, refund := range record.Refunds {
+		if refund.ID == id {
+			return refund, true
+		}
+	}
+	return models.Refund{}, false
+}
+
+// StartRefundRetries resends pending refunds every REFUND_RETRY_INTERVAL
+// until ctx is cancelled.
+func (s *PaymentService) StartRefundRetries(ctx context.Context) {
+	interval := s.config.RefundRetryInterval
+	if interval <= 0 {
+		interval = defaultRefundRetryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if settled := s.retryPendingRefunds(ctx, time.Now()); settled > 0 {
+				logrus.Infof("Settled %d pending refunds", settled)
+			}
+		}
+	}
+}
+
+// retryPendingRefunds resends every refund that has been pending for longer
+// than its processor's timeout, so requests still in flight are left
+// alone. The refund keeps its ID, which the processor uses to recognise a
+// refund it already made. It returns how many refunds were settled.
+func (s *PaymentService) retryPendingRefunds(ctx context.Context, now time.Time) int {
+	type pendingRefund struct {
+		correlationID string
+		refund        models.Refund
+	}
+	var pending []pendingRefund
+	for _, record := range s.storage.GetAllPayments() {
+		for _, refund := range record.Refunds {
+			if refund.Status != models.RefundStatusPending {
+				continue
+			}
+			if p, ok := s.processors.Get(refund.Processor); ok && now.Sub(refund.RequestedAt) < p.Timeout {
+				continue
+			}
+			pending = append(pending, pendingRefund{correlationID: record.CorrelationID, refund: refund})
+		}
+	}
+
+	settled := 0
+	for _, candidate := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		refund := candidate.refund
+		sendErr := s.sendRefund(ctx, candidate.correlationID, &refund)
+		if _, err := s.finishRefund(candidate.correlationID, &refund, sendErr); !errors.Is(err, ErrRefundPending) {
+			settled++
+		}
+	}
+	return settled
+}
+
+// reserveRefund validates the refund against the payment and stores it as
+// pending, taking its amount out of what is left to refund.
+func (s *PaymentService) reserveRefund(correlationID string, amount models.Money) (*models.Refund, error) {
+	s.recordMu.Lock()
+	defer s.recordMu.Unlock()
+
+	record, ok := s.storage.GetPaymentByCorrelationID(correlationID)
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+
+	remaining := record.RefundableAmount()
+	if !record.Status.IsCharged() || remaining <= 0 {
+		return nil, ErrPaymentNotRefundable
+	}
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount > remaining {
+		return nil, fmt.Errorf("%w: %s left", ErrRefundExceedsPayment, remaining)
+	}
+	if err := record.Currency.OrDefault().ValidateAmount(amount); err != nil {
+		return nil, err
+	}
+
+	refund := &models.Refund{
+		ID:          uuid.New(),
+		Amount:      amount,
+		Processor:   record.Processor,
+		Status:      models.RefundStatusPending,
+		RequestedAt: time.Now(),
+	}
+	record.SetRefund(*refund)
+	if err := s.savePayment(record); err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// sendRefund asks the processor that charged the payment to reverse refund.
+func (s *PaymentService) sendRefund(ctx context.Context, correlationID string, refund *models.Refund) error {
+	p, ok := s.processors.Get(refund.Processor)
+	if !ok {
+		return fmt.Errorf("%w: %s", errUnknownProcessor, refund.Processor)
+	}
+
+	path := "/payments/" + url.PathEscape(correlationID) + "/refunds"
+	return s.postProcessor(ctx, p, path, models.ProcessorRefundRequest{
+		RefundID:    refund.ID,
+		Amount:      refund.Amount,
+		RequestedAt: refund.RequestedAt,
+	}, nil)
+}
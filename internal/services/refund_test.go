@@ -0,0 +1,156 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+)
+
+// newRefundingProcessor accepts payments and refunds; once failRefunds is set
+// every refund is rejected.
+func newRefundingProcessor(t *testing.T, refunds *atomic.Int32, failRefunds *atomic.Bool) *httptest.Server {
+	return newFakeProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/refunds") {
+			w.Write([]byte(`{"message":"payment processed successfully"}`))
+			return
+		}
+		if failRefunds.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		refunds.Add(1)
+		w.Write([]byte(`{}`))
+	})
+}
+
+func TestPaymentService_RefundPayment(t *testing.T) {
+	var refunds atomic.Int32
+	var failRefunds atomic.Bool
+	processor := newRefundingProcessor(t, &refunds, &failRefunds)
+	service := newTestService(processor.URL)
+	ctx := context.Background()
+
+	if _, err := service.RefundPayment(ctx, "refund-me", 0); !errors.Is(err, ErrPaymentNotFound) {
+		t.Errorf("Expected ErrPaymentNotFound, got %v", err)
+	}
+	if _, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "refund-me", Amount: 1000}); err != nil {
+		t.Fatalf("Payment failed: %v", err)
+	}
+
+	partial, err := service.RefundPayment(ctx, "refund-me", 300)
+	if err != nil || partial.Status != models.RefundStatusSucceeded || partial.Processor != "default" {
+		t.Fatalf("Expected partial refund through default, got %+v, %v", partial, err)
+	}
+	if _, err := service.RefundPayment(ctx, "refund-me", 800); !errors.Is(err, ErrRefundExceedsPayment) {
+		t.Errorf("Expected ErrRefundExceedsPayment, got %v", err)
+	}
+
+	failRefunds.Store(true)
+	failed, err := service.RefundPayment(ctx, "refund-me", 200)
+	if !errors.Is(err, ErrRefundFailed) || failed.Status != models.RefundStatusFailed {
+		t.Errorf("Expected a failed refund, got %+v, %v", failed, err)
+	}
+	failRefunds.Store(false)
+
+	// A failed refund gives its amount back, so the rest is still 700
+	rest, err := service.RefundPayment(ctx, "refund-me", 0)
+	if err != nil || rest.Amount != 700 {
+		t.Fatalf("Expected the remaining 700 to be refunded, got %+v, %v", rest, err)
+	}
+	if _, err := service.RefundPayment(ctx, "refund-me", 0); !errors.Is(err, ErrPaymentNotRefundable) {
+		t.Errorf("Expected ErrPaymentNotRefundable once fully refunded, got %v", err)
+	}
+
+	record, _ := service.GetPayment("refund-me")
+	if record.Status != models.PaymentStatusRefunded || record.RefundedAmount != 1000 || len(record.Refunds) != 3 {
+		t.Errorf("Unexpected record after refunds: %+v", record)
+	}
+	if got := refunds.Load(); got != 2 {
+		t.Errorf("Expected two refunds at the processor, got %d", got)
+	}
+
+	summary := service.GetPaymentsSummary(nil, nil)
+	if got := summary["default"]; got.TotalAmount != 1000 || got.TotalRefunds != 2 || got.TotalRefundedAmount != 1000 {
+		t.Errorf("Unexpected summary after refunds: %+v", got)
+	}
+}
+
+func TestPaymentService_RefundRequiresChargedPayment(t *testing.T) {
+	service := newTestService("http://localhost:8001")
+
+	if err := service.EnqueuePayment(&models.PaymentRequest{CorrelationID: "queued", Amount: 1000}); err != nil {
+		t.Fatalf("Expected payment to be queued, got %v", err)
+	}
+	if _, err := service.RefundPayment(context.Background(), "queued", 0); !errors.Is(err, ErrPaymentNotRefundable) {
+		t.Errorf("Expected ErrPaymentNotRefundable for a pending payment, got %v", err)
+	}
+}
+
+func TestPaymentService_RefundTimeoutStaysPending(t *testing.T) {
+	// The processor refunds but answers too late the first time; it
+	// recognises the refund by its ID when it is resent
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	processor := newFakeProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/refunds") {
+			w.Write([]byte(`{"message":"payment processed successfully"}`))
+			return
+		}
+		var req models.ProcessorRefundRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		seen[req.RefundID.String()]++
+		first := seen[req.RefundID.String()] == 1
+		mu.Unlock()
+		if first {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte(`{}`))
+	})
+
+	service := newTestService(processor.URL, func(cfg *config.Config) { cfg.RequestTimeout = 100 * time.Millisecond })
+	ctx := context.Background()
+
+	if _, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "slow-refund", Amount: 1000}); err != nil {
+		t.Fatalf("Payment failed: %v", err)
+	}
+	pending, err := service.RefundPayment(ctx, "slow-refund", 400)
+	if !errors.Is(err, ErrRefundPending) || pending.Status != models.RefundStatusPending {
+		t.Fatalf("Expected the timed out refund to stay pending, got %+v, %v", pending, err)
+	}
+	// The pending amount stays reserved
+	if _, err := service.RefundPayment(ctx, "slow-refund", 700); !errors.Is(err, ErrRefundExceedsPayment) {
+		t.Errorf("Expected the pending refund to hold its amount, got %v", err)
+	}
+
+	// Too recent to resend while the first request may still be in flight
+	if settled := service.retryPendingRefunds(ctx, pending.RequestedAt); settled != 0 {
+		t.Errorf("Expected a fresh pending refund to be left alone, settled %d", settled)
+	}
+	if settled := service.retryPendingRefunds(ctx, time.Now().Add(time.Second)); settled != 1 {
+		t.Fatalf("Expected the pending refund to be settled, settled %d", settled)
+	}
+
+	record, _ := service.GetPayment("slow-refund")
+	if len(record.Refunds) != 1 || record.Refunds[0].Status != models.RefundStatusSucceeded || record.RefundedAmount != 400 {
+		t.Errorf("Expected the resent refund to succeed, got %+v", record.Refunds)
+	}
+	if record.Status != models.PaymentStatusPartiallyRefunded {
+		t.Errorf("Expected a partially refunded payment, got %s", record.Status)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 1 || seen[pending.ID.String()] != 2 {
+		t.Errorf("Expected the refund to be resent under the same ID, got %v", seen)
+	}
+}
@@ -0,0 +1,194 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+)
+
+// Processor is a payment processor known to the registry, along with its
+// live health state.
+type Processor struct {
+	Name          string
+	URL           string
+	Priority      int
+	FeePercentage float64
+	Timeout       time.Duration
+	AdminToken    string
+
+	client  *http.Client
+	breaker *CircuitBreaker
+
+	healthMu sync.RWMutex
+	health   models.ProcessorHealth
+
+	// Rate limiting for health checks
+	healthCheckMu   sync.Mutex
+	lastHealthCheck time.Time
+
+	// Smoothed latency of successful payment calls
+	latencyMu sync.Mutex
+	latency   time.Duration
+
+	// Fee rate in percent; FeePercentage until the processor reports its own
+	feeMu sync.RWMutex
+	fee   float64
+}
+
+// latencyAlpha weights the newest sample in the latency moving average.
+const latencyAlpha = 0.2
+
+func (p *Processor) observeLatency(d time.Duration) {
+	p.latencyMu.Lock()
+	defer p.latencyMu.Unlock()
+	if p.latency == 0 {
+		p.latency = d
+		return
+	}
+	p.latency = time.Duration(latencyAlpha*float64(d) + (1-latencyAlpha)*float64(p.latency))
+}
+
+// Latency returns the moving average latency of successful payment calls,
+// or zero before the first one.
+func (p *Processor) Latency() time.Duration {
+	p.latencyMu.Lock()
+	defer p.latencyMu.Unlock()
+	return p.latency
+}
+
+// Fee returns the processor's fee rate in percent, as its admin summary
+// last reported it or else as configured.
+func (p *Processor) Fee() float64 {
+	p.feeMu.RLock()
+	defer p.feeMu.RUnlock()
+	return p.fee
+}
+
+// learnFee records the fee rate the processor reported.
+func (p *Processor) learnFee(percent float64) {
+	p.feeMu.Lock()
+	defer p.feeMu.Unlock()
+	if percent != p.fee {
+		logrus.Infof("%s processor fee rate is %.2f%%, was %.2f%%", p.Name, percent, p.fee)
+		p.fee = percent
+	}
+}
+
+// Health returns a snapshot of the processor's health.
+func (p *Processor) Health() models.ProcessorHealth {
+	p.healthMu.RLock()
+	defer p.healthMu.RUnlock()
+	return p.health
+}
+
+// CircuitState returns the state of the processor's circuit breaker.
+func (p *Processor) CircuitState() CircuitState {
+	return p.breaker.State()
+}
+
+// available combines the polled health with the live circuit breaker.
+func (p *Processor) available() bool {
+	p.healthMu.RLock()
+	healthy := p.health.IsHealthy && !p.health.Failing
+	p.healthMu.RUnlock()
+	return healthy && p.breaker.State() != CircuitOpen
+}
+
+// ErrDuplicateProcessorName is returned for a processor list that uses a
+// name twice.
+var ErrDuplicateProcessorName = errors.New("processor name is used more than once")
+
+// ProcessorRegistry holds every configured processor, ordered by priority.
+type ProcessorRegistry struct {
+	processors []*Processor
+	byName     map[string]*Processor
+}
+
+// NewProcessorRegistry builds the registry from cfg.Processors, or from the
+// default/fallback URLs when no processor list is configured. Payments,
+// summaries and breakers are all keyed by name, so a name used twice fails
+// with ErrDuplicateProcessorName; the registry returned alongside keeps the
+// first processor of each name.
+func NewProcessorRegistry(cfg *config.Config) (*ProcessorRegistry, error) {
+	configs := cfg.Processors
+	if len(configs) == 0 {
+		configs = []config.ProcessorConfig{
+			{Name: "default", URL: cfg.DefaultProcessorURL, Priority: 1, FeePercentage: cfg.DefaultProcessorFee},
+			{Name: "fallback", URL: cfg.FallbackProcessorURL, Priority: 2, FeePercentage: cfg.FallbackProcessorFee},
+		}
+	}
+
+	breakerSettings := circuitBreakerSettings(cfg)
+
+	registry := &ProcessorRegistry{
+		byName: make(map[string]*Processor, len(configs)),
+	}
+	var err error
+	for _, pc := range configs {
+		if _, exists := registry.byName[pc.Name]; exists {
+			err = fmt.Errorf("%w: %q at %s", ErrDuplicateProcessorName, pc.Name, pc.URL)
+			continue
+		}
+		timeout := pc.Timeout
+		if timeout <= 0 {
+			timeout = cfg.RequestTimeout
+		}
+		adminToken := pc.AdminToken
+		if adminToken == "" {
+			adminToken = cfg.ProcessorAdminToken
+		}
+		processor := &Processor{
+			Name:          pc.Name,
+			URL:           strings.TrimRight(pc.URL, "/"),
+			Priority:      pc.Priority,
+			FeePercentage: pc.FeePercentage,
+			Timeout:       timeout,
+			AdminToken:    adminToken,
+			fee:           pc.FeePercentage,
+			client: &http.Client{
+				Timeout:   timeout,
+				Transport: otelhttp.NewTransport(http.DefaultTransport),
+			},
+			breaker: NewCircuitBreaker(pc.Name, breakerSettings),
+			health: models.ProcessorHealth{
+				IsHealthy: true,
+				LastCheck: time.Now(),
+			},
+		}
+		registry.processors = append(registry.processors, processor)
+		registry.byName[processor.Name] = processor
+	}
+
+	sort.SliceStable(registry.processors, func(i, j int) bool {
+		return registry.processors[i].Priority < registry.processors[j].Priority
+	})
+	return registry, err
+}
+
+func (r *ProcessorRegistry) Get(name string) (*Processor, bool) {
+	processor, ok := r.byName[name]
+	return processor, ok
+}
+
+// All returns the processors in priority order.
+func (r *ProcessorRegistry) All() []*Processor {
+	return r.processors
+}
+
+// Names returns the processor names in priority order.
+func (r *ProcessorRegistry) Names() []string {
+	names := make([]string, len(r.processors))
+	for i, processor := range r.processors {
+		names[i] = processor.Name
+	}
+	return names
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+	"th_payment_processor/internal/storage"
+)
+
+func TestPaymentService_RoutesAcrossConfiguredProcessors(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	working := newFlakyProcessor(t, 0)
+
+	cfg := &config.Config{
+		RequestTimeout: time.Second,
+		Processors: []config.ProcessorConfig{
+			{Name: "secondary", URL: working.URL, Priority: 2},
+			{Name: "primary", URL: failing.URL, Priority: 1},
+			{Name: "tertiary", URL: working.URL, Priority: 3},
+		},
+	}
+
+	store := storage.NewInMemoryStorage()
+	service := NewPaymentService(cfg, store)
+
+	if names := service.processors.Names(); names[0] != "primary" || names[1] != "secondary" || names[2] != "tertiary" {
+		t.Fatalf("Expected processors in priority order, got %v", names)
+	}
+
+	record, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "n-way", Amount: 1000})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if record.Processor != "secondary" {
+		t.Errorf("Expected secondary processor after primary failed, got %s", record.Processor)
+	}
+
+	summary := service.GetPaymentsSummary(nil, nil)
+	if len(summary) != 3 {
+		t.Errorf("Expected every processor in the summary, got %v", summary)
+	}
+	if summary["secondary"].TotalRequests != 1 || summary["secondary"].TotalAmount != 1000 {
+		t.Errorf("Unexpected secondary summary: %+v", summary["secondary"])
+	}
+}
+
+func TestNewProcessorRegistry_RejectsDuplicateNames(t *testing.T) {
+	cfg := &config.Config{
+		RequestTimeout: time.Second,
+		Processors: []config.ProcessorConfig{
+			{Name: "primary", URL: "http://first", Priority: 1},
+			{Name: "primary", URL: "http://second", Priority: 0},
+			{Name: "secondary", URL: "http://third", Priority: 2},
+		},
+	}
+
+	registry, err := NewProcessorRegistry(cfg)
+	if !errors.Is(err, ErrDuplicateProcessorName) {
+		t.Errorf("Expected ErrDuplicateProcessorName, got %v", err)
+	}
+	if names := registry.Names(); len(names) != 2 || names[0] != "primary" || names[1] != "secondary" {
+		t.Fatalf("Expected the duplicate to be skipped, got %v", names)
+	}
+	if p, _ := registry.Get("primary"); p.URL != "http://first" {
+		t.Errorf("Expected the first primary to be kept, got %s", p.URL)
+	}
+}
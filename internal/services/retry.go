@@ -0,0 +1,367 @@
+package services
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"th_payment_processor/internal/models"
+)
+
+const (
+	defaultRetryMaxAttempts = 5
+	defaultRetryBaseDelay   = 1 * time.Second
+	defaultRetryMaxDelay    = 30 * time.Second
+	defaultRetryDeadline    = 5 * time.Minute
+)
+
+type retryItem struct {
+	req      *models.PaymentRequest
+	record   *models.PaymentRecord
+	due      time.Time
+	deadline time.Time
+	// verify is set for a payment recovered mid-attempt, which is looked up
+	// at the processors before it is sent again
+	verify bool
+}
+
+// retryQueue is a min-heap of pending retries ordered by due time.
+type retryQueue []*retryItem
+
+func (q retryQueue) Len() int            { return len(q) }
+func (q retryQueue) Less(i, j int) bool  { return q[i].due.Before(q[j].due) }
+func (q retryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *retryQueue) Push(x interface{}) { *q = append(*q, x.(*retryItem)) }
+func (q *retryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
+
+type retryScheduler struct {
+	mu    sync.Mutex
+	items retryQueue
+	wake  chan struct{}
+}
+
+func newRetryScheduler() *retryScheduler {
+	return &retryScheduler{
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (r *retryScheduler) push(item *retryItem) {
+	r.mu.Lock()
+	heap.Push(&r.items, item)
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// popDue removes every item due at or before now and reports how long to
+// wait for the next one.
+func (r *retryScheduler) popDue(now time.Time) ([]*retryItem, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []*retryItem
+	for r.items.Len() > 0 && !r.items[0].due.After(now) {
+		due = append(due, heap.Pop(&r.items).(*retryItem))
+	}
+
+	wait := time.Minute
+	if r.items.Len() > 0 {
+		wait = r.items[0].due.Sub(now)
+	}
+	return due, wait
+}
+
+// PendingRetries returns the number of payments waiting for another attempt.
+func (s *PaymentService) PendingRetries() int {
+	s.retries.mu.Lock()
+	defer s.retries.mu.Unlock()
+	return s.retries.items.Len()
+}
+
+// RecoverRetries queues the payments a previous run left pending, in flight
+// or waiting for a retry, since the queue and the retries lived in memory.
+// Each keeps the deadline it started with. A payment that was in flight may
+// have been charged by the interrupted attempt, so it is looked up at the
+// processors before it is sent again. Call it before payments are accepted.
+func (s *PaymentService) RecoverRetries() int {
+	query := models.PaymentQuery{
+		Statuses: []models.PaymentStatus{
+			models.PaymentStatusPending,
+			models.PaymentStatusProcessing,
+			models.PaymentStatusRetryScheduled,
+		},
+		Limit: models.MaxPageSize,
+	}
+	now := time.Now()
+	recovered := 0
+	for {
+		page, err := s.storage.ListPayments(query)
+		if err != nil {
+			logrus.Errorf("Could not list the payments to recover: %v", err)
+			break
+		}
+		for _, record := range page.Payments {
+			// Holds are settled by the authorization loop, never charged here
+			if record.Authorization != nil {
+				continue
+			}
+			item := &retryItem{
+				req:      &models.PaymentRequest{CorrelationID: record.CorrelationID, Amount: record.Amount, Currency: record.Currency},
+				record:   record,
+				due:      now,
+				deadline: record.ProcessedAt.Add(s.retryDeadline()),
+				verify:   record.Status == models.PaymentStatusProcessing,
+			}
+			if record.Status == models.PaymentStatusRetryScheduled && now.After(item.deadline) {
+				s.markPermanentlyFailed(record, "retry deadline exceeded during a restart")
+				continue
+			}
+			s.retries.push(item)
+			recovered++
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if recovered > 0 {
+		logrus.Infof("Recovered %d unfinished payments", recovered)
+	}
+	return recovered
+}
+
+// StartRetryScheduler re-attempts failed payments as they come due until ctx
+// is cancelled.
+func (s *PaymentService) StartRetryScheduler(ctx context.Context) {
+	sem := make(chan struct{}, s.workerCount())
+
+	for {
+		due, wait := s.retries.popDue(time.Now())
+		for _, item := range due {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(item *retryItem) {
+				defer func() { <-sem }()
+				s.retryPayment(ctx, item)
+			}(item)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.retries.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// scheduleRetry queues a failed payment for another attempt, or marks it
+// permanently failed once the attempt budget or deadline is exhausted.
+// Either way the record is stored in its new state.
+func (s *PaymentService) scheduleRetry(req *models.PaymentRequest, record *models.PaymentRecord, cause string) {
+	s.scheduleRetryItem(&retryItem{
+		req:      req,
+		record:   record,
+		deadline: record.ProcessedAt.Add(s.retryDeadline()),
+	}, cause)
+}
+
+func (s *PaymentService) scheduleRetryItem(item *retryItem, cause string) {
+	if item.record.Attempts >= s.retryMaxAttempts() {
+		s.markPermanentlyFailed(item.record, fmt.Sprintf("exhausted %d attempts: %s", item.record.Attempts, cause))
+		return
+	}
+
+	item.due = time.Now().Add(s.retryBackoff(item.record.Attempts))
+	if item.due.After(item.deadline) {
+		s.markPermanentlyFailed(item.record, "retry deadline exceeded: "+cause)
+		return
+	}
+
+	// A recovered payment that could not be verified may already be waiting
+	if item.record.Status != models.PaymentStatusRetryScheduled {
+		s.transition(item.record, models.PaymentStatusRetryScheduled, cause)
+	}
+	s.savePayment(item.record)
+
+	logrus.Infof("Scheduling retry %d for payment %s at %s",
+		item.record.Attempts+1, item.record.CorrelationID, item.due.Format(time.RFC3339Nano))
+	s.retries.push(item)
+}
+
+func (s *PaymentService) retryPayment(ctx context.Context, item *retryItem) {
+	ctx, span := otel.Tracer("payment-service").Start(ctx, "RetryPayment")
+	defer span.End()
+
+	// Work on a copy so readers of the stored record never see a partial update
+	updated := *item.record
+	if item.verify && s.settleInterruptedAttempt(ctx, item, &updated) {
+		return
+	}
+
+	updated.Attempts++
+	updated.LastAttemptAt = time.Now()
+	if updated.Status != models.PaymentStatusProcessing {
+		s.transition(&updated, models.PaymentStatusProcessing, "")
+	}
+	s.savePayment(&updated)
+
+	span.SetAttributes(
+		attribute.String("payment.correlation_id", updated.CorrelationID),
+		attribute.Int("payment.attempt", updated.Attempts),
+	)
+
+	// Re-evaluate processor health before spending an attempt on them
+	s.checkAllProcessorsHealth()
+
+	var err error
+	if !s.anyProcessorHealthy() {
+		err = fmt.Errorf("no healthy payment processor")
+	} else {
+		err = s.attemptProcessors(ctx, item.req, &updated)
+	}
+
+	if err == nil {
+		updated.ProcessedAt = time.Now()
+		s.transition(&updated, models.PaymentStatusSucceeded, "accepted by "+updated.Processor)
+		s.savePayment(&updated)
+		logrus.Infof("Payment %s succeeded on attempt %d with %s processor",
+			updated.CorrelationID, updated.Attempts, updated.Processor)
+		return
+	}
+
+	logrus.Warnf("Retry %d failed for payment %s: %v", updated.Attempts, updated.CorrelationID, err)
+	span.RecordError(err)
+
+	item.record = &updated
+	s.scheduleRetryItem(item, err.Error())
+}
+
+// settleInterruptedAttempt looks up at every processor a payment that was
+// in flight when the previous run stopped. It reports true when the payment
+// needs no new attempt now: a processor holds it, so it succeeded, or some
+// processor could not be asked, so it is rescheduled rather than risk a
+// second charge. Otherwise updated is left processing for the next attempt.
+func (s *PaymentService) settleInterruptedAttempt(ctx context.Context, item *retryItem, updated *models.PaymentRecord) bool {
+	if updated.Status != models.PaymentStatusProcessing {
+		s.transition(updated, models.PaymentStatusProcessing, "checking an attempt interrupted by a restart")
+	}
+
+	var lookupErr error
+	for _, p := range s.processors.All() {
+		remote, err := s.lookupProcessorPayment(ctx, p.Name, updated.CorrelationID)
+		if err != nil {
+			lookupErr = err
+			continue
+		}
+		if remote == nil {
+			continue
+		}
+		updated.Processor = p.Name
+		updated.ProcessedAt = time.Now()
+		if !remote.ProcessedAt.IsZero() {
+			updated.ProcessedAt = remote.ProcessedAt
+		}
+		s.applyFee(updated, remote.Fee)
+		s.transition(updated, models.PaymentStatusSucceeded, "confirmed by "+p.Name+" after a restart")
+		s.savePayment(updated)
+		logrus.Infof("Payment %s interrupted by a restart was charged by %s", updated.CorrelationID, p.Name)
+		return true
+	}
+
+	if lookupErr != nil {
+		item.record = updated
+		s.scheduleRetryItem(item, "could not check an attempt interrupted by a restart: "+lookupErr.Error())
+		return true
+	}
+	item.verify = false
+	return false
+}
+
+func (s *PaymentService) markPermanentlyFailed(record *models.PaymentRecord, reason string) {
+	updated := *record
+	s.transition(&updated, models.PaymentStatusFailed, reason)
+	s.savePayment(&updated)
+
+	logrus.Errorf("Payment %s permanently failed after %d attempts: %s",
+		updated.CorrelationID, updated.Attempts, reason)
+
+	_, span := otel.Tracer("payment-service").Start(context.Background(), "PaymentPermanentlyFailed")
+	span.SetAttributes(
+		attribute.String("payment.correlation_id", updated.CorrelationID),
+		attribute.Int("payment.attempts", updated.Attempts),
+	)
+	span.SetStatus(codes.Error, reason)
+	span.End()
+}
+
+// retryBackoff returns the delay before the attempt following the given one.
+func (s *PaymentService) retryBackoff(attempt int) time.Duration {
+	return exponentialBackoff(s.retryBaseDelay(), s.retryMaxDelay(), attempt)
+}
+
+// exponentialBackoff doubles delay for every attempt up to maxDelay, with
+// equal jitter so retries from a shared outage spread out.
+func exponentialBackoff(delay, maxDelay time.Duration, attempt int) time.Duration {
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (s *PaymentService) retryMaxAttempts() int {
+	if s.config.RetryMaxAttempts <= 0 {
+		return defaultRetryMaxAttempts
+	}
+	return s.config.RetryMaxAttempts
+}
+
+func (s *PaymentService) retryBaseDelay() time.Duration {
+	if s.config.RetryBaseDelay <= 0 {
+		return defaultRetryBaseDelay
+	}
+	return s.config.RetryBaseDelay
+}
+
+func (s *PaymentService) retryMaxDelay() time.Duration {
+	if s.config.RetryMaxDelay <= 0 {
+		return defaultRetryMaxDelay
+	}
+	return s.config.RetryMaxDelay
+}
+
+func (s *PaymentService) retryDeadline() time.Duration {
+	if s.config.RetryDeadline <= 0 {
+		return defaultRetryDeadline
+	}
+	return s.config.RetryDeadline
+}
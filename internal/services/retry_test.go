@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+	"th_payment_processor/internal/storage"
+)
+
+// newFlakyProcessor returns a processor that fails the first failures
+// payment calls and accepts every call after that.
+func newFlakyProcessor(t *testing.T, failures int32) *httptest.Server {
+	var calls int32
+	return newFakeProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"message":"payment processed successfully"}`))
+	})
+}
+
+func waitForRecord(t *testing.T, store storage.Store, correlationID string, done func(*models.PaymentRecord) bool) *models.PaymentRecord {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if record, ok := store.GetPaymentByCorrelationID(correlationID); ok && done(record) {
+			return record
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for payment %s", correlationID)
+	return nil
+}
+
+func TestPaymentService_RetrySucceedsAfterProcessorsRecover(t *testing.T) {
+	// Default and fallback both fail the first attempt, then recover
+	processor := newFlakyProcessor(t, 2)
+	service := newTestService(processor.URL, func(cfg *config.Config) { cfg.RetryBaseDelay = 10 * time.Millisecond })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.StartRetryScheduler(ctx)
+
+	if _, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "retry-ok", Amount: 1000}); err == nil {
+		t.Fatal("Expected first attempt to fail")
+	}
+
+	record := waitForRecord(t, service.storage, "retry-ok", func(r *models.PaymentRecord) bool { return r.Success })
+	if record.Status != models.PaymentStatusSucceeded || record.Processor != "default" || record.Attempts != 2 {
+		t.Errorf("Expected success on default at attempt 2, got processor=%s attempts=%d", record.Processor, record.Attempts)
+	}
+}
+
+func TestPaymentService_RetryGivesUpAfterMaxAttempts(t *testing.T) {
+	processor := newFlakyProcessor(t, 1<<30)
+	service := newTestService(processor.URL, func(cfg *config.Config) {
+		cfg.RetryMaxAttempts = 3
+		cfg.RetryBaseDelay = 5 * time.Millisecond
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.StartRetryScheduler(ctx)
+
+	service.ProcessPayment(&models.PaymentRequest{CorrelationID: "retry-exhausted", Amount: 1000})
+
+	record := waitForRecord(t, service.storage, "retry-exhausted", func(r *models.PaymentRecord) bool { return r.Status == models.PaymentStatusFailed })
+	if record.Attempts != 3 || record.Success || record.Processor != "" {
+		t.Errorf("Unexpected permanently failed record: %+v", record)
+	}
+
+	// processing, then (retry_scheduled, processing) per retry, then failed
+	want := []models.PaymentStatus{
+		models.PaymentStatusPending,
+		models.PaymentStatusProcessing,
+		models.PaymentStatusRetryScheduled,
+		models.PaymentStatusProcessing,
+		models.PaymentStatusRetryScheduled,
+		models.PaymentStatusProcessing,
+		models.PaymentStatusFailed,
+	}
+	if len(record.StatusHistory) != len(want) {
+		t.Fatalf("Unexpected status history: %+v", record.StatusHistory)
+	}
+	for i, transition := range record.StatusHistory {
+		if transition.Status != want[i] {
+			t.Errorf("StatusHistory[%d] = %s, want %s", i, transition.Status, want[i])
+		}
+	}
+	if service.PendingRetries() != 0 {
+		t.Errorf("Expected no pending retries, got %d", service.PendingRetries())
+	}
+}
+
+func TestPaymentService_RecoverRetries(t *testing.T) {
+	// The processor charged "charged" before the restart and knows nothing
+	// of the others
+	var mu sync.Mutex
+	sent := make(map[string]int)
+	processor := newFakeProcessor(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			if r.URL.Path != "/payments/charged" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"amount":10,"refundedAmount":0,"fee":0.5}`))
+			return
+		}
+		var req models.PaymentProcessorRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		sent[req.CorrelationID]++
+		mu.Unlock()
+		w.Write([]byte(`{"message":"payment processed successfully"}`))
+	})
+	service := newTestService(processor.URL, func(cfg *config.Config) { cfg.RetryBaseDelay = 10 * time.Millisecond })
+	store := service.storage
+
+	at := time.Now().Add(-time.Second)
+	store.StorePayment(models.NewPaymentRecord("queued", 1000, at))
+	for _, id := range []string{"charged", "unsent", "retrying", "expired"} {
+		record := models.NewPaymentRecord(id, 1000, at)
+		if id == "expired" {
+			record = models.NewPaymentRecord(id, 1000, at.Add(-time.Hour))
+		}
+		record.Attempts = 1
+		record.Transition(models.PaymentStatusProcessing, at, "")
+		if id == "retrying" || id == "expired" {
+			record.Transition(models.PaymentStatusRetryScheduled, at, "all payment processors are unavailable")
+		}
+		store.StorePayment(record)
+	}
+
+	if recovered := service.RecoverRetries(); recovered != 4 {
+		t.Fatalf("Expected 4 payments to be recovered, got %d", recovered)
+	}
+	if record, _ := store.GetPaymentByCorrelationID("expired"); record.Status != models.PaymentStatusFailed {
+		t.Errorf("Expected a retry past its deadline to fail, got %s", record.Status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.StartRetryScheduler(ctx)
+
+	for _, id := range []string{"queued", "charged", "unsent", "retrying"} {
+		waitForRecord(t, store, id, func(r *models.PaymentRecord) bool { return r.Status == models.PaymentStatusSucceeded })
+	}
+	charged, _ := store.GetPaymentByCorrelationID("charged")
+	if charged.Processor != "default" || charged.Fee != 50 || charged.Attempts != 1 {
+		t.Errorf("Expected the interrupted attempt to be confirmed, got %+v", charged)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sent["charged"] != 0 || sent["unsent"] != 1 || sent["queued"] != 1 || sent["retrying"] != 1 {
+		t.Errorf("Expected only the uncharged payments to be sent once, got %v", sent)
+	}
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+)
+
+const (
+	RoutingPriority      = "priority"
+	RoutingCheapest      = "cheapest"
+	RoutingLatencyBudget = "latency-budget"
+	RoutingWeighted      = "weighted"
+)
+
+const defaultLatencyBudget = 200 * time.Millisecond
+
+// ProcessorCandidate is a processor as seen by a RoutingPolicy.
+type ProcessorCandidate struct {
+	Name            string
+	Priority        int
+	FeePercentage   float64
+	Healthy         bool
+	MinResponseTime time.Duration
+}
+
+// RoutingPolicy decides the order in which processors are tried for a
+// payment. Unhealthy candidates may be returned; they are skipped when the
+// payment is attempted.
+type RoutingPolicy interface {
+	Name() string
+	Order(req *models.PaymentRequest, candidates []ProcessorCandidate) []ProcessorCandidate
+}
+
+// NewRoutingPolicy builds the policy selected by cfg.RoutingPolicy.
+func NewRoutingPolicy(cfg *config.Config) (RoutingPolicy, error) {
+	switch cfg.RoutingPolicy {
+	case "", RoutingPriority:
+		return priorityPolicy{}, nil
+	case RoutingCheapest:
+		return cheapestPolicy{}, nil
+	case RoutingLatencyBudget:
+		budget := cfg.RoutingLatencyBudget
+		if budget <= 0 {
+			budget = defaultLatencyBudget
+		}
+		return latencyBudgetPolicy{budget: budget}, nil
+	case RoutingWeighted:
+		weights, err := parseRoutingWeights(cfg.RoutingWeights)
+		if err != nil {
+			return nil, err
+		}
+		return weightedPolicy{weights: weights}, nil
+	default:
+		return nil, fmt.Errorf("unknown routing policy: %s", cfg.RoutingPolicy)
+	}
+}
+
+// byPriority returns a copy of candidates sorted by ascending priority.
+func byPriority(candidates []ProcessorCandidate) []ProcessorCandidate {
+	ordered := append([]ProcessorCandidate(nil), candidates...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Priority < ordered[j].Priority
+	})
+	return ordered
+}
+
+// priorityPolicy always tries processors in configured priority order.
+type priorityPolicy struct{}
+
+func (priorityPolicy) Name() string { return RoutingPriority }
+
+func (priorityPolicy) Order(_ *models.PaymentRequest, candidates []ProcessorCandidate) []ProcessorCandidate {
+	return byPriority(candidates)
+}
+
+// cheapestPolicy tries healthy processors from the lowest fee up.
+type cheapestPolicy struct{}
+
+func (cheapestPolicy) Name() string { return RoutingCheapest }
+
+func (cheapestPolicy) Order(_ *models.PaymentRequest, candidates []ProcessorCandidate) []ProcessorCandidate {
+	ordered := byPriority(candidates)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].Healthy != ordered[j].Healthy {
+			return ordered[i].Healthy
+		}
+		return ordered[i].FeePercentage < ordered[j].FeePercentage
+	})
+	return ordered
+}
+
+// latencyBudgetPolicy keeps priority order but demotes processors whose
+// reported minResponseTime exceeds the budget.
+type latencyBudgetPolicy struct {
+	budget time.Duration
+}
+
+func (p latencyBudgetPolicy) Name() string { return RoutingLatencyBudget }
+
+func (p latencyBudgetPolicy) Order(_ *models.PaymentRequest, candidates []ProcessorCandidate) []ProcessorCandidate {
+	ordered := byPriority(candidates)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].MinResponseTime <= p.budget && ordered[j].MinResponseTime > p.budget
+	})
+	return ordered
+}
+
+// weightedPolicy sends a share of payments to each processor first, falling
+// back to priority order for the rest.
+type weightedPolicy struct {
+	weights map[string]int
+}
+
+func (p weightedPolicy) Name() string { return RoutingWeighted }
+
+func (p weightedPolicy) Order(_ *models.PaymentRequest, candidates []ProcessorCandidate) []ProcessorCandidate {
+	ordered := byPriority(candidates)
+
+	total := 0
+	for _, c := range ordered {
+		if c.Healthy {
+			total += p.weights[c.Name]
+		}
+	}
+	if total == 0 {
+		return ordered
+	}
+
+	pick := rand.Intn(total)
+	for i, c := range ordered {
+		if !c.Healthy {
+			continue
+		}
+		if pick < p.weights[c.Name] {
+			first := ordered[i]
+			copy(ordered[1:i+1], ordered[:i])
+			ordered[0] = first
+			break
+		}
+		pick -= p.weights[c.Name]
+	}
+	return ordered
+}
+
+// parseRoutingWeights parses "default=90,fallback=10".
+func parseRoutingWeights(raw string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid routing weight %q: expected name=weight", entry)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid routing weight %q: weight must be a non-negative integer", entry)
+		}
+		weights[strings.TrimSpace(name)] = weight
+	}
+	if len(weights) == 0 {
+		return nil, fmt.Errorf("weighted routing requires ROUTING_WEIGHTS")
+	}
+	return weights, nil
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+)
+
+func candidateNames(candidates []ProcessorCandidate) []string {
+	names := make([]string, len(candidates))
+	for i, c := range candidates {
+		names[i] = c.Name
+	}
+	return names
+}
+
+func testCandidates() []ProcessorCandidate {
+	return []ProcessorCandidate{
+		{Name: "fallback", Priority: 2, FeePercentage: 5, Healthy: true, MinResponseTime: 20 * time.Millisecond},
+		{Name: "default", Priority: 1, FeePercentage: 1, Healthy: true, MinResponseTime: 500 * time.Millisecond},
+	}
+}
+
+func TestRoutingPolicies(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        config.Config
+		candidates func() []ProcessorCandidate
+		want       []string
+	}{
+		{
+			name:       "priority",
+			cfg:        config.Config{RoutingPolicy: RoutingPriority},
+			candidates: testCandidates,
+			want:       []string{"default", "fallback"},
+		},
+		{
+			name: "cheapest prefers healthy",
+			cfg:  config.Config{RoutingPolicy: RoutingCheapest},
+			candidates: func() []ProcessorCandidate {
+				c := testCandidates()
+				c[1].Healthy = false
+				return c
+			},
+			want: []string{"fallback", "default"},
+		},
+		{
+			name: "cheapest",
+			cfg:  config.Config{RoutingPolicy: RoutingCheapest},
+			candidates: func() []ProcessorCandidate {
+				c := testCandidates()
+				c[0].FeePercentage = 0.5
+				return c
+			},
+			want: []string{"fallback", "default"},
+		},
+		{
+			name:       "latency budget demotes slow default",
+			cfg:        config.Config{RoutingPolicy: RoutingLatencyBudget, RoutingLatencyBudget: 100 * time.Millisecond},
+			candidates: testCandidates,
+			want:       []string{"fallback", "default"},
+		},
+		{
+			name:       "latency budget keeps default within budget",
+			cfg:        config.Config{RoutingPolicy: RoutingLatencyBudget, RoutingLatencyBudget: time.Second},
+			candidates: testCandidates,
+			want:       []string{"default", "fallback"},
+		},
+		{
+			name:       "weighted all to fallback",
+			cfg:        config.Config{RoutingPolicy: RoutingWeighted, RoutingWeights: "default=0,fallback=1"},
+			candidates: testCandidates,
+			want:       []string{"fallback", "default"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := NewRoutingPolicy(&tt.cfg)
+			if err != nil {
+				t.Fatalf("NewRoutingPolicy failed: %v", err)
+			}
+			got := candidateNames(policy.Order(nil, tt.candidates()))
+			if len(got) != len(tt.want) || got[0] != tt.want[0] || got[1] != tt.want[1] {
+				t.Errorf("Order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightedPolicy_Split(t *testing.T) {
+	policy, err := NewRoutingPolicy(&config.Config{RoutingPolicy: RoutingWeighted, RoutingWeights: "default=3,fallback=1"})
+	if err != nil {
+		t.Fatalf("NewRoutingPolicy failed: %v", err)
+	}
+
+	first := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		first[policy.Order(nil, testCandidates())[0].Name]++
+	}
+	// Expect roughly 3000/1000; allow generous slack for randomness
+	if first["default"] < 2700 || first["fallback"] < 700 {
+		t.Errorf("Unexpected split: %v", first)
+	}
+}
+
+func TestNewRoutingPolicy_Invalid(t *testing.T) {
+	if _, err := NewRoutingPolicy(&config.Config{RoutingPolicy: "round-robin"}); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+	if _, err := NewRoutingPolicy(&config.Config{RoutingPolicy: RoutingWeighted, RoutingWeights: "default"}); err == nil {
+		t.Error("Expected error for malformed weights")
+	}
+}
@@ -0,0 +1,438 @@
+package services
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+)
+
+const (
+	defaultWebhookTimeout     = 5 * time.Second
+	defaultWebhookMaxAttempts = 8
+	defaultWebhookBaseDelay   = 1 * time.Second
+	defaultWebhookMaxDelay    = 5 * time.Minute
+	defaultWebhookConcurrency = 4
+	defaultWebhookQueueSize   = 10000
+
+	// Oldest dead letters are dropped beyond this many
+	webhookDeadLetterLimit = 1000
+
+	// WebhookSignatureHeader carries "t=<unix seconds>,v1=<hex HMAC-SHA256>"
+	// of every delivery; see SignWebhook.
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+var (
+	// ErrWebhookNotFound is returned for an unknown webhook ID.
+	ErrWebhookNotFound = errors.New("webhook not found")
+	// ErrInvalidWebhookEvent is returned when subscribing to an unknown event type.
+	ErrInvalidWebhookEvent = errors.New("unknown webhook event type")
+	// ErrDeliveryNotFound is returned when replaying a delivery that is not
+	// in the dead-letter list.
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+type webhookItem struct {
+	delivery *models.WebhookDelivery
+	due      time.Time
+}
+
+// webhookQueue is a min-heap of pending deliveries ordered by due time.
+type webhookQueue []*webhookItem
+
+func (q webhookQueue) Len() int            { return len(q) }
+func (q webhookQueue) Less(i, j int) bool  { return q[i].due.Before(q[j].due) }
+func (q webhookQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *webhookQueue) Push(x interface{}) { *q = append(*q, x.(*webhookItem)) }
+func (q *webhookQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
+
+// WebhookDispatcher keeps the registered webhooks and delivers payment
+// events to them in the background. Deliveries that keep failing end up in
+// a dead-letter list from where they can be replayed. Everything is held in
+// memory and lost on restart.
+type WebhookDispatcher struct {
+	config  *config.Config
+	client  *http.Client
+	targets webhookTargets
+
+	mu          sync.Mutex
+	webhooks    map[uuid.UUID]*models.Webhook
+	pending     webhookQueue
+	deadLetters []*models.WebhookDelivery
+	wake        chan struct{}
+}
+
+func NewWebhookDispatcher(cfg *config.Config) *WebhookDispatcher {
+	timeout := cfg.WebhookTimeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+
+	targets := newWebhookTargets(cfg.WebhookAllowedHosts)
+	return &WebhookDispatcher{
+		config: cfg,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: otelhttp.NewTransport(targets.transport()),
+		},
+		targets:  targets,
+		webhooks: make(map[uuid.UUID]*models.Webhook),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Register adds a webhook for the requested events, or all of them when
+// none are given, generating a secret if the request has none. The URL must
+// be http(s) and may not point inward; see webhookTargets.
+func (d *WebhookDispatcher) Register(req *models.WebhookRequest) (*models.Webhook, error) {
+	if err := d.targets.validate(req.URL); err != nil {
+		return nil, err
+	}
+
+	events := req.Events
+	if len(events) == 0 {
+		events = models.WebhookEventTypes
+	}
+	for _, event := range events {
+		if !event.Valid() {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidWebhookEvent, string(event))
+		}
+	}
+
+	secret := req.Secret
+	if secret == "" {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, fmt.Errorf("failed to generate secret: %w", err)
+		}
+		secret = hex.EncodeToString(buf)
+	}
+
+	webhook := &models.Webhook{
+		ID:        uuid.New(),
+		URL:       req.URL,
+		Events:    append([]models.WebhookEventType(nil), events...),
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+
+	d.mu.Lock()
+	d.webhooks[webhook.ID] = webhook
+	d.mu.Unlock()
+
+	logrus.Infof("Registered webhook %s for %v", webhook.URL, webhook.Events)
+	copied := *webhook
+	return &copied, nil
+}
+
+// List returns the registered webhooks without their secrets.
+func (d *WebhookDispatcher) List() []models.Webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	webhooks := make([]models.Webhook, 0, len(d.webhooks))
+	for _, webhook := range d.webhooks {
+		copied := *webhook
+		copied.Secret = ""
+		webhooks = append(webhooks, copied)
+	}
+	return webhooks
+}
+
+// Delete removes a webhook. Its pending deliveries are dropped when due.
+func (d *WebhookDispatcher) Delete(id uuid.UUID) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.webhooks[id]; !ok {
+		return ErrWebhookNotFound
+	}
+	delete(d.webhooks, id)
+	return nil
+}
+
+// Publish queues an event about record for every webhook subscribed to
+// eventType. It never blocks; when the queue is full the delivery goes
+// straight to the dead-letter list.
+func (d *WebhookDispatcher) Publish(eventType models.WebhookEventType, record *models.PaymentRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.webhooks) == 0 {
+		return
+	}
+
+	event := models.WebhookEvent{
+		ID:        uuid.New(),
+		Type:      eventType,
+		CreatedAt: time.Now(),
+		Payment:   *record,
+	}
+	for _, webhook := range d.webhooks {
+		if !webhook.Subscribes(eventType) {
+			continue
+		}
+		delivery := &models.WebhookDelivery{ID: uuid.New(), WebhookID: webhook.ID, Event: event}
+		if d.pending.Len() >= d.queueSize() {
+			logrus.Errorf("Webhook queue full, dead-lettering %s for %s", eventType, webhook.URL)
+			delivery.LastError = "delivery queue full"
+			d.deadLetterLocked(delivery)
+			continue
+		}
+		heap.Push(&d.pending, &webhookItem{delivery: delivery, due: event.CreatedAt})
+	}
+	d.notifyLocked()
+}
+
+// DeadLetters returns the deliveries that exhausted their attempts, oldest
+// first.
+func (d *WebhookDispatcher) DeadLetters() []models.WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deliveries := make([]models.WebhookDelivery, len(d.deadLetters))
+	for i, delivery := range d.deadLetters {
+		deliveries[i] = *delivery
+	}
+	return deliveries
+}
+
+// Replay takes a delivery off the dead-letter list and queues it again with
+// a fresh attempt budget.
+func (d *WebhookDispatcher) Replay(id uuid.UUID) (*models.WebhookDelivery, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, delivery := range d.deadLetters {
+		if delivery.ID != id {
+			continue
+		}
+		if _, ok := d.webhooks[delivery.WebhookID]; !ok {
+			return nil, ErrWebhookNotFound
+		}
+		d.deadLetters = append(d.deadLetters[:i], d.deadLetters[i+1:]...)
+		delivery.Attempts = 0
+		heap.Push(&d.pending, &webhookItem{delivery: delivery, due: time.Now()})
+		d.notifyLocked()
+
+		copied := *delivery
+		return &copied, nil
+	}
+	return nil, ErrDeliveryNotFound
+}
+
+// Start delivers events as they come due until ctx is cancelled, at most
+// WEBHOOK_CONCURRENCY at a time.
+func (d *WebhookDispatcher) Start(ctx context.Context) {
+	sem := make(chan struct{}, d.concurrency())
+
+	for {
+		due, wait := d.popDue(time.Now())
+		for _, delivery := range due {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(delivery *models.WebhookDelivery) {
+				defer func() { <-sem }()
+				d.attempt(ctx, delivery)
+			}(delivery)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-d.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// popDue removes and returns every delivery due at now, along with how long
+// to wait for the next one.
+func (d *WebhookDispatcher) popDue(now time.Time) ([]*models.WebhookDelivery, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var due []*models.WebhookDelivery
+	for d.pending.Len() > 0 && !d.pending[0].due.After(now) {
+		due = append(due, heap.Pop(&d.pending).(*webhookItem).delivery)
+	}
+
+	wait := time.Minute
+	if d.pending.Len() > 0 {
+		wait = d.pending[0].due.Sub(now)
+	}
+	return due, wait
+}
+
+// attempt sends delivery once and reschedules it with backoff, or moves it
+// to the dead-letter list once it has used up its attempts.
+func (d *WebhookDispatcher) attempt(ctx context.Context, delivery *models.WebhookDelivery) {
+	err := d.send(ctx, delivery)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delivery.Attempts++
+	delivery.LastAttemptAt = time.Now()
+	switch {
+	case err == nil:
+		delivery.LastError = ""
+	case errors.Is(err, ErrWebhookNotFound):
+		logrus.Infof("Dropping %s delivery %s: webhook was deleted", delivery.Event.Type, delivery.ID)
+	case delivery.Attempts >= d.maxAttempts():
+		logrus.Errorf("Webhook delivery %s failed after %d attempts, dead-lettering: %v", delivery.ID, delivery.Attempts, err)
+		delivery.LastError = err.Error()
+		d.deadLetterLocked(delivery)
+	default:
+		delivery.LastError = err.Error()
+		backoff := exponentialBackoff(d.baseDelay(), d.maxDelay(), delivery.Attempts)
+		heap.Push(&d.pending, &webhookItem{delivery: delivery, due: time.Now().Add(backoff)})
+		d.notifyLocked()
+	}
+}
+
+// send posts the signed event to the webhook.
+func (d *WebhookDispatcher) send(ctx context.Context, delivery *models.WebhookDelivery) error {
+	tracer := otel.Tracer("payment-service")
+	ctx, span := tracer.Start(ctx, "DeliverWebhook")
+	defer span.End()
+
+	d.mu.Lock()
+	webhook, ok := d.webhooks[delivery.WebhookID]
+	var url, secret string
+	if ok {
+		url, secret = webhook.URL, webhook.Secret
+	}
+	d.mu.Unlock()
+	if !ok {
+		return ErrWebhookNotFound
+	}
+
+	span.SetAttributes(
+		attribute.String("webhook.url", url),
+		attribute.String("webhook.event", string(delivery.Event.Type)),
+		attribute.Int("webhook.attempt", delivery.Attempts+1),
+	)
+
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", string(delivery.Event.Type))
+	req.Header.Set("X-Webhook-Delivery", delivery.ID.String())
+	req.Header.Set(WebhookSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, SignWebhook(secret, timestamp, body)))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		span.SetStatus(codes.Error, resp.Status)
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SignWebhook returns the hex HMAC-SHA256, keyed by secret, of
+// "<timestamp>.<body>", which receivers recompute to authenticate a delivery.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *WebhookDispatcher) deadLetterLocked(delivery *models.WebhookDelivery) {
+	d.deadLetters = append(d.deadLetters, delivery)
+	if over := len(d.deadLetters) - webhookDeadLetterLimit; over > 0 {
+		d.deadLetters = append([]*models.WebhookDelivery(nil), d.deadLetters[over:]...)
+	}
+}
+
+func (d *WebhookDispatcher) notifyLocked() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *WebhookDispatcher) maxAttempts() int {
+	if d.config.WebhookMaxAttempts <= 0 {
+		return defaultWebhookMaxAttempts
+	}
+	return d.config.WebhookMaxAttempts
+}
+
+func (d *WebhookDispatcher) baseDelay() time.Duration {
+	if d.config.WebhookBaseDelay <= 0 {
+		return defaultWebhookBaseDelay
+	}
+	return d.config.WebhookBaseDelay
+}
+
+func (d *WebhookDispatcher) maxDelay() time.Duration {
+	if d.config.WebhookMaxDelay <= 0 {
+		return defaultWebhookMaxDelay
+	}
+	return d.config.WebhookMaxDelay
+}
+
+func (d *WebhookDispatcher) concurrency() int {
+	if d.config.WebhookConcurrency <= 0 {
+		return defaultWebhookConcurrency
+	}
+	return d.config.WebhookConcurrency
+}
+
+func (d *WebhookDispatcher) queueSize() int {
+	if d.config.WebhookQueueSize <= 0 {
+		return defaultWebhookQueueSize
+	}
+	return d.config.WebhookQueueSize
+}
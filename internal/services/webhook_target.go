@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrInvalidWebhookURL is returned when registering a webhook whose URL is
+// not http(s) or points at a loopback, private or link-local address.
+var ErrInvalidWebhookURL = errors.New("invalid webhook URL")
+
+// webhookTargets decides which hosts webhooks may be delivered to. Public
+// addresses always may; hosts listed in WEBHOOK_ALLOWED_HOSTS may be
+// internal, everything else on the loopback, private or link-local networks
+// is refused so webhooks cannot be used to reach this host's neighbours.
+type webhookTargets struct {
+	allowed map[string]bool
+}
+
+func newWebhookTargets(hosts []string) webhookTargets {
+	allowed := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		allowed[strings.ToLower(host)] = true
+	}
+	return webhookTargets{allowed: allowed}
+}
+
+// validate checks a webhook URL at registration. Hostnames are only
+// resolved when delivering, where dial enforces the same rule.
+func (t webhookTargets) validate(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhookURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme must be http or https", ErrInvalidWebhookURL)
+	}
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case host == "":
+		return fmt.Errorf("%w: missing host", ErrInvalidWebhookURL)
+	case t.allowed[host]:
+		return nil
+	case host == "localhost" || strings.HasSuffix(host, ".localhost"):
+		return fmt.Errorf("%w: %s is a loopback host", ErrInvalidWebhookURL, host)
+	}
+	if ip := net.ParseIP(host); ip != nil && blockedWebhookIP(ip) {
+		return fmt.Errorf("%w: %s is not a public address", ErrInvalidWebhookURL, host)
+	}
+	return nil
+}
+
+// transport dials webhook receivers, refusing connections to addresses
+// that are not public unless the host is allowed. Checking the address
+// actually dialled also covers hostnames that resolve inward.
+func (t webhookTargets) transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would hide the receiver's address from the dialer
+	transport.Proxy = nil
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	guarded := &net.Dialer{
+		Timeout:   dialer.Timeout,
+		KeepAlive: dialer.KeepAlive,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || blockedWebhookIP(ip) {
+				return fmt.Errorf("%w: %s is not a public address", ErrInvalidWebhookURL, host)
+			}
+			return nil
+		},
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err == nil && t.allowed[strings.ToLower(host)] {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return guarded.DialContext(ctx, network, address)
+	}
+	return transport
+}
+
+func blockedWebhookIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
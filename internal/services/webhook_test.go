@@ -0,0 +1,190 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/config"
+	"th_payment_processor/internal/models"
+)
+
+// webhookReceiver records the events it accepts, checking their signature.
+type webhookReceiver struct {
+	*httptest.Server
+	mu      sync.Mutex
+	events  []models.WebhookEvent
+	failing atomic.Bool
+}
+
+func newWebhookReceiver(t *testing.T, secret string) *webhookReceiver {
+	r := &webhookReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(req.Body)
+		var timestamp int64
+		var signature string
+		fmt.Sscanf(req.Header.Get(WebhookSignatureHeader), "t=%d,v1=%s", &timestamp, &signature)
+		if signature != SignWebhook(secret, timestamp, body) {
+			t.Errorf("Invalid signature %q", req.Header.Get(WebhookSignatureHeader))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var event models.WebhookEvent
+		json.Unmarshal(body, &event)
+		r.mu.Lock()
+		r.events = append(r.events, event)
+		r.mu.Unlock()
+	}))
+	return r
+}
+
+func (r *webhookReceiver) received() []models.WebhookEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]models.WebhookEvent(nil), r.events...)
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookDispatcher_PaymentEvents(t *testing.T) {
+	var refunds atomic.Int32
+	var failRefunds atomic.Bool
+	processor := newRefundingProcessor(t, &refunds, &failRefunds)
+	service := newTestService(processor.URL, func(cfg *config.Config) { cfg.WebhookAllowedHosts = []string{"127.0.0.1"} })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go service.Webhooks().Start(ctx)
+
+	receiver := newWebhookReceiver(t, "s3cret")
+	defer receiver.Close()
+	if _, err := service.Webhooks().Register(&models.WebhookRequest{URL: receiver.URL, Secret: "s3cret"}); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if _, err := service.Webhooks().Register(&models.WebhookRequest{URL: receiver.URL, Events: []models.WebhookEventType{"payment.unknown"}}); err == nil {
+		t.Error("Expected an unknown event type to be rejected")
+	}
+
+	if _, err := service.ProcessPayment(&models.PaymentRequest{CorrelationID: "hooked", Amount: 1000}); err != nil {
+		t.Fatalf("ProcessPayment failed: %v", err)
+	}
+	if _, err := service.RefundPayment(ctx, "hooked", 400); err != nil {
+		t.Fatalf("RefundPayment failed: %v", err)
+	}
+
+	waitFor(t, "two webhook events", func() bool { return len(receiver.received()) == 2 })
+	types := map[models.WebhookEventType]models.WebhookEvent{}
+	for _, event := range receiver.received() {
+		types[event.Type] = event
+	}
+	if event := types[models.WebhookPaymentSucceeded]; event.Payment.CorrelationID != "hooked" || event.Payment.Status != models.PaymentStatusSucceeded {
+		t.Errorf("Unexpected succeeded event: %+v", event)
+	}
+	if event := types[models.WebhookPaymentRefunded]; event.Payment.RefundedAmount != 400 {
+		t.Errorf("Unexpected refunded event: %+v", event)
+	}
+
+	if webhooks := service.Webhooks().List(); len(webhooks) != 1 || webhooks[0].Secret != "" {
+		t.Errorf("Expected one webhook listed without its secret, got %+v", webhooks)
+	}
+}
+
+func TestWebhookDispatcher_DeadLetterAndReplay(t *testing.T) {
+	cfg := &config.Config{
+		WebhookMaxAttempts:  3,
+		WebhookBaseDelay:    time.Millisecond,
+		WebhookMaxDelay:     5 * time.Millisecond,
+		WebhookAllowedHosts: []string{"127.0.0.1"},
+	}
+	dispatcher := NewWebhookDispatcher(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dispatcher.Start(ctx)
+
+	receiver := newWebhookReceiver(t, "s3cret")
+	defer receiver.Close()
+	receiver.failing.Store(true)
+	webhook, _ := dispatcher.Register(&models.WebhookRequest{
+		URL:    receiver.URL,
+		Events: []models.WebhookEventType{models.WebhookPaymentFailed},
+		Secret: "s3cret",
+	})
+
+	record := models.NewPaymentRecord("doomed", 1000, time.Now())
+	dispatcher.Publish(models.WebhookPaymentSucceeded, record)
+	dispatcher.Publish(models.WebhookPaymentFailed, record)
+
+	waitFor(t, "a dead letter", func() bool { return len(dispatcher.DeadLetters()) == 1 })
+	dead := dispatcher.DeadLetters()[0]
+	if dead.Attempts != 3 || dead.WebhookID != webhook.ID || dead.Event.Type != models.WebhookPaymentFailed || dead.LastError == "" {
+		t.Errorf("Unexpected dead letter: %+v", dead)
+	}
+
+	receiver.failing.Store(false)
+	if _, err := dispatcher.Replay(dead.ID); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	waitFor(t, "the replayed delivery", func() bool { return len(receiver.received()) == 1 })
+	if got := receiver.received()[0]; got.ID != dead.Event.ID {
+		t.Errorf("Replay delivered event %s, want %s", got.ID, dead.Event.ID)
+	}
+	if len(dispatcher.DeadLetters()) != 0 {
+		t.Error("Expected the replayed delivery to leave the dead-letter list")
+	}
+	if _, err := dispatcher.Replay(dead.ID); err != ErrDeliveryNotFound {
+		t.Errorf("Expected ErrDeliveryNotFound for a second replay, got %v", err)
+	}
+}
+
+func TestWebhookDispatcher_RejectsInwardURLs(t *testing.T) {
+	dispatcher := NewWebhookDispatcher(&config.Config{WebhookAllowedHosts: []string{"receiver.internal"}})
+
+	for _, url := range []string{
+		"ftp://example.com/hook",
+		"http://localhost:8080/hook",
+		"http://127.0.0.1/hook",
+		"http://10.0.0.5/hook",
+		"http://192.168.1.10/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+	} {
+		if _, err := dispatcher.Register(&models.WebhookRequest{URL: url}); !errors.Is(err, ErrInvalidWebhookURL) {
+			t.Errorf("Expected %s to be rejected, got %v", url, err)
+		}
+	}
+	for _, url := range []string{"https://example.com/hook", "http://receiver.internal:9000/hook"} {
+		if _, err := dispatcher.Register(&models.WebhookRequest{URL: url}); err != nil {
+			t.Errorf("Expected %s to be accepted, got %v", url, err)
+		}
+	}
+
+	// Deliveries check the address actually dialled, whatever the URL said
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	client := &http.Client{Transport: newWebhookTargets(nil).transport()}
+	if _, err := client.Get(receiver.URL); !errors.Is(err, ErrInvalidWebhookURL) {
+		t.Errorf("Expected the dial to a loopback receiver to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"th_payment_processor/internal/models"
+)
+
+type summaryKey struct {
+	processor string
+	currency  models.Currency
+}
+
+// summaryContribution is what one payment or refund adds to the summary,
+// or a payment that finally failed.
+type summaryContribution struct {
+	at     time.Time
+	key    summaryKey
+	totals models.CurrencySummary
+	failed bool
+}
+
+func contributionsOf(record *models.PaymentRecord) []summaryContribution {
+	var contributions []summaryContribution
+	currency := record.Currency.OrDefault()
+	if record.Success {
+		contributions = append(contributions, summaryContribution{
+			at:     record.ProcessedAt,
+			key:    summaryKey{processor: record.Processor, currency: currency},
+			totals: models.CurrencySummary{TotalRequests: 1, TotalAmount: record.Amount, TotalFee: record.Fee, TotalNetAmount: record.Amount - record.Fee},
+		})
+	}
+	if at := failedAt(record); record.Status == models.PaymentStatusFailed && !at.IsZero() {
+		contributions = append(contributions, summaryContribution{at: at, failed: true})
+	}
+	// Refunds count when they happened, not when the payment did
+	for _, refund := range record.Refunds {
+		if refund.Status != models.RefundStatusSucceeded || refund.Duplicate {
+			continue
+		}
+		contributions = append(contributions, summaryContribution{
+			at:     refund.RefundedAt,
+			key:    summaryKey{processor: refund.Processor, currency: currency},
+			totals: models.CurrencySummary{TotalRefunds: 1, TotalRefundedAmount: refund.Amount},
+		})
+	}
+	return contributions
+}
+
+// failedAt is when record moved to failed.
+func failedAt(record *models.PaymentRecord) time.Time {
+	for i := len(record.StatusHistory) - 1; i >= 0; i-- {
+		if record.StatusHistory[i].Status == models.PaymentStatusFailed {
+			return record.StatusHistory[i].At
+		}
+	}
+	if !record.LastAttemptAt.IsZero() {
+		return record.LastAttemptAt
+	}
+	return record.ProcessedAt
+}
+
+func sameContributions(a, b []summaryContribution) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].at.Equal(b[i].at) || a[i].key != b[i].key || a[i].totals != b[i].totals || a[i].failed != b[i].failed {
+			return false
+		}
+	}
+	return true
+}
+
+// summaryBucket holds the totals of everything that happened within one
+// second, and which records contributed so a partly covered bucket can be
+// summed exactly.
+type summaryBucket struct {
+	totals  map[summaryKey]models.CurrencySummary
+	failed  int
+	records map[uuid.UUID]struct{}
+}
+
+// summaryAggregates keeps per-second totals up to date as payments are
+// written, so a summary adds up buckets instead of scanning every record.
+// Only the buckets at the edges of a from/to window look at records.
+type summaryAggregates struct {
+	buckets map[int64]*summaryBucket
+	// starts holds the bucket seconds in ascending order
+	starts        []int64
+	contributions map[uuid.UUID][]summaryContribution
+}
+
+func newSummaryAggregates() *summaryAggregates {
+	return &summaryAggregates{
+		buckets:       make(map[int64]*summaryBucket),
+		contributions: make(map[uuid.UUID][]summaryContribution),
+	}
+}
+
+// put replaces whatever record contributed before with its current totals.
+func (a *summaryAggregates) put(record *models.PaymentRecord) {
+	contributions := contributionsOf(record)
+	if sameContributions(a.contributions[record.ID], contributions) {
+		return
+	}
+
+	a.delete(record.ID)
+	if len(contributions) == 0 {
+		return
+	}
+	a.contributions[record.ID] = contributions
+	for _, c := range contributions {
+		bucket := a.bucket(c.at.Unix())
+		bucket.records[record.ID] = struct{}{}
+		if c.failed {
+			bucket.failed++
+			continue
+		}
+		bucket.totals[c.key] = addTotals(bucket.totals[c.key], c.totals, 1)
+	}
+}
+
+func (a *summaryAggregates) delete(id uuid.UUID) {
+	contributions, ok := a.contributions[id]
+	if !ok {
+		return
+	}
+
+	delete(a.contributions, id)
+	for _, c := range contributions {
+		bucket := a.buckets[c.at.Unix()]
+		delete(bucket.records, id)
+		if c.failed {
+			bucket.failed--
+		} else if totals := addTotals(bucket.totals[c.key], c.totals, -1); totals != (models.CurrencySummary{}) {
+			bucket.totals[c.key] = totals
+		} else {
+			delete(bucket.totals, c.key)
+		}
+	}
+	// A payment and its refunds may share a bucket, so drop empty ones last
+	for _, c := range contributions {
+		start := c.at.Unix()
+		if bucket, ok := a.buckets[start]; ok && len(bucket.records) == 0 {
+			delete(a.buckets, start)
+			i := sort.Search(len(a.starts), func(i int) bool { return a.starts[i] >= start })
+			a.starts = append(a.starts[:i], a.starts[i+1:]...)
+		}
+	}
+}
+
+func (a *summaryAggregates) bucket(start int64) *summaryBucket {
+	if bucket, ok := a.buckets[start]; ok {
+		return bucket
+	}
+
+	bucket := &summaryBucket{
+		totals:  make(map[summaryKey]models.CurrencySummary),
+		records: make(map[uuid.UUID]struct{}),
+	}
+	a.buckets[start] = bucket
+	// Payments mostly arrive in time order, making this an append
+	i := sort.Search(len(a.starts), func(i int) bool { return a.starts[i] >= start })
+	a.starts = append(a.starts, 0)
+	copy(a.starts[i+1:], a.starts[i:])
+	a.starts[i] = start
+	return bucket
+}
+
+// windowTotals are the totals of a time window, before they are shaped
+// into a summary.
+type windowTotals struct {
+	totals map[summaryKey]models.CurrencySummary
+	failed int
+}
+
+// window adds up the buckets overlapping [from, to]. Buckets entirely
+// inside the window count whole; the one or two cut by from or to add only
+// the contributions inside it.
+func (a *summaryAggregates) window(from, to *time.Time) windowTotals {
+	first, last := 0, len(a.starts)
+	if from != nil {
+		first = sort.Search(len(a.starts), func(i int) bool { return a.starts[i] >= from.Unix() })
+	}
+	if to != nil {
+		last = sort.Search(len(a.starts), func(i int) bool { return a.starts[i] > to.Unix() })
+	}
+
+	w := windowTotals{totals: make(map[summaryKey]models.CurrencySummary)}
+	for _, start := range a.starts[first:max(first, last)] {
+		bucket := a.buckets[start]
+		whole := (from == nil || !time.Unix(start, 0).Before(*from)) &&
+			(to == nil || !time.Unix(start+1, -1).After(*to))
+		if whole {
+			for key, t := range bucket.totals {
+				w.totals[key] = addTotals(w.totals[key], t, 1)
+			}
+			w.failed += bucket.failed
+			continue
+		}
+
+		for id := range bucket.records {
+			for _, c := range a.contributions[id] {
+				if c.at.Unix() != start || !inRange(c.at, from, to) {
+					continue
+				}
+				if c.failed {
+					w.failed++
+				} else {
+					w.totals[c.key] = addTotals(w.totals[c.key], c.totals, 1)
+				}
+			}
+		}
+	}
+	return w
+}
+
+func (w windowTotals) summary() models.PaymentSummary {
+	summary := models.PaymentSummary{}
+	for key, t := range w.totals {
+		summary.AddTotals(key.processor, key.currency, t)
+	}
+	return summary
+}
+
+func (a *summaryAggregates) summary(from, to *time.Time) models.PaymentSummary {
+	return a.window(from, to).summary()
+}
+
+// series splits [from, to] into intervals of step seconds and sums each.
+// Without from or to the series starts or ends with the recorded traffic.
+func (a *summaryAggregates) series(from, to *time.Time, step int64) ([]models.SummaryPoint, error) {
+	if step <= 0 {
+		return nil, models.ErrInvalidInterval
+	}
+
+	points := []models.SummaryPoint{}
+	if (from == nil || to == nil) && len(a.starts) == 0 {
+		return points, nil
+	}
+	lo, hi := int64(0), int64(0)
+	if from != nil {
+		lo = from.Unix()
+	} else {
+		lo = a.starts[0]
+	}
+	if to != nil {
+		hi = to.Unix()
+	} else {
+		hi = a.starts[len(a.starts)-1]
+	}
+	if hi < lo {
+		return points, nil
+	}
+
+	first, last := floorDiv(lo, step)*step, floorDiv(hi, step)*step
+	if (last-first)/step >= models.MaxSeriesPoints {
+		return nil, models.ErrSeriesTooLong
+	}
+	for start := first; start <= last; start += step {
+		begin, end := time.Unix(start, 0).UTC(), time.Unix(start+step, -1).UTC()
+		if from != nil && from.After(begin) {
+			begin = *from
+		}
+		if to != nil && to.Before(end) {
+			end = *to
+		}
+		w := a.window(&begin, &end)
+		points = append(points, models.SummaryPoint{
+			Start:          time.Unix(start, 0).UTC(),
+			Processors:     w.summary(),
+			FailedPayments: w.failed,
+		})
+	}
+	return points, nil
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+func addTotals(a, b models.CurrencySummary, sign int) models.CurrencySummary {
+	return models.CurrencySummary{
+		TotalRequests:       a.TotalRequests + sign*b.TotalRequests,
+		TotalAmount:         a.TotalAmount + models.Money(sign)*b.TotalAmount,
+		TotalFee:            a.TotalFee + models.Money(sign)*b.TotalFee,
+		TotalNetAmount:      a.TotalNetAmount + models.Money(sign)*b.TotalNetAmount,
+		TotalRefunds:        a.TotalRefunds + sign*b.TotalRefunds,
+		TotalRefundedAmount: a.TotalRefundedAmount + models.Money(sign)*b.TotalRefundedAmount,
+	}
+}
@@ -0,0 +1,364 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"th_payment_processor/internal/models"
+)
+
+// FsyncPolicy controls when appended log entries are flushed to disk.
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs after every write; nothing acknowledged is ever lost.
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncInterval syncs in the background, bounding loss to one interval.
+	FsyncInterval FsyncPolicy = "interval"
+	// FsyncNever leaves flushing to the operating system.
+	FsyncNever FsyncPolicy = "never"
+)
+
+const (
+	walFileName      = "payments.wal"
+	snapshotFileName = "payments.snapshot"
+)
+
+type FileStorageOptions struct {
+	Dir              string
+	Fsync            FsyncPolicy
+	FsyncInterval    time.Duration
+	SnapshotInterval time.Duration
+}
+
+// FileStorage keeps payments in memory for queries and makes them durable
+// through an append-only write-ahead log that is periodically compacted
+// into a snapshot. On startup the snapshot and then the log are replayed.
+type FileStorage struct {
+	*InMemoryStorage
+
+	opts FileStorageOptions
+
+	fileMu     sync.Mutex
+	wal        *os.File
+	walEntries int
+	dirty      bool
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+var _ Store = (*FileStorage)(nil)
+
+func NewFileStorage(opts FileStorageOptions) (*FileStorage, error) {
+	switch opts.Fsync {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	case "":
+		opts.Fsync = FsyncInterval
+	default:
+		return nil, fmt.Errorf("unknown fsync policy: %s", opts.Fsync)
+	}
+	if opts.FsyncInterval <= 0 {
+		opts.FsyncInterval = time.Second
+	}
+	if opts.SnapshotInterval <= 0 {
+		opts.SnapshotInterval = time.Minute
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	s := &FileStorage{
+		InMemoryStorage: NewInMemoryStorage(),
+		opts:            opts,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(s.walPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+	s.wal = wal
+
+	go s.background()
+	return s, nil
+}
+
+func (s *FileStorage) StorePayment(record *models.PaymentRecord) error {
+	line, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	return s.appendLocked(record, line)
+}
+
+// ReservePayment holds fileMu across the lookup and the append so no other
+// write can slip in between them.
+func (s *FileStorage) ReservePayment(record *models.PaymentRecord) (*models.PaymentRecord, bool, error) {
+	line, err := encodeRecord(record)
+	if err != nil {
+		return nil, false, err
+	}
+
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+
+	if existing, exists := s.InMemoryStorage.GetPaymentByCorrelationID(record.CorrelationID); exists {
+		return existing, false, nil
+	}
+	if err := s.appendLocked(record, line); err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
+
+// appendLocked logs the encoded record and then applies it in memory.
+// Callers hold fileMu.
+func (s *FileStorage) appendLocked(record *models.PaymentRecord, line []byte) error {
+	if s.wal == nil {
+		return errors.New("file storage is closed")
+	}
+	if _, err := s.wal.Write(line); err != nil {
+		return fmt.Errorf("failed to append to write-ahead log: %w", err)
+	}
+	if s.opts.Fsync == FsyncAlways {
+		if err := s.wal.Sync(); err != nil {
+			return fmt.Errorf("failed to sync write-ahead log: %w", err)
+		}
+	} else {
+		s.dirty = true
+	}
+	s.walEntries++
+
+	// Only becomes visible once it is in the log
+	return s.InMemoryStorage.StorePayment(record)
+}
+
+// encodeRecord renders record as a single write-ahead log line.
+func encodeRecord(record *models.PaymentRecord) ([]byte, error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode payment: %w", err)
+	}
+	return append(line, '\n'), nil
+}
+
+// Compact writes every record to a fresh snapshot and truncates the log.
+func (s *FileStorage) Compact() error {
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if s.wal == nil {
+		return errors.New("file storage is closed")
+	}
+	return s.compactLocked()
+}
+
+// Close stops the background loop and syncs and closes the log. It is safe
+// to call more than once and from several goroutines; every call returns the
+// result of the first.
+func (s *FileStorage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+
+		s.fileMu.Lock()
+		defer s.fileMu.Unlock()
+
+		err := s.wal.Sync()
+		if closeErr := s.wal.Close(); err == nil {
+			err = closeErr
+		}
+		s.wal = nil
+		s.closeErr = err
+	})
+	return s.closeErr
+}
+
+func (s *FileStorage) background() {
+	defer close(s.done)
+
+	var syncTick <-chan time.Time
+	if s.opts.Fsync == FsyncInterval {
+		syncTicker := time.NewTicker(s.opts.FsyncInterval)
+		defer syncTicker.Stop()
+		syncTick = syncTicker.C
+	}
+	snapshotTicker := time.NewTicker(s.opts.SnapshotInterval)
+	defer snapshotTicker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-syncTick:
+			s.fileMu.Lock()
+			if s.dirty {
+				if err := s.wal.Sync(); err != nil {
+					logrus.Errorf("Failed to sync write-ahead log: %v", err)
+				} else {
+					s.dirty = false
+				}
+			}
+			s.fileMu.Unlock()
+		case <-snapshotTicker.C:
+			s.fileMu.Lock()
+			if s.walEntries > 0 {
+				if err := s.compactLocked(); err != nil {
+					logrus.Errorf("Failed to compact payment storage: %v", err)
+				}
+			}
+			s.fileMu.Unlock()
+		}
+	}
+}
+
+func (s *FileStorage) compactLocked() error {
+	records := s.InMemoryStorage.GetAllPayments()
+
+	tmpPath := s.snapshotPath() + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write snapshot: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.snapshotPath()); err != nil {
+		return fmt.Errorf("failed to install snapshot: %w", err)
+	}
+	if err := syncDir(s.opts.Dir); err != nil {
+		return err
+	}
+
+	// The snapshot now holds everything, so the log can start over. A crash
+	// before this point only means replaying entries the snapshot already has.
+	if err := s.wal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if err := s.wal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	s.walEntries = 0
+	s.dirty = false
+
+	logrus.Infof("Compacted payment storage: %d records in snapshot", len(records))
+	return nil
+}
+
+// recover loads the snapshot and replays the log on top of it. A torn final
+// log entry from a crash mid-write is discarded; corruption anywhere else is
+// reported as an error.
+func (s *FileStorage) recover() error {
+	snapshotCount, err := s.replay(s.snapshotPath(), false)
+	if err != nil {
+		return err
+	}
+	walCount, err := s.replay(s.walPath(), true)
+	if err != nil {
+		return err
+	}
+	s.walEntries = walCount
+
+	if snapshotCount > 0 || walCount > 0 {
+		logrus.Infof("Recovered payment storage: %d snapshot records, %d log entries", snapshotCount, walCount)
+	}
+	return nil
+}
+
+func (s *FileStorage) replay(path string, truncateTornTail bool) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open %s: %w", filepath.Base(path), err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	count := 0
+	for {
+		line, readErr := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var record models.PaymentRecord
+			complete := line[len(line)-1] == '\n'
+			if err := json.Unmarshal(line, &record); err != nil || !complete {
+				if _, peekErr := r.Peek(1); peekErr == io.EOF && truncateTornTail {
+					logrus.Warnf("Discarding torn entry at end of %s (offset %d)", filepath.Base(path), offset)
+					if err := os.Truncate(path, offset); err != nil {
+						return count, fmt.Errorf("failed to truncate torn entry: %w", err)
+					}
+					return count, nil
+				}
+				return count, fmt.Errorf("corrupt entry in %s at offset %d", filepath.Base(path), offset)
+			}
+			s.InMemoryStorage.StorePayment(&record)
+			offset += int64(len(line))
+			count++
+		}
+		if readErr == io.EOF {
+			return count, nil
+		}
+		if readErr != nil {
+			return count, fmt.Errorf("failed to read %s: %w", filepath.Base(path), readErr)
+		}
+	}
+}
+
+func (s *FileStorage) walPath() string {
+	return filepath.Join(s.opts.Dir, walFileName)
+}
+
+func (s *FileStorage) snapshotPath() string {
+	return filepath.Join(s.opts.Dir, snapshotFileName)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open storage directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync storage directory: %w", err)
+	}
+	return nil
+}
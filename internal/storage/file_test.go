@@ -0,0 +1,117 @@
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/storage"
+	"th_payment_processor/internal/storage/storagetest"
+)
+
+func openFileStorage(t *testing.T, dir string) *storage.FileStorage {
+	t.Helper()
+	store, err := storage.NewFileStorage(storage.FileStorageOptions{
+		Dir:   dir,
+		Fsync: storage.FsyncAlways,
+	})
+	if err != nil {
+		t.Fatalf("NewFileStorage failed: %v", err)
+	}
+	return store
+}
+
+func TestFileStorage(t *testing.T) {
+	storagetest.RunStoreTests(t, func(t *testing.T) storage.Store {
+		store := openFileStorage(t, t.TempDir())
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestFileStorage_RecoversFromSnapshotAndLog(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC()
+
+	store := openFileStorage(t, dir)
+	store.StorePayment(storagetest.NewRecord("before-snapshot", 10, "default", now))
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	store.StorePayment(storagetest.NewRecord("after-snapshot", 20, "fallback", now))
+	store.Close()
+
+	reopened := openFileStorage(t, dir)
+	defer reopened.Close()
+
+	if _, ok := reopened.GetPaymentByCorrelationID("before-snapshot"); !ok {
+		t.Error("Expected snapshot record to be recovered")
+	}
+	if _, ok := reopened.GetPaymentByCorrelationID("after-snapshot"); !ok {
+		t.Error("Expected log record to be recovered")
+	}
+
+	summary := reopened.GetPaymentsSummary(nil, nil)
+	if summary["default"].TotalRequests != 1 || summary["fallback"].TotalRequests != 1 {
+		t.Errorf("Unexpected summary after recovery: %+v", summary)
+	}
+}
+
+func TestFileStorage_DiscardsTornLogEntry(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openFileStorage(t, dir)
+	store.StorePayment(storagetest.NewRecord("complete", 10, "default", time.Now().UTC()))
+	store.Close()
+
+	// Simulate a crash halfway through appending the next entry
+	wal, err := os.OpenFile(filepath.Join(dir, "payments.wal"), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteString(`{"id":"6f1c`)
+	wal.Close()
+
+	reopened := openFileStorage(t, dir)
+	defer reopened.Close()
+
+	if all := reopened.GetAllPayments(); len(all) != 1 || all[0].CorrelationID != "complete" {
+		t.Fatalf("Expected only the complete entry to be recovered, got %d records", len(all))
+	}
+
+	// New writes must land after the truncated tail and survive another restart
+	reopened.StorePayment(storagetest.NewRecord("after-crash", 5, "default", time.Now().UTC()))
+	reopened.Close()
+
+	again := openFileStorage(t, dir)
+	defer again.Close()
+	if _, ok := again.GetPaymentByCorrelationID("after-crash"); !ok {
+		t.Error("Expected entry written after recovery to survive a restart")
+	}
+}
+
+func TestFileStorage_CloseIsIdempotent(t *testing.T) {
+	store := openFileStorage(t, t.TempDir())
+	store.StorePayment(storagetest.NewRecord("closing", 10, "default", time.Now().UTC()))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.Close(); err != nil {
+				t.Errorf("Close failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := store.Close(); err != nil {
+		t.Errorf("Expected a repeated Close to succeed, got %v", err)
+	}
+	if err := store.StorePayment(storagetest.NewRecord("late", 10, "default", time.Now().UTC())); err == nil {
+		t.Error("Expected writes after Close to fail")
+	}
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"th_payment_processor/internal/models"
+)
+
+// indexBucketSize bounds how many entries an insert or removal shifts.
+const indexBucketSize = 512
+
+type indexEntry[K cmp.Ordered] struct {
+	key K
+	id  uuid.UUID
+}
+
+// compare orders entries by key, then by ID so equal keys stay distinct.
+func (e indexEntry[K]) compare(o indexEntry[K]) int {
+	if c := cmp.Compare(e.key, o.key); c != 0 {
+		return c
+	}
+	return bytes.Compare(e.id[:], o.id[:])
+}
+
+// orderedIndex keeps (key, payment ID) entries sorted. Entries live in
+// buckets of at most 2*indexBucketSize, so random inserts cost a binary
+// search and a short copy instead of shifting the whole index.
+type orderedIndex[K cmp.Ordered] struct {
+	buckets [][]indexEntry[K]
+}
+
+// bucketFor returns the bucket that holds, or would hold, e.
+func (x *orderedIndex[K]) bucketFor(e indexEntry[K]) int {
+	i := sort.Search(len(x.buckets), func(i int) bool {
+		b := x.buckets[i]
+		return b[len(b)-1].compare(e) >= 0
+	})
+	if i == len(x.buckets) {
+		i--
+	}
+	return i
+}
+
+func searchBucket[K cmp.Ordered](b []indexEntry[K], e indexEntry[K]) int {
+	return sort.Search(len(b), func(j int) bool { return b[j].compare(e) >= 0 })
+}
+
+func (x *orderedIndex[K]) insert(key K, id uuid.UUID) {
+	e := indexEntry[K]{key: key, id: id}
+	if len(x.buckets) == 0 {
+		x.buckets = [][]indexEntry[K]{{e}}
+		return
+	}
+
+	i := x.bucketFor(e)
+	b := x.buckets[i]
+	j := searchBucket(b, e)
+	b = append(b, indexEntry[K]{})
+	copy(b[j+1:], b[j:])
+	b[j] = e
+
+	if len(b) > 2*indexBucketSize {
+		right := append([]indexEntry[K](nil), b[indexBucketSize:]...)
+		b = b[:indexBucketSize:indexBucketSize]
+		x.buckets = append(x.buckets, nil)
+		copy(x.buckets[i+2:], x.buckets[i+1:])
+		x.buckets[i+1] = right
+	}
+	x.buckets[i] = b
+}
+
+func (x *orderedIndex[K]) remove(key K, id uuid.UUID) {
+	if len(x.buckets) == 0 {
+		return
+	}
+	e := indexEntry[K]{key: key, id: id}
+	i := x.bucketFor(e)
+	b := x.buckets[i]
+	j := searchBucket(b, e)
+	if j == len(b) || b[j].compare(e) != 0 {
+		return
+	}
+
+	b = append(b[:j], b[j+1:]...)
+	if len(b) == 0 {
+		x.buckets = append(x.buckets[:i], x.buckets[i+1:]...)
+		return
+	}
+	x.buckets[i] = b
+}
+
+// ascend calls fn on every entry not below from, in ascending order, until
+// fn returns false.
+func (x *orderedIndex[K]) ascend(from indexEntry[K], fn func(indexEntry[K]) bool) {
+	if len(x.buckets) == 0 {
+		return
+	}
+	i := x.bucketFor(from)
+	for j := searchBucket(x.buckets[i], from); i < len(x.buckets); i, j = i+1, 0 {
+		for _, e := range x.buckets[i][j:] {
+			if !fn(e) {
+				return
+			}
+		}
+	}
+}
+
+// descend calls fn on every entry, or only those below before when it is
+// set, in descending order until fn returns false.
+func (x *orderedIndex[K]) descend(before *indexEntry[K], fn func(indexEntry[K]) bool) {
+	if len(x.buckets) == 0 {
+		return
+	}
+	i := len(x.buckets) - 1
+	j := len(x.buckets[i])
+	if before != nil {
+		i = x.bucketFor(*before)
+		j = searchBucket(x.buckets[i], *before)
+	}
+	for ; i >= 0; i-- {
+		if j < 0 {
+			j = len(x.buckets[i])
+		}
+		for k := j - 1; k >= 0; k-- {
+			if !fn(x.buckets[i][k]) {
+				return
+			}
+		}
+		j = -1
+	}
+}
+
+// indexedKeys are the values a payment was indexed under, kept so the
+// entries can be found again when the payment changes.
+type indexedKeys struct {
+	created       int64
+	processed     int64
+	hasProcessed  bool
+	amount        models.Money
+	correlationID string
+	processor     string
+	status        models.PaymentStatus
+}
+
+func keysOf(record *models.PaymentRecord) indexedKeys {
+	keys := indexedKeys{
+		created:       createdAt(record).UnixNano(),
+		amount:        record.Amount,
+		correlationID: record.CorrelationID,
+		processor:     record.Processor,
+		status:        record.Status,
+	}
+	if !record.ProcessedAt.IsZero() {
+		keys.processed = record.ProcessedAt.UnixNano()
+		keys.hasProcessed = true
+	}
+	return keys
+}
+
+// createdAt is when the payment was accepted. Records stored before
+// CreatedAt existed fall back to their first status or processing time.
+func createdAt(record *models.PaymentRecord) time.Time {
+	switch {
+	case !record.CreatedAt.IsZero():
+		return record.CreatedAt
+	case len(record.StatusHistory) > 0:
+		return record.StatusHistory[0].At
+	}
+	return record.ProcessedAt
+}
+
+// paymentIndex holds the secondary indexes GET /payments is served from.
+// Payments are listed in created order; the other indexes narrow down the
+// candidates for a filter.
+type paymentIndex struct {
+	keys        map[uuid.UUID]indexedKeys
+	created     orderedIndex[int64]
+	processed   orderedIndex[int64]
+	amount      orderedIndex[models.Money]
+	correlation orderedIndex[string]
+	byProcessor map[string]map[uuid.UUID]struct{}
+	byStatus    map[models.PaymentStatus]map[uuid.UUID]struct{}
+}
+
+func newPaymentIndex() *paymentIndex {
+	return &paymentIndex{
+		keys:        make(map[uuid.UUID]indexedKeys),
+		byProcessor: make(map[string]map[uuid.UUID]struct{}),
+		byStatus:    make(map[models.PaymentStatus]map[uuid.UUID]struct{}),
+	}
+}
+
+// put indexes record, moving its entries if any indexed value changed.
+func (x *paymentIndex) put(record *models.PaymentRecord) {
+	keys := keysOf(record)
+	if old, ok := x.keys[record.ID]; ok {
+		if old == keys {
+			return
+		}
+		x.delete(record.ID)
+	}
+
+	x.keys[record.ID] = keys
+	x.created.insert(keys.created, record.ID)
+	if keys.hasProcessed {
+		x.processed.insert(keys.processed, record.ID)
+	}
+	x.amount.insert(keys.amount, record.ID)
+	x.correlation.insert(keys.correlationID, record.ID)
+	addToSet(x.byProcessor, keys.processor, record.ID)
+	addToSet(x.byStatus, keys.status, record.ID)
+}
+
+func (x *paymentIndex) delete(id uuid.UUID) {
+	keys, ok := x.keys[id]
+	if !ok {
+		return
+	}
+
+	delete(x.keys, id)
+	x.created.remove(keys.created, id)
+	if keys.hasProcessed {
+		x.processed.remove(keys.processed, id)
+	}
+	x.amount.remove(keys.amount, id)
+	x.correlation.remove(keys.correlationID, id)
+	removeFromSet(x.byProcessor, keys.processor, id)
+	removeFromSet(x.byStatus, keys.status, id)
+}
+
+// candidates returns the IDs selected by the narrowest index covering one of
+// the query's filters, or false when walking the created index and
+// filtering as it goes is expected to be cheaper. Candidates still have to
+// be checked against the whole query.
+func (x *paymentIndex) candidates(query models.PaymentQuery, limit int) ([]uuid.UUID, bool) {
+	best := len(x.keys)
+	var collect func() []uuid.UUID
+
+	consider := func(size int, ids func() []uuid.UUID) {
+		if size < best {
+			best = size
+			collect = ids
+		}
+	}
+	if len(query.Processors) > 0 {
+		consider(setsSize(x.byProcessor, query.Processors), func() []uuid.UUID { return setsIDs(x.byProcessor, query.Processors) })
+	}
+	if len(query.Statuses) > 0 {
+		consider(setsSize(x.byStatus, query.Statuses), func() []uuid.UUID { return setsIDs(x.byStatus, query.Statuses) })
+	}
+
+	// Ranges are counted only up to the best size so far
+	if query.MinAmount != nil || query.MaxAmount != nil {
+		inRange := func(e indexEntry[models.Money]) bool { return query.MaxAmount == nil || e.key <= *query.MaxAmount }
+		from := indexEntry[models.Money]{key: math.MinInt64}
+		if query.MinAmount != nil {
+			from.key = *query.MinAmount
+		}
+		consider(rangeSize(&x.amount, from, inRange, best), func() []uuid.UUID { return rangeIDs(&x.amount, from, inRange) })
+	}
+	if query.ProcessedFrom != nil || query.ProcessedTo != nil {
+		inRange := func(e indexEntry[int64]) bool {
+			return query.ProcessedTo == nil || e.key <= query.ProcessedTo.UnixNano()
+		}
+		from := indexEntry[int64]{key: math.MinInt64}
+		if query.ProcessedFrom != nil {
+			from.key = query.ProcessedFrom.UnixNano()
+		}
+		consider(rangeSize(&x.processed, from, inRange, best), func() []uuid.UUID { return rangeIDs(&x.processed, from, inRange) })
+	}
+	if query.CorrelationIDPrefix != "" {
+		inRange := func(e indexEntry[string]) bool { return strings.HasPrefix(e.key, query.CorrelationIDPrefix) }
+		from := indexEntry[string]{key: query.CorrelationIDPrefix}
+		consider(rangeSize(&x.correlation, from, inRange, best), func() []uuid.UUID { return rangeIDs(&x.correlation, from, inRange) })
+	}
+
+	// Walking in created order stops after about limit*total/best entries;
+	// sorting the candidates costs best
+	if collect == nil || best*best > (limit+1)*len(x.keys) {
+		return nil, false
+	}
+	return collect(), true
+}
+
+func rangeSize[K cmp.Ordered](x *orderedIndex[K], from indexEntry[K], inRange func(indexEntry[K]) bool, max int) int {
+	n := 0
+	x.ascend(from, func(e indexEntry[K]) bool {
+		if !inRange(e) || n == max {
+			return false
+		}
+		n++
+		return true
+	})
+	return n
+}
+
+func rangeIDs[K cmp.Ordered](x *orderedIndex[K], from indexEntry[K], inRange func(indexEntry[K]) bool) []uuid.UUID {
+	var ids []uuid.UUID
+	x.ascend(from, func(e indexEntry[K]) bool {
+		if !inRange(e) {
+			return false
+		}
+		ids = append(ids, e.id)
+		return true
+	})
+	return ids
+}
+
+func setsSize[K comparable](sets map[K]map[uuid.UUID]struct{}, keys []K) int {
+	n := 0
+	for _, key := range keys {
+		n += len(sets[key])
+	}
+	return n
+}
+
+func setsIDs[K comparable](sets map[K]map[uuid.UUID]struct{}, keys []K) []uuid.UUID {
+	var ids []uuid.UUID
+	for _, key := range keys {
+		for id := range sets[key] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func addToSet[K comparable](sets map[K]map[uuid.UUID]struct{}, key K, id uuid.UUID) {
+	set, ok := sets[key]
+	if !ok {
+		set = make(map[uuid.UUID]struct{})
+		sets[key] = set
+	}
+	set[id] = struct{}{}
+}
+
+func removeFromSet[K comparable](sets map[K]map[uuid.UUID]struct{}, key K, id uuid.UUID) {
+	delete(sets[key], id)
+	if len(sets[key]) == 0 {
+		delete(sets, key)
+	}
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"th_payment_processor/internal/models"
+)
+
+// ListPayments serves a page from the indexes. A selective filter reads its
+// own index and sorts the matches; otherwise the created index is walked
+// newest first until the page is full, so a page never scans more records
+// than it has to.
+func (s *InMemoryStorage) ListPayments(query models.PaymentQuery) (models.PaymentPage, error) {
+	var after *indexEntry[int64]
+	if query.Cursor != "" {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return models.PaymentPage{}, err
+		}
+		after = &cursor
+	}
+	limit := query.PageSize()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matches []indexEntry[int64]
+	if ids, ok := s.index.candidates(query, limit); ok {
+		for _, id := range ids {
+			record := s.byID[id]
+			if !query.Matches(record) {
+				continue
+			}
+			e := indexEntry[int64]{key: s.index.keys[id].created, id: id}
+			if after != nil && e.compare(*after) >= 0 {
+				continue
+			}
+			matches = append(matches, e)
+		}
+		sort.Slice(matches, func(i, j int) bool { return matches[i].compare(matches[j]) > 0 })
+		if len(matches) > limit+1 {
+			matches = matches[:limit+1]
+		}
+	} else {
+		s.index.created.descend(after, func(e indexEntry[int64]) bool {
+			if query.Matches(s.byID[e.id]) {
+				matches = append(matches, e)
+			}
+			return len(matches) <= limit
+		})
+	}
+
+	page := models.PaymentPage{Payments: make([]*models.PaymentRecord, 0, min(len(matches), limit))}
+	if len(matches) > limit {
+		matches = matches[:limit]
+		page.NextCursor = encodeCursor(matches[limit-1])
+	}
+	for _, e := range matches {
+		copied := *s.byID[e.id]
+		page.Payments = append(page.Payments, &copied)
+	}
+	return page, nil
+}
+
+// A cursor is the position of the last payment on a page in the created
+// index. Clients treat it as opaque.
+func encodeCursor(e indexEntry[int64]) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(e.key, 10) + ":" + e.id.String()))
+}
+
+func decodeCursor(cursor string) (indexEntry[int64], error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return indexEntry[int64]{}, models.ErrInvalidCursor
+	}
+	key, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return indexEntry[int64]{}, models.ErrInvalidCursor
+	}
+	created, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return indexEntry[int64]{}, models.ErrInvalidCursor
+	}
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return indexEntry[int64]{}, models.ErrInvalidCursor
+	}
+	return indexEntry[int64]{key: created, id: parsed}, nil
+}
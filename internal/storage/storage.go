@@ -2,6 +2,7 @@ package storage
 
 import (
 	"fmt"
+	"th_payment_processor/internal/config"
 	"th_payment_processor/internal/models"
 	"sync"
 	"time"
@@ -9,29 +10,108 @@ import (
 	"github.com/google/uuid"
 )
 
+// Store is the persistence contract shared by every payment storage backend.
+// Records passed in and handed out are copies, so callers may mutate them freely.
+type Store interface {
+	StorePayment(record *models.PaymentRecord) error
+	// ReservePayment stores record only if no payment with its correlation ID
+	// exists yet. It reports whether record was stored; if not, it returns
+	// the payment already holding the correlation ID. The check and the write
+	// are atomic, so exactly one of several concurrent callers wins.
+	ReservePayment(record *models.PaymentRecord) (*models.PaymentRecord, bool, error)
+	GetPaymentByID(id uuid.UUID) (*models.PaymentRecord, bool)
+	GetPaymentByCorrelationID(correlationID string) (*models.PaymentRecord, bool)
+	GetPaymentsSummary(from, to *time.Time) models.PaymentSummary
+	// GetPaymentsSeries splits [from, to] into intervals and summarizes each,
+	// counting finally failed payments too. It fails with
+	// models.ErrSeriesTooLong past models.MaxSeriesPoints intervals.
+	GetPaymentsSeries(from, to *time.Time, interval time.Duration) ([]models.SummaryPoint, error)
+	GetAllPayments() []*models.PaymentRecord
+	// ListPayments returns one page of the payments matching query, newest
+	// first. It fails with models.ErrInvalidCursor for a malformed cursor.
+	ListPayments(query models.PaymentQuery) (models.PaymentPage, error)
+	Close() error
+}
+
+// Open builds the backend selected by cfg.StorageBackend.
+func Open(cfg *config.Config) (Store, error) {
+	switch cfg.StorageBackend {
+	case "", "memory":
+		return NewInMemoryStorage(), nil
+	case "file":
+		return NewFileStorage(FileStorageOptions{
+			Dir:              cfg.StorageDir,
+			Fsync:            FsyncPolicy(cfg.StorageFsync),
+			FsyncInterval:    cfg.StorageFsyncInterval,
+			SnapshotInterval: cfg.StorageSnapshotInterval,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.StorageBackend)
+	}
+}
+
+var _ Store = (*InMemoryStorage)(nil)
+
 type InMemoryStorage struct {
 	mu       sync.RWMutex
 	payments map[string]*models.PaymentRecord
 	byID     map[uuid.UUID]*models.PaymentRecord
+	index    *paymentIndex
+	totals   *summaryAggregates
 }
 
 func NewInMemoryStorage() *InMemoryStorage {
 	return &InMemoryStorage{
 		payments: make(map[string]*models.PaymentRecord),
 		byID:     make(map[uuid.UUID]*models.PaymentRecord),
+		index:    newPaymentIndex(),
+		totals:   newSummaryAggregates(),
 	}
 }
-func (s *InMemoryStorage) StorePayment(record *models.PaymentRecord) {
+func (s *InMemoryStorage) StorePayment(record *models.PaymentRecord) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.payments[record.CorrelationID] = record
-	s.byID[record.ID] = record
+	stored := *record
+	if previous, exists := s.payments[stored.CorrelationID]; exists && previous.ID != stored.ID {
+		delete(s.byID, previous.ID)
+		s.index.delete(previous.ID)
+		s.totals.delete(previous.ID)
+	}
+	s.payments[stored.CorrelationID] = &stored
+	s.byID[stored.ID] = &stored
+	s.index.put(&stored)
+	s.totals.put(&stored)
+	return nil
+}
 
-	// Debug logging
-	// fmt.Printf("[DEBUG] Stored payment: ID=%s, CorrelationID=%s, Amount=%.2f, Processor=%s, Success=%v\n",
-	// 	record.ID, record.CorrelationID, record.Amount, record.Processor, record.Success)
-	// fmt.Printf("[DEBUG] Total payments in storage: %d\n", len(s.payments))
+func (s *InMemoryStorage) ReservePayment(record *models.PaymentRecord) (*models.PaymentRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, exists := s.payments[record.CorrelationID]; exists {
+		copied := *existing
+		return &copied, false, nil
+	}
+
+	stored := *record
+	s.payments[stored.CorrelationID] = &stored
+	s.byID[stored.ID] = &stored
+	s.index.put(&stored)
+	s.totals.put(&stored)
+	return nil, true, nil
+}
+
+func (s *InMemoryStorage) GetPaymentByID(id uuid.UUID) (*models.PaymentRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, exists := s.byID[id]
+	if !exists {
+		return nil, false
+	}
+	copied := *record
+	return &copied, true
 }
 
 func (s *InMemoryStorage) GetPaymentByCorrelationID(correlationID string) (*models.PaymentRecord, bool) {
@@ -39,54 +119,32 @@ func (s *InMemoryStorage) GetPaymentByCorrelationID(correlationID string) (*mode
 	defer s.mu.RUnlock()
 
 	record, exists := s.payments[correlationID]
-	return record, exists
+	if !exists {
+		return nil, false
+	}
+	copied := *record
+	return &copied, true
 }
 
+// GetPaymentsSummary reads the pre-aggregated totals, so it costs the number
+// of seconds in the window with traffic rather than the number of payments.
 func (s *InMemoryStorage) GetPaymentsSummary(from, to *time.Time) models.PaymentSummary {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	summary := models.PaymentSummary{
-		Default:  models.ProcessorSummary{},
-		Fallback: models.ProcessorSummary{},
-	}
+	return s.totals.summary(from, to)
+}
 
-	fmt.Printf("[DEBUG] GetPaymentsSummary: Total payments in storage: %d\n", len(s.payments))
+func (s *InMemoryStorage) GetPaymentsSeries(from, to *time.Time, interval time.Duration) ([]models.SummaryPoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	for _, record := range s.payments {
-		fmt.Printf("[DEBUG] Processing record: ID=%s, Processor=%s, Success=%v, Amount=%.2f\n",
-			record.ID, record.Processor, record.Success, record.Amount)
-
-		// filter by time range if provided
-		if from != nil && record.ProcessedAt.Before(*from) {
-			fmt.Printf("[DEBUG] Skipping record due to 'from' filter: %s\n", record.ID)
-			continue
-		}
-		if to != nil && record.ProcessedAt.After(*to) {
-			fmt.Printf("[DEBUG] Skipping record due to 'to' filter: %s\n", record.ID)
-			continue
-		}
-
-		if record.Success {
-			switch record.Processor {
-			case "default":
-				summary.Default.TotalRequests++
-				summary.Default.TotalAmount += record.Amount
-				fmt.Printf("[DEBUG] Added to default summary: requests=%d, amount=%.2f\n",
-					summary.Default.TotalRequests, summary.Default.TotalAmount)
-			case "fallback":
-				summary.Fallback.TotalRequests++
-				summary.Fallback.TotalAmount += record.Amount
-				fmt.Printf("[DEBUG] Added to fallback summary: requests=%d, amount=%.2f\n",
-					summary.Fallback.TotalRequests, summary.Fallback.TotalAmount)
-			}
-		} else {
-			fmt.Printf("[DEBUG] Skipping unsuccessful payment: %s\n", record.ID)
-		}
-	}
+	return s.totals.series(from, to, int64(interval/time.Second))
+}
 
-	fmt.Printf("[DEBUG] Final summary - Default: %+v, Fallback: %+v\n", summary.Default, summary.Fallback)
-	return summary
+// inRange reports whether t falls within the optional [from, to] window.
+func inRange(t time.Time, from, to *time.Time) bool {
+	return (from == nil || !t.Before(*from)) && (to == nil || !t.After(*to))
 }
 
 func (s *InMemoryStorage) GetAllPayments() []*models.PaymentRecord {
@@ -95,7 +153,12 @@ func (s *InMemoryStorage) GetAllPayments() []*models.PaymentRecord {
 
 	records := make([]*models.PaymentRecord, 0, len(s.payments))
 	for _, record := range s.payments {
-		records = append(records, record)
+		copied := *record
+		records = append(records, &copied)
 	}
 	return records
 }
+
+func (s *InMemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,47 @@
+package storage_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"th_payment_processor/internal/storage"
+	"th_payment_processor/internal/storage/storagetest"
+)
+
+func TestInMemoryStorage(t *testing.T) {
+	storagetest.RunStoreTests(t, func(t *testing.T) storage.Store {
+		return storage.NewInMemoryStorage()
+	})
+}
+
+// BenchmarkGetPaymentsSummary compares the bucketed summary with scanning
+// every record, for a minute of traffic at growing rates. The bucketed cost
+// follows the seconds in the window; the scan follows the payment count.
+func BenchmarkGetPaymentsSummary(b *testing.B) {
+	base := time.Now().UTC().Truncate(time.Minute)
+	from, to := base.Add(5500*time.Millisecond), base.Add(54500*time.Millisecond)
+
+	for _, n := range []int{1000, 10000, 100000} {
+		store := storage.NewInMemoryStorage()
+		for i := 0; i < n; i++ {
+			processedAt := base.Add(time.Duration(i) * time.Minute / time.Duration(n))
+			record := storagetest.NewRecord(fmt.Sprintf("corr-%d", i), 1990, []string{"default", "fallback"}[i%2], processedAt)
+			if err := store.StorePayment(record); err != nil {
+				b.Fatal(err)
+			}
+		}
+		records := store.GetAllPayments()
+
+		b.Run(fmt.Sprintf("buckets/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				store.GetPaymentsSummary(&from, &to)
+			}
+		})
+		b.Run(fmt.Sprintf("scan/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				storagetest.ScanSummary(records, &from, &to)
+			}
+		})
+	}
+}
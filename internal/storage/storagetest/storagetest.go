@@ -0,0 +1,618 @@
+// Package storagetest provides the conformance suite every storage.Store
+// backend must pass.
+package storagetest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"th_payment_processor/internal/models"
+	"th_payment_processor/internal/storage"
+)
+
+// RunStoreTests exercises newStore against the storage.Store contract. Each
+// subtest gets a fresh, empty store.
+func RunStoreTests(t *testing.T, newStore func(t *testing.T) storage.Store) {
+	t.Run("StoreAndLookup", func(t *testing.T) {
+		testStoreAndLookup(t, newStore(t))
+	})
+	t.Run("MissingLookup", func(t *testing.T) {
+		testMissingLookup(t, newStore(t))
+	})
+	t.Run("UpdateReplacesRecord", func(t *testing.T) {
+		testUpdateReplacesRecord(t, newStore(t))
+	})
+	t.Run("ReservePayment", func(t *testing.T) {
+		testReservePayment(t, newStore(t))
+	})
+	t.Run("ConcurrentReservations", func(t *testing.T) {
+		testConcurrentReservations(t, newStore(t))
+	})
+	t.Run("RecordsAreCopied", func(t *testing.T) {
+		testRecordsAreCopied(t, newStore(t))
+	})
+	t.Run("Summary", func(t *testing.T) {
+		testSummary(t, newStore(t))
+	})
+	t.Run("SummaryTimeFilter", func(t *testing.T) {
+		testSummaryTimeFilter(t, newStore(t))
+	})
+	t.Run("SummaryRefunds", func(t *testing.T) {
+		testSummaryRefunds(t, newStore(t))
+	})
+	t.Run("SummaryCurrencies", func(t *testing.T) {
+		testSummaryCurrencies(t, newStore(t))
+	})
+	t.Run("SummaryWindows", func(t *testing.T) {
+		testSummaryWindows(t, newStore(t))
+	})
+	t.Run("Series", func(t *testing.T) {
+		testSeries(t, newStore(t))
+	})
+	t.Run("GetAllPayments", func(t *testing.T) {
+		testGetAllPayments(t, newStore(t))
+	})
+	t.Run("ListPayments", func(t *testing.T) {
+		testListPayments(t, newStore(t))
+	})
+	t.Run("ListPaymentsFilters", func(t *testing.T) {
+		testListPaymentsFilters(t, newStore(t))
+	})
+	t.Run("ListPaymentsAfterUpdate", func(t *testing.T) {
+		testListPaymentsAfterUpdate(t, newStore(t))
+	})
+}
+
+// NewRecord builds a successful payment record for use in backend tests.
+func NewRecord(correlationID string, amount models.Money, processor string, processedAt time.Time) *models.PaymentRecord {
+	return &models.PaymentRecord{
+		ID:            uuid.New(),
+		CorrelationID: correlationID,
+		Amount:        amount,
+		Processor:     processor,
+		CreatedAt:     processedAt,
+		ProcessedAt:   processedAt,
+		Success:       true,
+		Attempts:      1,
+		LastAttemptAt: processedAt,
+	}
+}
+
+func mustStore(t *testing.T, store storage.Store, record *models.PaymentRecord) {
+	t.Helper()
+	if err := store.StorePayment(record); err != nil {
+		t.Fatalf("StorePayment(%s) failed: %v", record.CorrelationID, err)
+	}
+}
+
+func testStoreAndLookup(t *testing.T, store storage.Store) {
+	record := NewRecord("corr-1", 1990, "default", time.Now().UTC())
+	mustStore(t, store, record)
+
+	byCorrelation, ok := store.GetPaymentByCorrelationID("corr-1")
+	if !ok {
+		t.Fatal("Expected payment to be found by correlation ID")
+	}
+	if byCorrelation.ID != record.ID || byCorrelation.Amount != record.Amount || byCorrelation.Processor != record.Processor {
+		t.Errorf("Lookup by correlation ID returned %+v, want %+v", byCorrelation, record)
+	}
+
+	byID, ok := store.GetPaymentByID(record.ID)
+	if !ok {
+		t.Fatal("Expected payment to be found by ID")
+	}
+	if byID.CorrelationID != "corr-1" {
+		t.Errorf("Lookup by ID returned correlation ID %s", byID.CorrelationID)
+	}
+}
+
+func testMissingLookup(t *testing.T, store storage.Store) {
+	if _, ok := store.GetPaymentByCorrelationID("missing"); ok {
+		t.Error("Expected missing correlation ID lookup to fail")
+	}
+	if _, ok := store.GetPaymentByID(uuid.New()); ok {
+		t.Error("Expected missing ID lookup to fail")
+	}
+}
+
+func testUpdateReplacesRecord(t *testing.T, store storage.Store) {
+	record := NewRecord("corr-update", 1000, "failed", time.Now().UTC())
+	record.Success = false
+	mustStore(t, store, record)
+
+	updated := *record
+	updated.Processor = "fallback"
+	updated.Success = true
+	updated.Attempts = 2
+	mustStore(t, store, &updated)
+
+	got, ok := store.GetPaymentByCorrelationID("corr-update")
+	if !ok || !got.Success || got.Processor != "fallback" || got.Attempts != 2 {
+		t.Errorf("Expected updated record, got %+v", got)
+	}
+	if all := store.GetAllPayments(); len(all) != 1 {
+		t.Errorf("Expected update to replace the record, got %d records", len(all))
+	}
+}
+
+func testReservePayment(t *testing.T, store storage.Store) {
+	first := NewRecord("corr-reserve", 1000, "default", time.Now().UTC())
+	if existing, reserved, err := store.ReservePayment(first); err != nil || !reserved || existing != nil {
+		t.Fatalf("Expected first reservation to win, got existing=%+v reserved=%v err=%v", existing, reserved, err)
+	}
+
+	second := NewRecord("corr-reserve", 2000, "fallback", time.Now().UTC())
+	existing, reserved, err := store.ReservePayment(second)
+	if err != nil || reserved {
+		t.Fatalf("Expected second reservation to lose, got reserved=%v err=%v", reserved, err)
+	}
+	if existing == nil || existing.ID != first.ID || existing.Amount != 1000 {
+		t.Errorf("Expected the original payment back, got %+v", existing)
+	}
+	if _, ok := store.GetPaymentByID(second.ID); ok {
+		t.Error("Losing reservation must not be stored")
+	}
+}
+
+func testConcurrentReservations(t *testing.T, store storage.Store) {
+	const callers = 16
+
+	var wg sync.WaitGroup
+	var winners atomic.Int32
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, reserved, err := store.ReservePayment(NewRecord("corr-race", 1000, "default", time.Now().UTC()))
+			if err != nil {
+				t.Errorf("ReservePayment failed: %v", err)
+			}
+			if reserved {
+				winners.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := winners.Load(); got != 1 {
+		t.Errorf("Expected exactly one reservation to win, got %d", got)
+	}
+	if all := store.GetAllPayments(); len(all) != 1 {
+		t.Errorf("Expected one stored payment, got %d", len(all))
+	}
+}
+
+func testRecordsAreCopied(t *testing.T, store storage.Store) {
+	record := NewRecord("corr-copy", 1000, "default", time.Now().UTC())
+	mustStore(t, store, record)
+
+	record.Amount = 99900
+	got, _ := store.GetPaymentByCorrelationID("corr-copy")
+	if got.Amount != 1000 {
+		t.Errorf("Mutating the stored record leaked into the store: amount=%v", got.Amount)
+	}
+
+	got.Processor = "fallback"
+	again, _ := store.GetPaymentByCorrelationID("corr-copy")
+	if again.Processor != "default" {
+		t.Errorf("Mutating a returned record leaked into the store: processor=%s", again.Processor)
+	}
+}
+
+func testSummary(t *testing.T, store storage.Store) {
+	now := time.Now().UTC()
+	mustStore(t, store, NewRecord("d-1", 1000, "default", now))
+	mustStore(t, store, NewRecord("d-2", 1550, "default", now))
+	mustStore(t, store, NewRecord("f-1", 2000, "fallback", now))
+
+	failed := NewRecord("x-1", 3000, "failed", now)
+	failed.Success = false
+	mustStore(t, store, failed)
+
+	summary := store.GetPaymentsSummary(nil, nil)
+	if summary["default"].TotalRequests != 2 || summary["default"].TotalAmount != 2550 {
+		t.Errorf("Unexpected default summary: %+v", summary["default"])
+	}
+	if summary["fallback"].TotalRequests != 1 || summary["fallback"].TotalAmount != 2000 {
+		t.Errorf("Unexpected fallback summary: %+v", summary["fallback"])
+	}
+}
+
+func testSummaryTimeFilter(t *testing.T, store storage.Store) {
+	base := time.Date(2025, 7, 10, 12, 0, 0, 0, time.UTC)
+	mustStore(t, store, NewRecord("early", 100, "default", base.Add(-time.Minute)))
+	mustStore(t, store, NewRecord("start", 200, "default", base))
+	mustStore(t, store, NewRecord("middle", 400, "fallback", base.Add(30*time.Second)))
+	mustStore(t, store, NewRecord("end", 800, "default", base.Add(time.Minute)))
+	mustStore(t, store, NewRecord("late", 1600, "default", base.Add(2*time.Minute)))
+
+	from := base
+	to := base.Add(time.Minute)
+	summary := store.GetPaymentsSummary(&from, &to)
+
+	// Both bounds are inclusive
+	if summary["default"].TotalRequests != 2 || summary["default"].TotalAmount != 1000 {
+		t.Errorf("Unexpected default summary: %+v", summary["default"])
+	}
+	if summary["fallback"].TotalRequests != 1 || summary["fallback"].TotalAmount != 400 {
+		t.Errorf("Unexpected fallback summary: %+v", summary["fallback"])
+	}
+}
+
+func testSummaryRefunds(t *testing.T, store storage.Store) {
+	base := time.Date(2025, 7, 10, 12, 0, 0, 0, time.UTC)
+	record := NewRecord("refunded", 1000, "default", base.Add(-time.Hour))
+	record.SetRefund(models.Refund{ID: uuid.New(), Amount: 300, Processor: "default", Status: models.RefundStatusSucceeded, RefundedAt: base})
+	record.SetRefund(models.Refund{ID: uuid.New(), Amount: 200, Processor: "default", Status: models.RefundStatusFailed, RefundedAt: base})
+	record.SetRefund(models.Refund{ID: uuid.New(), Amount: 100, Processor: "default", Status: models.RefundStatusSucceeded, RefundedAt: base.Add(time.Hour)})
+	mustStore(t, store, record)
+
+	got, _ := store.GetPaymentByCorrelationID("refunded")
+	if got.RefundedAmount != 400 || len(got.Refunds) != 3 {
+		t.Errorf("Expected refunds to be stored with the payment, got %+v", got)
+	}
+
+	// Refunds count by when they happened, even if the payment is outside the window
+	from := base
+	to := base.Add(time.Minute)
+	summary := store.GetPaymentsSummary(&from, &to)
+	if d := summary["default"]; d.TotalRequests != 0 || d.TotalRefunds != 1 || d.TotalRefundedAmount != 300 {
+		t.Errorf("Unexpected windowed refund summary: %+v", d)
+	}
+
+	summary = store.GetPaymentsSummary(nil, nil)
+	if d := summary["default"]; d.TotalAmount != 1000 || d.TotalRefunds != 2 || d.TotalRefundedAmount != 400 {
+		t.Errorf("Unexpected refund summary: %+v", d)
+	}
+}
+
+func testSummaryCurrencies(t *testing.T, store storage.Store) {
+	now := time.Now().UTC()
+	mustStore(t, store, NewRecord("legacy", 1000, "default", now))
+	brl := NewRecord("brl", 500, "default", now)
+	brl.Currency = "BRL"
+	mustStore(t, store, brl)
+	jpy := NewRecord("jpy", 70000, "default", now)
+	jpy.Currency = "JPY"
+	jpy.SetRefund(models.Refund{ID: uuid.New(), Amount: 10000, Processor: "default", Status: models.RefundStatusSucceeded, RefundedAt: now})
+	mustStore(t, store, jpy)
+
+	d := store.GetPaymentsSummary(nil, nil)["default"]
+	// The processor totals only hold the default currency
+	if d.TotalRequests != 2 || d.TotalAmount != 1500 || d.TotalRefunds != 0 || d.TotalRefundedAmount != 0 {
+		t.Errorf("Unexpected processor totals: %+v", d)
+	}
+	// Records without a currency count as the default currency
+	if got := d.Currencies["BRL"]; got.TotalRequests != 2 || got.TotalAmount != 1500 || got.TotalRefunds != 0 {
+		t.Errorf("Unexpected BRL totals: %+v", got)
+	}
+	if got := d.Currencies["JPY"]; got.TotalRequests != 1 || got.TotalAmount != 70000 || got.TotalRefunds != 1 || got.TotalRefundedAmount != 10000 {
+		t.Errorf("Unexpected JPY totals: %+v", got)
+	}
+}
+
+// ScanSummary computes a summary the slow way, record by record. Backends
+// are checked against it and benchmarked against it.
+func ScanSummary(records []*models.PaymentRecord, from, to *time.Time) models.PaymentSummary {
+	in := func(t time.Time) bool {
+		return (from == nil || !t.Before(*from)) && (to == nil || !t.After(*to))
+	}
+	summary := models.PaymentSummary{}
+	for _, record := range records {
+		if record.Success && in(record.ProcessedAt) {
+			summary.AddPayment(record.Processor, record.Currency.OrDefault(), record.Amount, record.Fee)
+		}
+		for _, refund := range record.Refunds {
+			if refund.Status == models.RefundStatusSucceeded && !refund.Duplicate && in(refund.RefundedAt) {
+				summary.AddRefund(refund.Processor, record.Currency.OrDefault(), refund.Amount)
+			}
+		}
+	}
+	return summary
+}
+
+func testSummaryWindows(t *testing.T, store storage.Store) {
+	base := time.Now().UTC().Truncate(time.Second)
+	at := func(ms int) time.Time { return base.Add(time.Duration(ms) * time.Millisecond) }
+
+	var records []*models.PaymentRecord
+	for i := 0; i < 300; i++ {
+		processor := []string{"default", "fallback"}[i%2]
+		record := NewRecord(fmt.Sprintf("corr-%d", i), models.Money(100+i), processor, at(i*37))
+		record.SetFee(models.FeeFor(record.Amount, []float64{1, 5}[i%2], record.Currency))
+		if i%3 == 0 {
+			record.Currency = "USD"
+		}
+		record.Success = i%7 != 0
+		mustStore(t, store, record)
+		records = append(records, record)
+	}
+
+	// Later writes move totals between buckets and processors
+	for i, record := range records {
+		updated := *record
+		switch i % 5 {
+		case 0:
+			updated.Success = !updated.Success
+		case 1:
+			updated.ProcessedAt = at(i*37 + 1500)
+		case 2:
+			updated.SetRefund(models.Refund{ID: uuid.New(), Amount: 10, Processor: "default", Status: models.RefundStatusSucceeded, RefundedAt: at(i*37 + 10)})
+			updated.SetRefund(models.Refund{ID: uuid.New(), Amount: 5, Processor: "fallback", Status: models.RefundStatusSucceeded, RefundedAt: at(i*37 + 2600)})
+		case 3:
+			// A new payment takes over the correlation ID
+			updated = *NewRecord(record.CorrelationID, 999, "fallback", at(i*37+400))
+		default:
+			continue
+		}
+		mustStore(t, store, &updated)
+	}
+
+	all := store.GetAllPayments()
+	windows := []struct{ from, to int }{
+		{0, 12000}, {250, 250}, {999, 1000}, {1000, 1999}, {1001, 5432}, {-5000, 500}, {7777, 20000}, {3000, 2000},
+	}
+	for _, w := range windows {
+		from, to := at(w.from), at(w.to)
+		got, want := store.GetPaymentsSummary(&from, &to), ScanSummary(all, &from, &to)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Window %dms-%dms: got %+v, want %+v", w.from, w.to, got, want)
+		}
+	}
+
+	from := at(4321)
+	if got, want := store.GetPaymentsSummary(&from, nil), ScanSummary(all, &from, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("Open-ended window: got %+v, want %+v", got, want)
+	}
+	if got, want := store.GetPaymentsSummary(nil, nil), ScanSummary(all, nil, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unbounded summary: got %+v, want %+v", got, want)
+	}
+}
+
+func testSeries(t *testing.T, store storage.Store) {
+	base := time.Now().UTC().Truncate(time.Hour)
+	at := func(seconds int) time.Time { return base.Add(time.Duration(seconds) * time.Second) }
+
+	mustStore(t, store, NewRecord("early", 100, "default", at(5)))
+	mustStore(t, store, NewRecord("a", 200, "default", at(65)))
+	mustStore(t, store, NewRecord("b", 300, "default", at(70)))
+	mustStore(t, store, NewRecord("c", 400, "fallback", at(130)))
+	failed := models.NewPaymentRecord("failed", 500, at(60))
+	for _, status := range []models.PaymentStatus{models.PaymentStatusProcessing, models.PaymentStatusFailed} {
+		if err := failed.Transition(status, at(75), "retries exhausted"); err != nil {
+			t.Fatalf("Transition failed: %v", err)
+		}
+	}
+	mustStore(t, store, failed)
+
+	from, to := at(30), at(190)
+	points, err := store.GetPaymentsSeries(&from, &to, time.Minute)
+	if err != nil {
+		t.Fatalf("GetPaymentsSeries failed: %v", err)
+	}
+	want := []struct{ requests, failed int }{{0, 0}, {2, 1}, {1, 0}, {0, 0}}
+	if len(points) != len(want) {
+		t.Fatalf("Expected %d points, got %+v", len(want), points)
+	}
+	for i, point := range points {
+		start := at(60 * i)
+		if !point.Start.Equal(start) {
+			t.Errorf("Point %d starts at %s, want %s", i, point.Start, start)
+		}
+		requests := 0
+		for _, p := range point.Processors {
+			requests += p.TotalRequests
+		}
+		if requests != want[i].requests || point.FailedPayments != want[i].failed {
+			t.Errorf("Point %d: %d requests and %d failed, want %+v", i, requests, point.FailedPayments, want[i])
+		}
+
+		// Each point is the summary of its part of the window
+		begin, end := start, start.Add(time.Minute-time.Nanosecond)
+		if begin.Before(from) {
+			begin = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if summary := store.GetPaymentsSummary(&begin, &end); !reflect.DeepEqual(point.Processors, summary) {
+			t.Errorf("Point %d: processors %+v, summary of its window %+v", i, point.Processors, summary)
+		}
+	}
+
+	// Without bounds the series spans the recorded traffic
+	points, err = store.GetPaymentsSeries(nil, nil, time.Minute)
+	if err != nil || len(points) != 3 || !points[0].Start.Equal(base) || points[0].Processors["default"].TotalAmount != 100 {
+		t.Errorf("Unexpected unbounded series: %+v, %v", points, err)
+	}
+
+	far := at(10 * models.MaxSeriesPoints)
+	if _, err := store.GetPaymentsSeries(&from, &far, time.Second); !errors.Is(err, models.ErrSeriesTooLong) {
+		t.Errorf("Expected ErrSeriesTooLong, got %v", err)
+	}
+}
+
+func testGetAllPayments(t *testing.T, store storage.Store) {
+	if all := store.GetAllPayments(); len(all) != 0 {
+		t.Fatalf("Expected empty store, got %d records", len(all))
+	}
+
+	now := time.Now().UTC()
+	for _, id := range []string{"a", "b", "c"} {
+		mustStore(t, store, NewRecord(id, 100, "default", now))
+	}
+
+	seen := make(map[string]bool)
+	for _, record := range store.GetAllPayments() {
+		seen[record.CorrelationID] = true
+	}
+	if len(seen) != 3 || !seen["a"] || !seen["b"] || !seen["c"] {
+		t.Errorf("Unexpected payments listed: %v", seen)
+	}
+}
+
+// listAll follows NextCursor until the last page and returns every
+// correlation ID in the order listed.
+func listAll(t *testing.T, store storage.Store, query models.PaymentQuery) []string {
+	t.Helper()
+	var ids []string
+	for pages := 0; ; pages++ {
+		if pages > 10000 {
+			t.Fatal("Pagination did not terminate")
+		}
+		page, err := store.ListPayments(query)
+		if err != nil {
+			t.Fatalf("ListPayments(%+v) failed: %v", query, err)
+		}
+		if len(page.Payments) > query.PageSize() {
+			t.Fatalf("Page holds %d payments, limit is %d", len(page.Payments), query.PageSize())
+		}
+		for _, record := range page.Payments {
+			ids = append(ids, record.CorrelationID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+func testListPayments(t *testing.T, store storage.Store) {
+	page, err := store.ListPayments(models.PaymentQuery{})
+	if err != nil || len(page.Payments) != 0 || page.NextCursor != "" {
+		t.Fatalf("Expected an empty page, got %+v, %v", page, err)
+	}
+
+	// Enough payments to span several index buckets, some sharing a timestamp
+	base := time.Now().UTC().Truncate(time.Second)
+	const total = 2500
+	for i := 0; i < total; i++ {
+		mustStore(t, store, NewRecord(fmt.Sprintf("corr-%04d", i), 100, "default", base.Add(time.Duration(i/2)*time.Millisecond)))
+	}
+
+	ids := listAll(t, store, models.PaymentQuery{Limit: 7})
+	if len(ids) != total {
+		t.Fatalf("Expected %d payments across pages, got %d", total, len(ids))
+	}
+	seen := make(map[string]bool, total)
+	for i, id := range ids {
+		if seen[id] {
+			t.Fatalf("Payment %s listed twice", id)
+		}
+		seen[id] = true
+		// Newest first: pairs created at the same time may come in either order
+		if want := total - 1 - i; id[5:] != fmt.Sprintf("%04d", want) && id[5:] != fmt.Sprintf("%04d", want^1) {
+			t.Fatalf("Position %d holds %s, expected corr-%04d", i, id, want)
+		}
+	}
+
+	page, err = store.ListPayments(models.PaymentQuery{})
+	if err != nil || len(page.Payments) != models.DefaultPageSize || page.NextCursor == "" {
+		t.Errorf("Expected a full default page with a cursor, got %d payments, cursor %q, %v", len(page.Payments), page.NextCursor, err)
+	}
+
+	if _, err := store.ListPayments(models.PaymentQuery{Cursor: "not a cursor"}); !errors.Is(err, models.ErrInvalidCursor) {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+}
+
+func testListPaymentsFilters(t *testing.T, store storage.Store) {
+	base := time.Now().UTC().Truncate(time.Second)
+	for i := 0; i < 1000; i++ {
+		processor := "default"
+		if i%10 == 0 {
+			processor = "fallback"
+		}
+		record := NewRecord(fmt.Sprintf("order-%03d-%d", i/10, i%10), models.Money(i*100), processor, base.Add(time.Duration(i)*time.Second))
+		record.Status = models.PaymentStatusSucceeded
+		if i%100 == 0 {
+			record.Status = models.PaymentStatusFailed
+			record.Success = false
+		}
+		if i%250 == 1 {
+			// Not processed yet: never matches a processedAt range
+			record.Status = models.PaymentStatusPending
+			record.ProcessedAt = time.Time{}
+		}
+		mustStore(t, store, record)
+	}
+
+	minAmount, maxAmount := models.Money(10000), models.Money(10999)
+	from, to := base.Add(500*time.Second), base.Add(999*time.Second)
+	fallback := []string{"fallback"}
+
+	tests := []struct {
+		name  string
+		query models.PaymentQuery
+		want  int
+	}{
+		{"processor", models.PaymentQuery{Processors: fallback}, 100},
+		{"processors", models.PaymentQuery{Processors: []string{"default", "fallback"}}, 1000},
+		{"status", models.PaymentQuery{Statuses: []models.PaymentStatus{models.PaymentStatusFailed}}, 10},
+		{"statuses", models.PaymentQuery{Statuses: []models.PaymentStatus{models.PaymentStatusFailed, models.PaymentStatusPending}}, 14},
+		{"amount range", models.PaymentQuery{MinAmount: &minAmount, MaxAmount: &maxAmount}, 10},
+		{"min amount", models.PaymentQuery{MinAmount: &minAmount}, 900},
+		{"processed range", models.PaymentQuery{ProcessedFrom: &from, ProcessedTo: &to}, 498},
+		{"processed to", models.PaymentQuery{ProcessedTo: &from}, 499},
+		{"prefix", models.PaymentQuery{CorrelationIDPrefix: "order-04"}, 100},
+		{"exact prefix", models.PaymentQuery{CorrelationIDPrefix: "order-042-3"}, 1},
+		{"combined", models.PaymentQuery{Processors: fallback, CorrelationIDPrefix: "order-0", ProcessedFrom: &from}, 50},
+		{"no match", models.PaymentQuery{CorrelationIDPrefix: "missing"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, limit := range []int{1, 3, models.MaxPageSize} {
+				query := tt.query
+				query.Limit = limit
+				ids := listAll(t, store, query)
+				if len(ids) != tt.want {
+					t.Fatalf("Limit %d: expected %d payments, got %d", limit, tt.want, len(ids))
+				}
+				for i, id := range ids {
+					record, _ := store.GetPaymentByCorrelationID(id)
+					if !query.Matches(record) {
+						t.Fatalf("Limit %d: %s does not match the query", limit, id)
+					}
+					if i > 0 && ids[i-1] < id {
+						t.Fatalf("Limit %d: %s listed before newer %s", limit, ids[i-1], id)
+					}
+				}
+			}
+		})
+	}
+}
+
+func testListPaymentsAfterUpdate(t *testing.T, store storage.Store) {
+	now := time.Now().UTC()
+	record := NewRecord("corr-update", 1000, "default", now)
+	record.Status = models.PaymentStatusPending
+	mustStore(t, store, record)
+
+	updated := *record
+	updated.Status = models.PaymentStatusSucceeded
+	updated.Processor = "fallback"
+	mustStore(t, store, &updated)
+
+	query := models.PaymentQuery{Statuses: []models.PaymentStatus{models.PaymentStatusPending}}
+	if ids := listAll(t, store, query); len(ids) != 0 {
+		t.Errorf("Expected the old status to be unindexed, got %v", ids)
+	}
+	query = models.PaymentQuery{Processors: []string{"fallback"}, Statuses: []models.PaymentStatus{models.PaymentStatusSucceeded}}
+	if ids := listAll(t, store, query); len(ids) != 1 {
+		t.Errorf("Expected the updated payment to be listed once, got %v", ids)
+	}
+
+	// A new payment taking over the correlation ID replaces the old one
+	replacement := NewRecord("corr-update", 2000, "default", now.Add(time.Second))
+	mustStore(t, store, replacement)
+	page, err := store.ListPayments(models.PaymentQuery{})
+	if err != nil || len(page.Payments) != 1 || page.Payments[0].ID != replacement.ID {
+		t.Errorf("Expected only the replacement to be listed, got %+v, %v", page.Payments, err)
+	}
+}
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"errors"
+	"io"
 	"net/http"
 	"time"
 	"payment-processors/models"
@@ -37,9 +39,14 @@ func (h *PaymentHandler) ProcessPayment(c *gin.Context) {
 		return
 	}
 	
-	// Apply delay if configured
+	// Apply delay if configured; a client that gives up meanwhile is not charged
 	if config.Delay > 0 {
-		time.Sleep(time.Duration(config.Delay) * time.Millisecond)
+		select {
+		case <-time.After(time.Duration(config.Delay) * time.Millisecond):
+		case <-c.Request.Context().Done():
+			logrus.Warnf("Payment %s abandoned by client before processing", req.CorrelationID)
+			return
+		}
 	}
 	
 	// Calculate fee
@@ -50,6 +57,7 @@ func (h *PaymentHandler) ProcessPayment(c *gin.Context) {
 		ID:            uuid.New(),
 		CorrelationID: req.CorrelationID,
 		Amount:        req.Amount,
+		Currency:      req.Currency,
 		RequestedAt:   req.RequestedAt,
 		ProcessedAt:   time.Now(),
 		Fee:           fee,
@@ -63,27 +71,162 @@ func (h *PaymentHandler) ProcessPayment(c *gin.Context) {
 	
 	c.JSON(http.StatusOK, models.PaymentResponse{
 		Message: "payment processed successfully",
+		Fee:     record.Fee,
 	})
 }
 
 // GetPaymentDetails handles GET /payments/{id}
+// The id may be the processor's payment ID or the client's correlationId.
 func (h *PaymentHandler) GetPaymentDetails(c *gin.Context) {
 	idStr := c.Param("id")
-	id, err := uuid.Parse(idStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payment ID"})
+	
+	var record *models.PaymentRecord
+	exists := false
+	if id, err := uuid.Parse(idStr); err == nil {
+		record, exists = h.storage.GetPayment(id)
+	}
+	if !exists {
+		record, exists = h.storage.GetPaymentByCorrelationID(idStr)
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
 		return
 	}
 	
-	record, exists := h.storage.GetPayment(id)
-	if !exists {
+	c.JSON(http.StatusOK, record)
+}
+
+// RefundPayment handles POST /payments/{id}/refunds
+// The id may be the processor's payment ID or the client's correlationId.
+func (h *PaymentHandler) RefundPayment(c *gin.Context) {
+	var req models.RefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		logrus.Errorf("Invalid refund request: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	
+	config := h.storage.GetConfig()
+	
+	// Refunds fail along with payments
+	if config.Failure {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment processor is failing"})
+		return
+	}
+	
+	refund, err := h.storage.RefundPayment(c.Param("id"), req.RefundID, req.Amount)
+	switch {
+	case errors.Is(err, storage.ErrPaymentNotFound):
 		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
 		return
+	case errors.Is(err, storage.ErrRefundExceedsPayment):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Refund exceeds the remaining payment amount"})
+		return
+	case errors.Is(err, storage.ErrRefundMismatch):
+		c.JSON(http.StatusConflict, gin.H{"error": "Refund ID already used for a different refund"})
+		return
+	}
+	
+	logrus.Infof("Refund processed: %s, payment: %s, amount: %.2f",
+		refund.ID, refund.CorrelationID, refund.Amount)
+	
+	c.JSON(http.StatusOK, refund)
+}
+
+// AuthorizePayment handles POST /payments/authorize
+func (h *PaymentHandler) AuthorizePayment(c *gin.Context) {
+	var req models.AuthorizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		logrus.Errorf("Invalid authorization request: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	
+	config := h.storage.GetConfig()
+	
+	if config.Failure {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment processor is failing"})
+		return
+	}
+	
+	// Apply delay if configured; a client that gives up meanwhile holds nothing
+	if config.Delay > 0 {
+		select {
+		case <-time.After(time.Duration(config.Delay) * time.Millisecond):
+		case <-c.Request.Context().Done():
+			logrus.Warnf("Authorization %s abandoned by client before processing", req.CorrelationID)
+			return
+		}
+	}
+	
+	auth, err := h.storage.Authorize(&req)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "correlationId already used for a different payment"})
+		return
+	}
+	
+	logrus.Infof("Payment authorized: %s, amount: %.2f, expires: %s",
+		auth.CorrelationID, auth.Amount, auth.ExpiresAt.Format(time.RFC3339))
+	
+	c.JSON(http.StatusOK, auth)
+}
+
+// CapturePayment handles POST /payments/{id}/capture
+// The id may be the authorization ID or the client's correlationId.
+func (h *PaymentHandler) CapturePayment(c *gin.Context) {
+	var req models.CaptureRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	
+	if h.storage.GetConfig().Failure {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment processor is failing"})
+		return
 	}
 	
+	record, err := h.storage.Capture(c.Param("id"), req.Amount)
+	if err != nil {
+		h.authorizationError(c, err)
+		return
+	}
+	
+	logrus.Infof("Payment captured: %s, amount: %.2f, fee: %.2f",
+		record.CorrelationID, record.Amount, record.Fee)
+	
 	c.JSON(http.StatusOK, record)
 }
 
+// VoidPayment handles POST /payments/{id}/void
+// The id may be the authorization ID or the client's correlationId.
+func (h *PaymentHandler) VoidPayment(c *gin.Context) {
+	if h.storage.GetConfig().Failure {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Payment processor is failing"})
+		return
+	}
+	
+	auth, err := h.storage.Void(c.Param("id"))
+	if err != nil {
+		h.authorizationError(c, err)
+		return
+	}
+	
+	logrus.Infof("Authorization voided: %s", auth.CorrelationID)
+	
+	c.JSON(http.StatusOK, auth)
+}
+
+func (h *PaymentHandler) authorizationError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, storage.ErrAuthorizationNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authorization not found"})
+	case errors.Is(err, storage.ErrCaptureExceedsAuthorization):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Capture exceeds the authorized amount"})
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": "Authorization is no longer open"})
+	}
+}
+
 // GetServiceHealth handles GET /payments/service-health
 func (h *PaymentHandler) GetServiceHealth(c *gin.Context) {
 	config := h.storage.GetConfig()
@@ -36,6 +36,10 @@ func main() {
 	// Setup routes
 	router.POST("/payments", handler.ProcessPayment)
 	router.GET("/payments/:id", handler.GetPaymentDetails)
+	router.POST("/payments/:id/refunds", handler.RefundPayment)
+	router.POST("/payments/authorize", handler.AuthorizePayment)
+	router.POST("/payments/:id/capture", handler.CapturePayment)
+	router.POST("/payments/:id/void", handler.VoidPayment)
 	router.GET("/payments/service-health", handler.GetServiceHealth)
 	
 	// Admin routes
@@ -8,20 +8,69 @@ import (
 type PaymentRequest struct {
 	CorrelationID string    `json:"correlationId" binding:"required"`
 	Amount        float64   `json:"amount" binding:"required,gt=0"`
+	Currency      string    `json:"currency"`
 	RequestedAt   time.Time `json:"requestedAt" binding:"required"`
 }
 
 type PaymentResponse struct {
-	Message string `json:"message"`
+	Message string  `json:"message"`
+	Fee     float64 `json:"fee"`
 }
 
 type PaymentRecord struct {
-	ID            uuid.UUID `json:"id"`
+	ID             uuid.UUID `json:"id"`
+	CorrelationID  string    `json:"correlationId"`
+	Amount         float64   `json:"amount"`
+	Currency       string    `json:"currency,omitempty"`
+	RequestedAt    time.Time `json:"requestedAt"`
+	ProcessedAt    time.Time `json:"processedAt"`
+	Fee            float64   `json:"fee"`
+	RefundedAmount float64   `json:"refundedAmount"`
+}
+
+type RefundRequest struct {
+	RefundID    string    `json:"refundId" binding:"required"`
+	Amount      float64   `json:"amount" binding:"required,gt=0"`
+	RequestedAt time.Time `json:"requestedAt"`
+}
+
+type RefundRecord struct {
+	ID            string    `json:"id"`
+	PaymentID     uuid.UUID `json:"paymentId"`
 	CorrelationID string    `json:"correlationId"`
 	Amount        float64   `json:"amount"`
+	RefundedAt    time.Time `json:"refundedAt"`
+}
+
+type AuthorizationRequest struct {
+	CorrelationID string    `json:"correlationId" binding:"required"`
+	Amount        float64   `json:"amount" binding:"required,gt=0"`
+	Currency      string    `json:"currency"`
 	RequestedAt   time.Time `json:"requestedAt"`
-	ProcessedAt   time.Time `json:"processedAt"`
-	Fee           float64   `json:"fee"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+}
+
+// CaptureRequest captures Amount of a hold; zero captures all of it.
+type CaptureRequest struct {
+	Amount float64 `json:"amount" binding:"gte=0"`
+}
+
+const (
+	AuthorizationAuthorized = "authorized"
+	AuthorizationCaptured   = "captured"
+	AuthorizationVoided     = "voided"
+	AuthorizationExpired    = "expired"
+)
+
+type AuthorizationRecord struct {
+	ID             uuid.UUID `json:"id"`
+	CorrelationID  string    `json:"correlationId"`
+	Amount         float64   `json:"amount"`
+	Currency       string    `json:"currency,omitempty"`
+	CapturedAmount float64   `json:"capturedAmount"`
+	Status         string    `json:"status"`
+	AuthorizedAt   time.Time `json:"authorizedAt"`
+	ExpiresAt      time.Time `json:"expiresAt"`
 }
 
 type HealthCheckResponse struct {
@@ -30,10 +79,12 @@ type HealthCheckResponse struct {
 }
 
 type PaymentSummary struct {
-	TotalRequests     int     `json:"totalRequests"`
-	TotalAmount       float64 `json:"totalAmount"`
-	TotalFee          float64 `json:"totalFee"`
-	FeePerTransaction float64 `json:"feePerTransaction"`
+	TotalRequests       int     `json:"totalRequests"`
+	TotalAmount         float64 `json:"totalAmount"`
+	TotalFee            float64 `json:"totalFee"`
+	FeePerTransaction   float64 `json:"feePerTransaction"`
+	TotalRefunds        int     `json:"totalRefunds"`
+	TotalRefundedAmount float64 `json:"totalRefundedAmount"`
 }
 
 type Config struct {
@@ -1,21 +1,44 @@
 package storage
 
 import (
+	"errors"
+	"math"
 	"sync"
 	"time"
 	"payment-processors/models"
 	"github.com/google/uuid"
 )
 
+var (
+	ErrPaymentNotFound      = errors.New("payment not found")
+	ErrRefundExceedsPayment = errors.New("refund exceeds the remaining payment amount")
+	ErrRefundMismatch       = errors.New("refund ID already used for a different refund")
+	
+	ErrAuthorizationNotFound       = errors.New("authorization not found")
+	ErrAuthorizationMismatch       = errors.New("correlationId already used for a different payment")
+	ErrAuthorizationClosed         = errors.New("authorization is no longer open")
+	ErrCaptureExceedsAuthorization = errors.New("capture exceeds the authorized amount")
+)
+
+// defaultAuthorizationTTL applies when the client does not say when a hold expires
+const defaultAuthorizationTTL = 7 * 24 * time.Hour
+
 type InMemoryStorage struct {
-	mu       sync.RWMutex
-	payments map[uuid.UUID]*models.PaymentRecord
-	config   *models.Config
+	mu            sync.RWMutex
+	payments      map[uuid.UUID]*models.PaymentRecord
+	byCorrelation map[string]*models.PaymentRecord
+	refunds       map[string]*models.RefundRecord
+	// Holds keyed by both their ID and correlationId
+	authorizations map[string]*models.AuthorizationRecord
+	config         *models.Config
 }
 
 func NewInMemoryStorage(feePercentage float64, minResponseTime int) *InMemoryStorage {
 	return &InMemoryStorage{
-		payments: make(map[uuid.UUID]*models.PaymentRecord),
+		payments:       make(map[uuid.UUID]*models.PaymentRecord),
+		byCorrelation:  make(map[string]*models.PaymentRecord),
+		refunds:        make(map[string]*models.RefundRecord),
+		authorizations: make(map[string]*models.AuthorizationRecord),
 		config: &models.Config{
 			Token:           "123", // Default token
 			Delay:           0,
@@ -30,13 +53,188 @@ func (s *InMemoryStorage) StorePayment(record *models.PaymentRecord) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.payments[record.ID] = record
+	s.byCorrelation[record.CorrelationID] = record
 }
 
 func (s *InMemoryStorage) GetPayment(id uuid.UUID) (*models.PaymentRecord, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	record, exists := s.payments[id]
-	return record, exists
+	return copyPayment(record), exists
+}
+
+func (s *InMemoryStorage) GetPaymentByCorrelationID(correlationID string) (*models.PaymentRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, exists := s.byCorrelation[correlationID]
+	return copyPayment(record), exists
+}
+
+// copyPayment copies a stored payment so it can be read, or marshalled,
+// after the lock is released while refunds update the original.
+func copyPayment(record *models.PaymentRecord) *models.PaymentRecord {
+	if record == nil {
+		return nil
+	}
+	copied := *record
+	return &copied
+}
+
+// copyAuthorization is copyPayment for holds, which captures and voids update.
+func copyAuthorization(auth *models.AuthorizationRecord) *models.AuthorizationRecord {
+	copied := *auth
+	return &copied
+}
+
+// RefundPayment reverses amount of the payment with the given payment ID or
+// correlationId. Repeating a refund ID returns the refund already made
+// instead of refunding twice.
+func (s *InMemoryStorage) RefundPayment(id string, refundID string, amount float64) (*models.RefundRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	var payment *models.PaymentRecord
+	if paymentID, err := uuid.Parse(id); err == nil {
+		payment = s.payments[paymentID]
+	}
+	if payment == nil {
+		payment = s.byCorrelation[id]
+	}
+	if payment == nil {
+		return nil, ErrPaymentNotFound
+	}
+	
+	if existing, exists := s.refunds[refundID]; exists {
+		if existing.PaymentID != payment.ID || existing.Amount != amount {
+			return nil, ErrRefundMismatch
+		}
+		return existing, nil
+	}
+	
+	// Compare in cents so float rounding never blocks a full refund
+	if math.Round((payment.RefundedAmount+amount)*100) > math.Round(payment.Amount*100) {
+		return nil, ErrRefundExceedsPayment
+	}
+	
+	refund := &models.RefundRecord{
+		ID:            refundID,
+		PaymentID:     payment.ID,
+		CorrelationID: payment.CorrelationID,
+		Amount:        amount,
+		RefundedAt:    time.Now(),
+	}
+	payment.RefundedAmount += amount
+	s.refunds[refundID] = refund
+	return refund, nil
+}
+
+// Authorize places a hold for the request. Repeating it returns the
+// existing hold.
+func (s *InMemoryStorage) Authorize(req *models.AuthorizationRequest) (*models.AuthorizationRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	if existing, exists := s.authorizations[req.CorrelationID]; exists {
+		if existing.Amount != req.Amount || existing.Currency != req.Currency {
+			return nil, ErrAuthorizationMismatch
+		}
+		return copyAuthorization(existing), nil
+	}
+	if _, exists := s.byCorrelation[req.CorrelationID]; exists {
+		return nil, ErrAuthorizationMismatch
+	}
+	
+	now := time.Now()
+	expiresAt := req.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(defaultAuthorizationTTL)
+	}
+	
+	auth := &models.AuthorizationRecord{
+		ID:            uuid.New(),
+		CorrelationID: req.CorrelationID,
+		Amount:        req.Amount,
+		Currency:      req.Currency,
+		Status:        models.AuthorizationAuthorized,
+		AuthorizedAt:  now,
+		ExpiresAt:     expiresAt,
+	}
+	s.authorizations[auth.ID.String()] = auth
+	s.authorizations[auth.CorrelationID] = auth
+	return copyAuthorization(auth), nil
+}
+
+// Capture charges amount of the hold with the given ID or correlationId,
+// zero meaning all of it, and stores the resulting payment. Repeating a
+// capture returns the payment already made.
+func (s *InMemoryStorage) Capture(id string, amount float64) (*models.PaymentRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	auth, err := s.openAuthorizationLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	if amount == 0 {
+		amount = auth.Amount
+	}
+	if auth.Status == models.AuthorizationCaptured && auth.CapturedAmount == amount {
+		return copyPayment(s.byCorrelation[auth.CorrelationID]), nil
+	}
+	if auth.Status != models.AuthorizationAuthorized {
+		return nil, ErrAuthorizationClosed
+	}
+	if math.Round(amount*100) > math.Round(auth.Amount*100) {
+		return nil, ErrCaptureExceedsAuthorization
+	}
+	
+	record := &models.PaymentRecord{
+		ID:            uuid.New(),
+		CorrelationID: auth.CorrelationID,
+		Amount:        amount,
+		Currency:      auth.Currency,
+		RequestedAt:   auth.AuthorizedAt,
+		ProcessedAt:   time.Now(),
+		Fee:           amount * s.config.FeePercentage / 100,
+	}
+	s.payments[record.ID] = record
+	s.byCorrelation[record.CorrelationID] = record
+	
+	auth.Status = models.AuthorizationCaptured
+	auth.CapturedAmount = amount
+	return copyPayment(record), nil
+}
+
+// Void releases the hold with the given ID or correlationId.
+func (s *InMemoryStorage) Void(id string) (*models.AuthorizationRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	auth, err := s.openAuthorizationLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	switch auth.Status {
+	case models.AuthorizationVoided:
+		return copyAuthorization(auth), nil
+	case models.AuthorizationAuthorized:
+		auth.Status = models.AuthorizationVoided
+		return copyAuthorization(auth), nil
+	default:
+		return nil, ErrAuthorizationClosed
+	}
+}
+
+// openAuthorizationLocked finds a hold, first expiring it if it lapsed.
+func (s *InMemoryStorage) openAuthorizationLocked(id string) (*models.AuthorizationRecord, error) {
+	auth, exists := s.authorizations[id]
+	if !exists {
+		return nil, ErrAuthorizationNotFound
+	}
+	if auth.Status == models.AuthorizationAuthorized && !time.Now().Before(auth.ExpiresAt) {
+		auth.Status = models.AuthorizationExpired
+	}
+	return auth, nil
 }
 
 func (s *InMemoryStorage) GetPaymentsSummary(from, to *time.Time) models.PaymentSummary {
@@ -61,6 +259,18 @@ func (s *InMemoryStorage) GetPaymentsSummary(from, to *time.Time) models.Payment
 		summary.TotalFee += record.Fee
 	}
 	
+	for _, refund := range s.refunds {
+		if from != nil && refund.RefundedAt.Before(*from) {
+			continue
+		}
+		if to != nil && refund.RefundedAt.After(*to) {
+			continue
+		}
+		
+		summary.TotalRefunds++
+		summary.TotalRefundedAmount += refund.Amount
+	}
+	
 	return summary
 }
 
@@ -80,4 +290,7 @@ func (s *InMemoryStorage) PurgePayments() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.payments = make(map[uuid.UUID]*models.PaymentRecord)
+	s.byCorrelation = make(map[string]*models.PaymentRecord)
+	s.refunds = make(map[string]*models.RefundRecord)
+	s.authorizations = make(map[string]*models.AuthorizationRecord)
 }